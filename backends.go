@@ -1,56 +1,330 @@
 package tokenmanager
 
 import (
+	"cmp"
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/redis/go-redis/v9"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
 )
 
 type bUserTokenInfo struct {
-	TokenString string // literal TokenString String
-	TokenData   string // unmarshal token data
+	TokenString string    // literal TokenString String
+	TokenData   string    // unmarshal token data
+	ExpiresAt   time.Time // user token score
+	Metadata    map[string]string
+	Fingerprint string    // Fingerprint of TokenString
+	Revoked     bool      // soft revoked, in its grace period
+	CreatedAt   time.Time // when the token was saved, zero when unknown
+
+	opts *options // decodes TokenData, the defaults when nil
+}
+
+// Unmarshal decodes TokenData into dest with the configured codec, reading older
+// payload versions like LoadTokenInto
+func (t *bUserTokenInfo) Unmarshal(dest any) error {
+	o := t.opts
+	if o == nil {
+		o = defaultOptions
+	}
+	return o.decodePayload([]byte(t.TokenData), dest)
+}
+
+// AsString returns TokenData as stored
+func (t *bUserTokenInfo) AsString() string {
+	return t.TokenData
+}
+
+// orphanedToken is the ErrOrphanedToken of a user token whose value is gone,
+// naming the token by its fingerprint
+func orphanedToken(tokenString string) error {
+	return fmt.Errorf("%w: %s", ErrOrphanedToken, Fingerprint(tokenString))
+}
+
+// ScopeMetadataKey is the metadata entry listing the scopes a user token grants,
+// separated by spaces like an OAuth scope, for LoadTokensWithScope
+const ScopeMetadataKey = "scope"
+
+// scopes returns the scopes metadata grants
+func scopes(metadata map[string]string) []string {
+	return strings.Fields(metadata[ScopeMetadataKey])
+}
+
+// withScope returns the user tokens of list granting scope
+func withScope(list []*bUserTokenInfo, scope string) []*bUserTokenInfo {
+	granted := make([]*bUserTokenInfo, 0)
+	for _, userToken := range list {
+		if slices.Contains(scopes(userToken.Metadata), scope) {
+			granted = append(granted, userToken)
+		}
+	}
+	return granted
+}
+
+// UserTokenDebug is a raw user token entry, as stored, for inspecting inconsistencies
+type UserTokenDebug struct {
+	TokenString string
+	Score       int64         // user token score, the expiry in unix seconds
+	TTL         time.Duration // remaining TTL of the value, -1 for none, -2 when missing
+	Exists      bool          // whether the value still exists
+}
+
+// TokenEntry is a token made elsewhere, e.g. by a system sessions are migrated from
+type TokenEntry struct {
+	Token     string
+	Value     interface{}
+	ExpiresAt time.Time
+	Metadata  map[string]string
 }
 
 type backend interface {
 	saveToken(ctx context.Context, token string, value interface{}, expire time.Duration) (bool, error)
 	loadToken(ctx context.Context, token string) (string, error)
+	loadTokenWithTTL(ctx context.Context, token string) (string, time.Duration, error)
 	deleteToken(ctx context.Context, tokens ...string) error
+	deleteTokenIfValue(ctx context.Context, token string, expected string) (bool, error)
+	updateTokenValue(ctx context.Context, token string, value interface{}) error
+	updateTokenValueIfActive(ctx context.Context, userId string, token string, value interface{}) error
 	isTokenExist(ctx context.Context, token string) (bool, error)
+	areTokensExist(ctx context.Context, tokens ...string) (map[string]bool, error)
+	revokeToken(ctx context.Context, token string) error
 
-	cleanupUserToken(ctx context.Context, userId string) error
-	saveUserToken(ctx context.Context, userId string, genToken func() (string, error), value interface{}, expiresIn time.Duration) (string, error)
+	softRevokeUserToken(ctx context.Context, userId string, token string, grace time.Duration) error
+	cleanupUserToken(ctx context.Context, userId string) (int64, error)
+	previewCleanupUserToken(ctx context.Context, userId string) ([]string, error)
+	saveUserToken(ctx context.Context, userId string, genToken func() (string, error), value interface{}, expiresIn time.Duration, metadata map[string]string) (string, error)
+	saveTokenPair(ctx context.Context, userId string, genAccess, genRefresh func() (string, error), accessValue, refreshValue interface{}, accessTTL, refreshTTL time.Duration, metadata map[string]string) (string, string, error)
+	saveUnconfirmedUserToken(ctx context.Context, userId string, genToken func() (string, error), value interface{}, expiresIn time.Duration) (string, error)
+	confirmUserToken(ctx context.Context, userId string, tokenString string) error
+	getOrCreateUserToken(ctx context.Context, userId string, genToken func() (string, error), value interface{}, expiresIn time.Duration) (string, bool, error)
+	saveUserTokenWithId(ctx context.Context, userId string, token string, value interface{}, expiresIn time.Duration) (bool, error)
+	saveUserTokens(ctx context.Context, userId string, entries []TokenEntry) error
+	saveUserTokenPipe(ctx context.Context, pipe redis.Pipeliner, userId string, genToken func() (string, error), value interface{}, expiresIn time.Duration) (string, func() error, error)
+	deleteUserTokenPipe(ctx context.Context, pipe redis.Pipeliner, userId string, tokens ...string) func() error
 	loadUserToken(ctx context.Context, userId string, tokenString string) (*bUserTokenInfo, error)
 	loadUserTokenList(ctx context.Context, userId string) ([]*bUserTokenInfo, error)
-	deleteUserToken(ctx context.Context, userId string, tokens ...string) error
+	loadUserTokensWithScope(ctx context.Context, userId string, scope string) ([]*bUserTokenInfo, error)
+	loadUserTokenListPaged(ctx context.Context, userId string, offset, limit int64) ([]*bUserTokenInfo, int64, error)
+	deleteUserToken(ctx context.Context, userId string, tokens ...string) (int64, error)
+	deleteAllUserTokens(ctx context.Context, userIds ...string) error
+	moveUserTokens(ctx context.Context, fromUserId string, toUserId string) error
+	deleteUserTokensExcept(ctx context.Context, userId string, keepToken string) error
+	countUserTokens(ctx context.Context, userId string) (int64, error)
+	userTokenExists(ctx context.Context, userId string, tokenString string) (bool, error)
+	refreshUserToken(ctx context.Context, userId string, tokenString string, expiresIn time.Duration) error
+	extendAllUserTokens(ctx context.Context, userId string, expiresIn time.Duration) error
+	rotateUserToken(ctx context.Context, userId string, oldToken string, genToken func() (string, error), value interface{}, expiresIn time.Duration) (string, error)
+	userIdForToken(ctx context.Context, tokenString string) (string, error)
+	reconcileUserToken(ctx context.Context, userId string, tokenString string) error
+	dumpUserTokens(ctx context.Context, userId string) ([]UserTokenDebug, error)
+	scanUserIds(ctx context.Context, fn func(userId string) error) error
+	watchRevocations(ctx context.Context, fn func(token string)) error
+	iterateUserTokens(ctx context.Context, userId string, fn func(*bUserTokenInfo) error) error
+
+	ping(ctx context.Context) error
+	close() error
+
+	// bind hands the applied options to the backend
+	bind(opts *options)
 }
 
-type redisBackend struct {
+// Backend is a token storage usable with WithBackend.
+type Backend interface {
 	backend
-	client *redis.Client
+}
+
+type redisBackend struct {
+	opts   *options
+	client redis.UniversalClient
+	// cluster disables multi-key commands, whose keys may hash to different slots.
+	cluster bool
+}
+
+// NewClusterBackend returns a backend for a Redis Cluster, or any other
+// redis.UniversalClient whose keys may be spread over several nodes.
+func NewClusterBackend(client redis.UniversalClient) Backend {
+	return &redisBackend{
+		opts:    defaultOptions,
+		client:  client,
+		cluster: true,
+	}
+}
+
+// NewBackend builds a client from opts, honoring its DB, Username and Password,
+// and returns a backend on it together with the client, to be closed by the caller.
+func NewBackend(opts *redis.Options) (Backend, *redis.Client) {
+	client := redis.NewClient(opts)
+	return &redisBackend{
+		opts:   defaultOptions,
+		client: client,
+	}, client
+}
+
+// NewSentinelBackend returns a backend talking to the master elected by Redis Sentinel.
+// The failover client is a plain *redis.Client, so every command works as with WithRedisBackend.
+func NewSentinelBackend(opts *redis.FailoverOptions) Backend {
+	return &redisBackend{
+		opts:   defaultOptions,
+		client: redis.NewFailoverClient(opts),
+	}
+}
+
+func (r *redisBackend) bind(opts *options) {
+	r.opts = opts
+}
+
+// reader is the client of read only commands, the WithReadClient one if set
+func (r *redisBackend) reader() redis.UniversalClient {
+	if r.opts.readClient != nil {
+		return r.opts.readClient
+	}
+	return r.client
+}
+
+// joinKey joins the segments of a key behind the WithNamespace segment, if any
+func (r *redisBackend) joinKey(segments ...string) string {
+	if r.opts.namespace != "" {
+		segments = append([]string{r.opts.namespace}, segments...)
+	}
+	return strings.Join(segments, ":")
 }
 
 func (r *redisBackend) getUserTokenKey(userId string) string {
-	return strings.Join([]string{
-		"USER_TOKENS",
-		userId,
-	}, ":")
+	return r.joinKey(r.opts.userTokenPrefix, r.userSegment(userId))
+}
+
+// getUserTokenCreatedKey scores the user tokens by when they were saved
+func (r *redisBackend) getUserTokenCreatedKey(userId string) string {
+	return r.joinKey(r.opts.userTokenPrefix+"_CREATED", r.userSegment(userId))
+}
+
+// getUserTokenScopeKey scores the user tokens granting scope by expiry, like the user token key
+func (r *redisBackend) getUserTokenScopeKey(userId string, scope string) string {
+	return r.joinKey(r.opts.userTokenPrefix+"_SCOPE", r.userSegment(userId), scope)
+}
+
+// userSegment is the key segment of userId, wrapped in a hash tag under
+// WithKeyTagging so every key of the user hashes to the same cluster slot
+func (r *redisBackend) userSegment(userId string) string {
+	if !r.opts.keyTagging {
+		return userId
+	}
+	return "{" + userId + "}"
+}
+
+// tokenKey joins the key of a token of userId, behind the user hash tag under
+// WithKeyTagging. userId is "" for a token saved on its own.
+func (r *redisBackend) tokenKey(prefix string, userId string, tokenString string) string {
+	if !r.opts.keyTagging || userId == "" {
+		return r.joinKey(prefix, r.hashToken(tokenString))
+	}
+	return r.joinKey(prefix, r.userSegment(userId), r.hashToken(tokenString))
+}
+
+// tokenOwner returns the user whose tagged keys hold the token under
+// WithKeyTagging, "" for a token saved on its own or without tagging
+func (r *redisBackend) tokenOwner(ctx context.Context, tokenString string) (string, error) {
+	if !r.opts.keyTagging {
+		return "", nil
+	}
+	userId, err := r.client.Get(ctx, r.getTokenOwnerKey(tokenString)).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", nil
+	}
+	return userId, err
+}
+
+// splitSlots reports whether the keys of one user may hash to different slots,
+// ruling out the scripts that touch them together
+func (r *redisBackend) splitSlots() bool {
+	return r.cluster && !r.opts.keyTagging
+}
+
+// hashToken returns the form of tokenString used inside token keys
+func (r *redisBackend) hashToken(tokenString string) string {
+	if r.opts.tokenHash == nil {
+		return tokenString
+	}
+	return r.opts.tokenHash(tokenString)
+}
+
+func (r *redisBackend) getTokenMetaKey(userId string, tokenString string) string {
+	return r.tokenKey("TOKEN_META", userId, tokenString)
+}
+
+// getTokenOwnerKey is never tagged, it is how a token alone finds its user
+func (r *redisBackend) getTokenOwnerKey(tokenString string) string {
+	return r.joinKey("TOKEN_OWNERS", r.hashToken(tokenString))
 }
 
-func (r *redisBackend) getTokenKey(tokenString string) string {
-	return strings.Join([]string{
-		"TOKENS",
-		tokenString,
-	}, ":")
+// getTokenPairKey holds the other token of the pair the token was saved in
+func (r *redisBackend) getTokenPairKey(userId string, tokenString string) string {
+	return r.tokenKey("TOKEN_PAIRS", userId, tokenString)
+}
+
+func (r *redisBackend) getUnconfirmedTokenKey(userId string, tokenString string) string {
+	return r.tokenKey("UNCONFIRMED_TOKENS", userId, tokenString)
+}
+
+// tokenKeys returns every key holding data of the token, not counting its revocation
+func (r *redisBackend) tokenKeys(userId string, tokenString string) []string {
+	keys := []string{r.getTokenKey(userId, tokenString), r.getTokenMetaKey(userId, tokenString), r.getUnconfirmedTokenKey(userId, tokenString), r.getTokenPairKey(userId, tokenString)}
+	if r.opts.ownerIndex {
+		keys = append(keys, r.getTokenOwnerKey(tokenString))
+	}
+	return keys
+}
+
+func (r *redisBackend) getRevokedTokenKey(userId string, tokenString string) string {
+	return r.tokenKey("REVOKED_TOKENS", userId, tokenString)
+}
+
+func (r *redisBackend) getIssueRateKey(userId string) string {
+	return r.joinKey("TOKEN_ISSUE_RATE", userId)
+}
+
+// checkIssueRate counts a token issue of the user and fails with ErrRateLimited
+// once more than WithIssueRateLimit allows were issued in the current window.
+func (r *redisBackend) checkIssueRate(ctx context.Context, userId string) error {
+	if r.opts.issueRateMax <= 0 {
+		return nil
+	}
+	n, err := issueRateScript.Run(ctx, r.client, []string{r.getIssueRateKey(userId)}, ttlMillis(r.opts.issueRateWindow)).Int64()
+	if err != nil {
+		return err
+	}
+	if n > int64(r.opts.issueRateMax) {
+		return ErrRateLimited
+	}
+	return nil
+}
+
+func (r *redisBackend) getTokenKey(userId string, tokenString string) string {
+	return r.tokenKey(r.opts.tokenPrefix, userId, tokenString)
 }
 
 func (r *redisBackend) saveToken(ctx context.Context, token string, value interface{}, expire time.Duration) (bool, error) {
+	return r.saveTokenOf(ctx, "", token, value, expire)
+}
+
+// saveTokenOf is saveToken writing the token key of userId
+func (r *redisBackend) saveTokenOf(ctx context.Context, userId string, token string, value interface{}, expire time.Duration) (bool, error) {
+	if expire < 0 {
+		return false, ErrInvalidExpiry
+	}
+	v, err := r.opts.encodeValue(value)
+	if err != nil {
+		return false, err
+	}
 	result, err := r.client.SetNX(
 		ctx,
-		r.getTokenKey(token),
-		value,
+		r.getTokenKey(userId, token),
+		v,
 		expire,
 	).Result()
 	if err != nil {
@@ -60,143 +334,2213 @@ func (r *redisBackend) saveToken(ctx context.Context, token string, value interf
 }
 
 func (r *redisBackend) loadToken(ctx context.Context, token string) (string, error) {
-	key := r.getTokenKey(token)
+	value, _, err := r.loadTokenWithTTL(ctx, token)
+	return value, err
+}
+
+// loadTokenWithTTL is loadToken also returning the remaining lifetime of the
+// token, 0 for a token without expiry.
+func (r *redisBackend) loadTokenWithTTL(ctx context.Context, token string) (string, time.Duration, error) {
+	userId, err := r.tokenOwner(ctx, token)
+	if err != nil {
+		return "", 0, err
+	}
+	return r.loadTokenOf(ctx, userId, token)
+}
+
+// loadTokenOf is loadTokenWithTTL reading the token keys of userId
+func (r *redisBackend) loadTokenOf(ctx context.Context, userId string, token string) (string, time.Duration, error) {
+	key := r.getTokenKey(userId, token)
+
+	var get *redis.StringCmd
+	var pttl *redis.DurationCmd
+	var revoked, unconfirmed *redis.IntCmd
+	_, err := r.reader().Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		get = pipe.Get(ctx, key)
+		pttl = pipe.PTTL(ctx, key)
+		revoked = pipe.Exists(ctx, r.getRevokedTokenKey(userId, token))
+		unconfirmed = pipe.Exists(ctx, r.getUnconfirmedTokenKey(userId, token))
+		return nil
+	})
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return "", 0, err
+	}
+	if revoked.Val() > 0 {
+		return "", 0, ErrTokenRevoked
+	}
+	if unconfirmed.Val() > 0 {
+		return "", 0, ErrTokenUnconfirmed
+	}
 
-	result, err := r.client.Get(ctx, key).Result()
+	result, err := get.Result()
 	if err != nil {
 		if errors.Is(err, redis.Nil) {
-			return "", ErrTokenNotFound
+			return "", 0, ErrTokenNotFound
 		}
-		return "", err
+		return "", 0, err
 	}
-	return result, nil
+	ttl := pttl.Val()
+	if ttl < 0 {
+		ttl = 0
+	}
+	return result, ttl, nil
 }
-func (r *redisBackend) deleteToken(ctx context.Context, tokens ...string) error {
-	tokensForDelete := make([]string, len(tokens))
 
-	for i, token := range tokens {
-		key := r.getTokenKey(token)
-		tokensForDelete[i] = key
+// deleteTokenIfValue deletes the token only while it still holds expected, so a
+// caller holding a stale value can't delete what replaced it.
+func (r *redisBackend) deleteTokenIfValue(ctx context.Context, token string, expected string) (bool, error) {
+	userId, err := r.tokenOwner(ctx, token)
+	if err != nil {
+		return false, err
+	}
+	keys := r.tokenKeys(userId, token)
+	if r.cluster {
+		// the other keys may live in other slots, they go once the value is gone
+		ok, err := deleteTokenIfValueScript.Run(ctx, r.client, keys[:1], expected).Bool()
+		if err != nil || !ok {
+			return false, err
+		}
+		return true, r.unlink(ctx, keys[1:]...)
 	}
+	return deleteTokenIfValueScript.Run(ctx, r.client, keys, expected).Bool()
+}
 
-	return r.client.Unlink(ctx, tokensForDelete...).Err()
+// updateTokenValue replaces the value of the token, keeping its TTL
+func (r *redisBackend) updateTokenValue(ctx context.Context, token string, value interface{}) error {
+	v, err := r.opts.encodeValue(value)
+	if err != nil {
+		return err
+	}
+	userId, err := r.tokenOwner(ctx, token)
+	if err != nil {
+		return err
+	}
+	err = r.client.SetArgs(ctx, r.getTokenKey(userId, token), v, redis.SetArgs{Mode: "XX", KeepTTL: true}).Err()
+	if errors.Is(err, redis.Nil) {
+		return ErrTokenNotFound
+	}
+	return err
 }
 
-func (r *redisBackend) extendTokenExpire(ctx context.Context, tokenString string, expire time.Duration) (bool, error) {
-	return r.client.Expire(ctx, r.getTokenKey(tokenString), expire).Result()
+// updateTokenValueIfActive replaces the value of a user token keeping its TTL,
+// unless it was revoked or left the user tokens, in one script so a revocation
+// can't slip in between the checks and the write
+func (r *redisBackend) updateTokenValueIfActive(ctx context.Context, userId string, token string, value interface{}) error {
+	if r.splitSlots() {
+		// the script needs the token and user token keys in one slot
+		return ErrNotSupported
+	}
+	v, err := r.opts.encodeValue(value)
+	if err != nil {
+		return err
+	}
+	keys := []string{r.getUserTokenKey(userId), r.getTokenKey(userId, token), r.getRevokedTokenKey(userId, token)}
+	n, err := updateActiveUserTokenScript.Run(ctx, r.client, keys, token, v, r.opts.now().Unix()).Int()
+	if err != nil {
+		return err
+	}
+	switch n {
+	case -1:
+		return ErrTokenNotFound
+	case -2:
+		return ErrTokenRevoked
+	}
+	return nil
 }
 
-func (r *redisBackend) isTokenExist(ctx context.Context, token string) (bool, error) {
-	key := r.getTokenKey(token)
+// partnerToken returns the other token of the pair of token, "" if it wasn't saved in one
+func (r *redisBackend) partnerToken(ctx context.Context, userId string, token string) (string, error) {
+	partner, err := r.client.Get(ctx, r.getTokenPairKey(userId, token)).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", nil
+	}
+	return partner, err
+}
 
-	count, err := r.client.Exists(ctx, key).Result()
+// revokeToken marks the token revoked until the token itself expires, along
+// with the other token of its pair
+func (r *redisBackend) revokeToken(ctx context.Context, token string) error {
+	userId, err := r.tokenOwner(ctx, token)
 	if err != nil {
-		return false, err
+		return err
 	}
-	if count <= 0 {
-		return false, nil
-	} else {
-		return true, nil
+	partner, err := r.partnerToken(ctx, userId, token)
+	if err != nil {
+		return err
+	}
+	if err := r.revokeSingleToken(ctx, userId, token); err != nil {
+		return err
+	}
+	if partner == "" {
+		return nil
+	}
+	if err := r.revokeSingleToken(ctx, userId, partner); !errors.Is(err, ErrTokenNotFound) {
+		return err
 	}
+	return nil
 }
 
-func (r *redisBackend) cleanupUserToken(ctx context.Context, userId string) error {
-	key := r.getUserTokenKey(userId)
-
-	now := time.Now().UTC().Unix()
-	err := r.client.ZRemRangeByScore(ctx, key, "0", strconv.FormatInt(now, 10)).Err()
+func (r *redisBackend) revokeSingleToken(ctx context.Context, userId string, token string) error {
+	ttl, err := r.client.PTTL(ctx, r.getTokenKey(userId, token)).Result()
 	if err != nil {
 		return err
 	}
-	userTokens, err := r.client.ZRange(ctx, key, 0, -1).Result()
+	switch {
+	case ttl == -2:
+		return ErrTokenNotFound
+	case ttl < 0:
+		ttl = 0
+	}
+	err = r.client.Set(ctx, r.getRevokedTokenKey(userId, token), 1, ttl).Err()
 	if err != nil {
 		return err
 	}
+	r.publishRevocation(ctx, userId, token)
+	return nil
+}
 
-	tokensForDelete := make([]interface{}, 0)
-	for _, token := range userTokens {
-		ex, err := r.isTokenExist(ctx, token)
-		if err != nil {
-			return err
-		}
-		if !ex {
-			tokensForDelete = append(tokensForDelete, token)
-		}
+// publishRevocation announces token on the WithRevocationChannel channel, if any.
+// The token goes out the way it is stored, hashed under WithTokenHashing.
+func (r *redisBackend) publishRevocation(ctx context.Context, userId string, token string) {
+	if r.opts.revocationChannel == "" {
+		return
 	}
-	return r.client.ZRem(ctx, key, tokensForDelete...).Err()
+	r.opts.warn(ctx, "publish", userId, r.client.Publish(ctx, r.joinKey(r.opts.revocationChannel), r.hashToken(token)).Err())
 }
 
-func (r *redisBackend) saveUserToken(ctx context.Context, userId string, genToken func() (string, error), value interface{}, expiresIn time.Duration) (string, error) {
-	_ = r.cleanupUserToken(ctx, userId)
-	key := r.getUserTokenKey(userId)
-	for {
-		now := time.Now().UTC()
-		expire := now.Add(expiresIn).UTC()
+// softRevokedMarker is the value of the revocation of a soft revoked token
+const softRevokedMarker = "soft"
 
-		token, err := genToken()
-		if err != nil {
-			return "", err
-		}
+// softRevokeUserToken revokes a token of the user and the other token of its
+// pair, leaving them loadable by loadUserToken, flagged Revoked, until they
+// expire grace from now.
+func (r *redisBackend) softRevokeUserToken(ctx context.Context, userId string, token string, grace time.Duration) error {
+	partner, err := r.partnerToken(ctx, userId, token)
+	if err != nil {
+		return err
+	}
+	if err := r.softRevokeSingleUserToken(ctx, userId, token, grace); err != nil {
+		return err
+	}
+	if partner == "" {
+		return nil
+	}
+	if err := r.softRevokeSingleUserToken(ctx, userId, partner, grace); !errors.Is(err, ErrTokenNotFound) {
+		return err
+	}
+	return nil
+}
 
-		ok, err := r.saveToken(ctx, token, value, expire.Sub(now))
-		if err != nil {
-			return "", err
+func (r *redisBackend) softRevokeSingleUserToken(ctx context.Context, userId string, token string, grace time.Duration) error {
+	key := r.getUserTokenKey(userId)
+	score, err := r.client.ZScore(ctx, key, token).Result()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return ErrTokenNotFound
 		}
-		if ok {
-			err = r.client.ZAdd(ctx, key, redis.Z{
-				Member: token,
-				Score:  float64(expire.Unix()),
-			}).Err()
-			//r.client.Expire(ctx, key, expire.Sub(time.Now().UTC()))
+		return err
+	}
 
-			if err != nil {
-				_ = r.deleteToken(ctx, token)
-				return "", err
-			}
-			return token, nil
+	now := r.opts.now()
+	expire := now.Add(grace).UTC()
+	if scoreExpire := time.Unix(int64(score), 0); scoreExpire.Before(expire) {
+		expire = scoreExpire
+	}
+	if !expire.After(now) {
+		return ErrTokenNotFound
+	}
+	ttl := expire.Sub(now)
+	_, err = r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, r.getRevokedTokenKey(userId, token), softRevokedMarker, ttl)
+		for _, k := range r.tokenKeys(userId, token) {
+			pipe.PExpire(ctx, k, ttl)
 		}
+		pipe.ZAddXX(ctx, key, redis.Z{Score: float64(expireScore(expire)), Member: token})
+		return nil
+	})
+	if err != nil {
+		return err
 	}
+	r.publishRevocation(ctx, userId, token)
+	return nil
 }
 
-// user TokenString 내에 없으면 토큰도 지워줌
-func (r *redisBackend) loadUserToken(ctx context.Context, userId string, tokenString string) (*bUserTokenInfo, error) {
-	_ = r.cleanupUserToken(ctx, userId)
-	key := r.getUserTokenKey(userId)
-
-	_, err := r.client.ZScore(ctx, key, tokenString).Result()
+// loadSoftRevokedUserToken loads a token of the user in its soft revocation grace
+// period, failing with ErrTokenRevoked for a token revoked by revokeToken.
+func (r *redisBackend) loadSoftRevokedUserToken(ctx context.Context, userId string, tokenString string, score float64) (*bUserTokenInfo, error) {
+	var marker, get *redis.StringCmd
+	_, err := r.reader().Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		marker = pipe.Get(ctx, r.getRevokedTokenKey(userId, tokenString))
+		get = pipe.Get(ctx, r.getTokenKey(userId, tokenString))
+		return nil
+	})
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return nil, err
+	}
+	if marker.Val() != softRevokedMarker {
+		return nil, ErrTokenRevoked
+	}
+	data, err := get.Result()
 	if err != nil {
 		if errors.Is(err, redis.Nil) {
-			_ = r.deleteToken(ctx, tokenString)
 			return nil, ErrTokenNotFound
 		}
 		return nil, err
 	}
-
-	data, err := r.loadToken(ctx, tokenString)
+	metadata, err := r.loadTokenMeta(ctx, userId, tokenString)
+	if err != nil {
+		return nil, err
+	}
+	created, err := r.loadCreated(ctx, userId, tokenString)
 	if err != nil {
 		return nil, err
 	}
 	return &bUserTokenInfo{
 		TokenString: tokenString,
+		Fingerprint: Fingerprint(tokenString),
 		TokenData:   data,
+		ExpiresAt:   time.Unix(int64(score), 0).UTC(),
+		Metadata:    metadata[0],
+		Revoked:     true,
+		CreatedAt:   created[0],
+		opts:        r.opts,
 	}, nil
 }
 
-func (r *redisBackend) loadUserTokenList(ctx context.Context, userId string) ([]*bUserTokenInfo, error) {
-	_ = r.cleanupUserToken(ctx, userId)
-	key := r.getUserTokenKey(userId)
+func (r *redisBackend) deleteToken(ctx context.Context, tokens ...string) error {
+	tokensForDelete := make([]string, 0, len(tokens)*3)
 
-	tokenStringList, err := r.client.ZRange(ctx, key, 0, -1).Result()
-	if err != nil {
-		return nil, err
+	for _, token := range tokens {
+		userId, err := r.tokenOwner(ctx, token)
+		if err != nil {
+			return err
+		}
+		tokensForDelete = append(tokensForDelete, r.tokenKeys(userId, token)...)
+	}
+
+	return r.unlink(ctx, tokensForDelete...)
+}
+
+func (r *redisBackend) unlink(ctx context.Context, keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	if !r.cluster {
+		var err error
+		for _, batch := range r.batches(len(keys)) {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if batchErr := r.client.Unlink(ctx, keys[batch[0]:batch[1]]...).Err(); err == nil {
+				err = batchErr
+			}
+		}
+		return err
+	}
+
+	// one UNLINK per key; the cluster pipeline routes each to its own slot
+	return r.pipelined(ctx, r.client, len(keys), func(pipe redis.Pipeliner, i int) {
+		pipe.Unlink(ctx, keys[i])
+	})
+}
+
+// batches splits n commands or keys into [start, end) ranges of at most
+// WithPipelineBatchSize
+func (r *redisBackend) batches(n int) [][2]int {
+	size := r.opts.pipelineBatchSize
+	if size <= 0 || size > n {
+		size = max(n, 1)
+	}
+	batches := make([][2]int, 0, (n+size-1)/size)
+	for start := 0; start < n; start += size {
+		batches = append(batches, [2]int{start, min(start+size, n)})
+	}
+	return batches
+}
+
+// pipelined runs fn for every i below n, fn queuing the commands of i, in one
+// pipeline per batch. Every batch runs, the first failing one is reported.
+func (r *redisBackend) pipelined(ctx context.Context, client redis.UniversalClient, n int, fn func(pipe redis.Pipeliner, i int)) error {
+	var err error
+	for _, batch := range r.batches(n) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		_, batchErr := client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for i := batch[0]; i < batch[1]; i++ {
+				fn(pipe, i)
+			}
+			return nil
+		})
+		if err == nil && !errors.Is(batchErr, redis.Nil) {
+			err = batchErr
+		}
+	}
+	return err
+}
+
+// zrem removes members from the sorted set key, at most WithPipelineBatchSize per ZREM
+func (r *redisBackend) zrem(ctx context.Context, key string, members []interface{}) (int64, error) {
+	var n int64
+	for _, batch := range r.batches(len(members)) {
+		if err := ctx.Err(); err != nil {
+			return n, err
+		}
+		removed, err := r.client.ZRem(ctx, key, members[batch[0]:batch[1]]...).Result()
+		n += removed
+		if err != nil {
+			return n, err
+		}
 	}
-	userTokenList := make([]*bUserTokenInfo, 0)
-	for _, tokenString := range tokenStringList {
-		userToken, err := r.loadUserToken(ctx, userId, tokenString)
+	return n, nil
+}
+
+// extendActiveTokens moves the expiry of the token values of the user to ttl from
+// now, sparing revoked tokens, which would outlive their revocation. It returns the
+// extended tokens and those whose value is gone.
+func (r *redisBackend) extendActiveTokens(ctx context.Context, userId string, tokens []string, ttl time.Duration) ([]string, []string, error) {
+	results := make([]int64, len(tokens))
+	if r.splitSlots() {
+		// the revocation may live in another slot than the value
+		for i, token := range tokens {
+			revoked, err := r.client.Exists(ctx, r.getRevokedTokenKey(userId, token)).Result()
+			if err != nil {
+				return nil, nil, err
+			}
+			if revoked > 0 {
+				results[i] = -2
+				continue
+			}
+			ok, err := r.client.PExpire(ctx, r.getTokenKey(userId, token), ttl).Result()
+			if err != nil {
+				return nil, nil, err
+			}
+			if results[i] = 1; !ok {
+				results[i] = -1
+			}
+		}
+	} else {
+		cmds := make([]*redis.Cmd, len(tokens))
+		_, err := r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for i, token := range tokens {
+				keys := []string{r.getTokenKey(userId, token), r.getRevokedTokenKey(userId, token)}
+				cmds[i] = extendActiveTokenScript.Eval(ctx, pipe, keys, ttlMillis(ttl))
+			}
+			return nil
+		})
 		if err != nil {
-			continue
+			return nil, nil, err
+		}
+		for i, cmd := range cmds {
+			results[i] = cmd.Val().(int64)
 		}
-		userTokenList = append(userTokenList, userToken)
 	}
-	return userTokenList, nil
+
+	extended := make([]string, 0, len(tokens))
+	gone := make([]string, 0)
+	for i, token := range tokens {
+		switch results[i] {
+		case 1:
+			extended = append(extended, token)
+		case -1:
+			gone = append(gone, token)
+		}
+	}
+	return extended, gone, nil
+}
+
+func (r *redisBackend) isTokenExist(ctx context.Context, token string) (bool, error) {
+	userId, err := r.tokenOwner(ctx, token)
+	if err != nil {
+		return false, err
+	}
+	return r.tokenExists(ctx, r.reader(), userId, token)
+}
+
+func (r *redisBackend) tokenExists(ctx context.Context, client redis.UniversalClient, userId string, token string) (bool, error) {
+	key := r.getTokenKey(userId, token)
+
+	count, err := client.Exists(ctx, key).Result()
+	if err != nil {
+		return false, err
+	}
+	if count <= 0 {
+		return false, nil
+	} else {
+		return true, nil
+	}
+}
+
+func (r *redisBackend) areTokensExist(ctx context.Context, tokens ...string) (map[string]bool, error) {
+	owners := make([]string, len(tokens))
+	for i, token := range tokens {
+		userId, err := r.tokenOwner(ctx, token)
+		if err != nil {
+			return nil, err
+		}
+		owners[i] = userId
+	}
+	return r.tokensExist(ctx, r.reader(), owners, tokens)
+}
+
+// tokensExist pipelines an EXISTS per token, which stays slot safe in a cluster.
+// owners holds the user of each token, or only one for tokens of the same user.
+func (r *redisBackend) tokensExist(ctx context.Context, client redis.UniversalClient, owners []string, tokens []string) (map[string]bool, error) {
+	exists := make(map[string]bool, len(tokens))
+	if len(tokens) == 0 {
+		return exists, nil
+	}
+
+	cmds := make([]*redis.IntCmd, len(tokens))
+	err := r.pipelined(ctx, client, len(tokens), func(pipe redis.Pipeliner, i int) {
+		userId := owners[0]
+		if len(owners) > 1 {
+			userId = owners[i]
+		}
+		cmds[i] = pipe.Exists(ctx, r.getTokenKey(userId, tokens[i]))
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i, token := range tokens {
+		exists[token] = cmds[i].Val() > 0
+	}
+	return exists, nil
+}
+
+func (r *redisBackend) cleanupUserToken(ctx context.Context, userId string) (int64, error) {
+	n, err := r.sweepUserToken(ctx, userId)
+	if n > 0 {
+		r.opts.warn(ctx, "pruneCreated", userId, r.pruneCreated(ctx, userId))
+	}
+	return n, err
+}
+
+// sweepUserToken removes the expired and dangling members of the user. The script
+// lists the members itself, the client only lists them to hash their token keys.
+func (r *redisBackend) sweepUserToken(ctx context.Context, userId string) (int64, error) {
+	if r.splitSlots() {
+		return r.cleanupUserTokenPerKey(ctx, userId)
+	}
+	key := r.getUserTokenKey(userId)
+	keys := []string{key}
+	args := []interface{}{strconv.FormatInt(r.opts.now().Unix(), 10), ""}
+	if r.opts.tokenHash == nil {
+		args[1] = r.tokenKey(r.opts.tokenPrefix, userId, "")
+		return cleanupUserTokenScript.Run(ctx, r.client, keys, args...).Int64()
+	}
+
+	userTokens, err := r.client.ZRange(ctx, key, 0, -1).Result()
+	if err != nil {
+		return 0, err
+	}
+	for _, token := range userTokens {
+		keys = append(keys, r.getTokenKey(userId, token))
+		args = append(args, token)
+	}
+	return cleanupUserTokenScript.Run(ctx, r.client, keys, args...).Int64()
+}
+
+// previewCleanupUserToken returns the members cleanupUserToken would remove, the
+// expired ones and those whose value is gone, removing nothing
+func (r *redisBackend) previewCleanupUserToken(ctx context.Context, userId string) ([]string, error) {
+	members, err := r.client.ZRangeWithScores(ctx, r.getUserTokenKey(userId), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	tokens := make([]string, len(members))
+	for i, member := range members {
+		tokens[i] = member.Member.(string)
+	}
+	exists, err := r.tokensExist(ctx, r.client, []string{userId}, tokens)
+	if err != nil {
+		return nil, err
+	}
+
+	now := r.opts.now().Unix()
+	preview := make([]string, 0)
+	for _, member := range members {
+		if int64(member.Score) <= now || !exists[member.Member.(string)] {
+			preview = append(preview, member.Member.(string))
+		}
+	}
+	return preview, nil
+}
+
+// recordCreated keeps now as when token was saved, until expire
+func (r *redisBackend) recordCreated(ctx context.Context, userId string, token string, now time.Time, expire time.Time) error {
+	keys := []string{r.getUserTokenCreatedKey(userId)}
+	return recordCreatedScript.Run(ctx, r.client, keys, now.Unix(), token, expireScore(expire), now.Unix()).Err()
+}
+
+// pruneCreated drops the creation of tokens no longer members of the user. The
+// creation key may live in another slot, so it is diffed rather than intersected.
+func (r *redisBackend) pruneCreated(ctx context.Context, userId string) error {
+	key := r.getUserTokenCreatedKey(userId)
+	tokens, err := r.client.ZRange(ctx, key, 0, -1).Result()
+	if err != nil || len(tokens) == 0 {
+		return err
+	}
+	scores, err := r.client.ZMScore(ctx, r.getUserTokenKey(userId), tokens...).Result()
+	if err != nil {
+		return err
+	}
+	gone := make([]interface{}, 0)
+	for i, token := range tokens {
+		// a missing member scores 0
+		if scores[i] == 0 {
+			gone = append(gone, token)
+		}
+	}
+	_, err = r.zrem(ctx, key, gone)
+	return err
+}
+
+// loadCreated returns when each token of the user was saved, zero when unknown
+func (r *redisBackend) loadCreated(ctx context.Context, userId string, tokens ...string) ([]time.Time, error) {
+	created := make([]time.Time, len(tokens))
+	if len(tokens) == 0 {
+		return created, nil
+	}
+	scores, err := r.reader().ZMScore(ctx, r.getUserTokenCreatedKey(userId), tokens...).Result()
+	if err != nil {
+		return nil, err
+	}
+	for i, score := range scores {
+		if score != 0 {
+			created[i] = time.Unix(int64(score), 0).UTC()
+		}
+	}
+	return created, nil
+}
+
+// tryCleanupUserToken runs the cleanup ahead of an operation that doesn't depend on it
+func (r *redisBackend) tryCleanupUserToken(ctx context.Context, userId string) {
+	if r.opts.strictConsistency {
+		// the sweep would remove the orphans unseen
+		return
+	}
+	_, err := r.cleanupUserToken(ctx, userId)
+	r.opts.warn(ctx, "cleanupUserToken", userId, err)
+}
+
+// cleanupUserTokenPerKey is the non scripted cleanup for cluster deployments,
+// where the user token key and the token keys may live in different slots.
+func (r *redisBackend) cleanupUserTokenPerKey(ctx context.Context, userId string) (int64, error) {
+	key := r.getUserTokenKey(userId)
+
+	now := r.opts.now().Unix()
+	removed, err := r.client.ZRemRangeByScore(ctx, key, "0", strconv.FormatInt(now, 10)).Result()
+	if err != nil {
+		return 0, err
+	}
+	userTokens, err := r.client.ZRange(ctx, key, 0, -1).Result()
+	if err != nil {
+		return removed, err
+	}
+
+	// on the primary, a lagging replica would have live tokens swept
+	exists, err := r.tokensExist(ctx, r.client, []string{userId}, userTokens)
+	if err != nil {
+		return removed, err
+	}
+	tokensForDelete := make([]interface{}, 0)
+	for _, token := range userTokens {
+		if !exists[token] {
+			tokensForDelete = append(tokensForDelete, token)
+		}
+	}
+	if len(tokensForDelete) == 0 {
+		return removed, nil
+	}
+	n, err := r.zrem(ctx, key, tokensForDelete)
+	return removed + n, err
+}
+
+func (r *redisBackend) saveUserToken(ctx context.Context, userId string, genToken func() (string, error), value interface{}, expiresIn time.Duration, metadata map[string]string) (string, error) {
+	if err := checkExpiry(expiresIn); err != nil {
+		return "", err
+	}
+	if err := r.checkIssueRate(ctx, userId); err != nil {
+		return "", err
+	}
+	r.tryCleanupUserToken(ctx, userId)
+
+	var ttl time.Duration
+	var now, expire time.Time
+	token, err := r.opts.generateToken(ctx, genToken, func(token string) (bool, error) {
+		now = r.opts.now()
+		expire = now.Add(expiresIn).UTC()
+		ttl = expire.Sub(now)
+		return r.insertUserToken(ctx, userId, token, value, expire, ttl)
+	})
+	if err != nil {
+		return "", err
+	}
+	r.opts.warn(ctx, "recordCreated", userId, r.recordCreated(ctx, userId, token, now, expire))
+
+	if len(metadata) != 0 {
+		err = r.saveTokenMeta(ctx, userId, token, metadata, ttl)
+		if err == nil && len(scopes(metadata)) != 0 {
+			_, err = r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+				r.indexScopes(ctx, pipe, userId, token, metadata, expire)
+				return nil
+			})
+		}
+		if err != nil {
+			r.tryDeleteUserToken(ctx, userId, token)
+			return "", err
+		}
+	}
+	if r.opts.ownerIndex {
+		err = r.client.Set(ctx, r.getTokenOwnerKey(token), userId, ttl).Err()
+		if err != nil {
+			r.tryDeleteUserToken(ctx, userId, token)
+			return "", err
+		}
+	}
+	if r.opts.maxUserTokens > 0 {
+		r.opts.warn(ctx, "trimUserToken", userId, r.trimUserToken(ctx, userId, r.opts.maxUserTokens))
+	}
+	return token, nil
+}
+
+// saveTokenPair saves an access and a refresh token of the user, each scored by
+// its own expiry, and links them so revoking either revokes both
+func (r *redisBackend) saveTokenPair(ctx context.Context, userId string, genAccess, genRefresh func() (string, error), accessValue, refreshValue interface{}, accessTTL, refreshTTL time.Duration, metadata map[string]string) (string, string, error) {
+	if err := checkExpiry(accessTTL); err != nil {
+		return "", "", err
+	}
+	if err := checkExpiry(refreshTTL); err != nil {
+		return "", "", err
+	}
+	access, err := r.saveUserToken(ctx, userId, genAccess, accessValue, accessTTL, metadata)
+	if err != nil {
+		return "", "", err
+	}
+	refresh, err := r.saveUserToken(ctx, userId, genRefresh, refreshValue, refreshTTL, metadata)
+	if err == nil {
+		_, err = r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, r.getTokenPairKey(userId, access), refresh, accessTTL)
+			pipe.Set(ctx, r.getTokenPairKey(userId, refresh), access, refreshTTL)
+			return nil
+		})
+	}
+	if err != nil {
+		// don't leave half a pair behind
+		tokens := []string{access}
+		if refresh != "" {
+			tokens = append(tokens, refresh)
+		}
+		_, delErr := r.deleteUserToken(ctx, userId, tokens...)
+		r.opts.warn(ctx, "deleteUserToken", userId, delErr)
+		return "", "", err
+	}
+	return access, refresh, nil
+}
+
+// saveUnconfirmedUserToken saves a user token that fails to load with
+// ErrTokenUnconfirmed until confirmUserToken. The token string isn't handed out
+// before the marker is set, so it can't be used in between.
+func (r *redisBackend) saveUnconfirmedUserToken(ctx context.Context, userId string, genToken func() (string, error), value interface{}, expiresIn time.Duration) (string, error) {
+	token, err := r.saveUserToken(ctx, userId, genToken, value, expiresIn, nil)
+	if err != nil {
+		return "", err
+	}
+	err = r.client.Set(ctx, r.getUnconfirmedTokenKey(userId, token), 1, expiresIn).Err()
+	if err != nil {
+		r.tryDeleteUserToken(ctx, userId, token)
+		return "", err
+	}
+	return token, nil
+}
+
+// confirmUserToken makes an unconfirmed user token usable by removing its marker.
+// Confirming a confirmed token does nothing.
+func (r *redisBackend) confirmUserToken(ctx context.Context, userId string, tokenString string) error {
+	score, err := r.client.ZScore(ctx, r.getUserTokenKey(userId), tokenString).Result()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return ErrTokenNotFound
+		}
+		return err
+	}
+	if int64(score) <= r.opts.now().Unix() {
+		return ErrTokenNotFound
+	}
+	return r.client.Del(ctx, r.getUnconfirmedTokenKey(userId, tokenString)).Err()
+}
+
+const (
+	userLockTTL          = time.Second * 5
+	userLockPollInterval = time.Millisecond * 20
+)
+
+func (r *redisBackend) getUserLockKey(userId string) string {
+	return r.joinKey("USER_TOKEN_LOCKS", userId)
+}
+
+// withUserLock runs fn holding a per user lock, waiting for it until ctx is done.
+// The lock expires after userLockTTL should its holder die.
+func (r *redisBackend) withUserLock(ctx context.Context, userId string, fn func() error) error {
+	key := r.getUserLockKey(userId)
+	owner := generateURLSafeOpaqueToken(16)
+	for {
+		ok, err := r.client.SetNX(ctx, key, owner, userLockTTL).Result()
+		if err != nil {
+			return err
+		}
+		if ok {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(userLockPollInterval):
+		}
+	}
+	defer func() {
+		err := deleteTokenIfValueScript.Run(ctx, r.client, []string{key}, owner).Err()
+		r.opts.warn(ctx, "unlock", userId, err)
+	}()
+	return fn()
+}
+
+// getOrCreate returns the token found by existing, or the one made by create
+// holding the user lock when there is none, reporting whether it was created.
+func (r *redisBackend) getOrCreate(ctx context.Context, userId string, existing func() (string, error), create func() (string, error)) (string, bool, error) {
+	token, err := existing()
+	if err != nil || token != "" {
+		return token, false, err
+	}
+	created := false
+	err = r.withUserLock(ctx, userId, func() error {
+		// another caller may have created it while we waited
+		token, err = existing()
+		if err != nil || token != "" {
+			return err
+		}
+		token, err = create()
+		created = err == nil
+		return err
+	})
+	if err != nil {
+		return "", false, err
+	}
+	return token, created, nil
+}
+
+// getOrCreateUserToken returns the furthest expiring token of the user, or saves
+// one when the user has none. Concurrent callers for a user get the same token.
+func (r *redisBackend) getOrCreateUserToken(ctx context.Context, userId string, genToken func() (string, error), value interface{}, expiresIn time.Duration) (string, bool, error) {
+	if err := checkExpiry(expiresIn); err != nil {
+		return "", false, err
+	}
+	key := r.getUserTokenKey(userId)
+	return r.getOrCreate(ctx, userId, func() (string, error) {
+		r.tryCleanupUserToken(ctx, userId)
+		tokens, err := r.client.ZRange(ctx, key, -1, -1).Result()
+		if err != nil || len(tokens) == 0 {
+			return "", err
+		}
+		return tokens[0], nil
+	}, func() (string, error) {
+		return r.saveUserToken(ctx, userId, genToken, value, expiresIn, nil)
+	})
+}
+
+// saveUserTokenWithId saves the user token under the caller's token string. When
+// the token key already exists it reports false and only makes sure the user token
+// member is there, so retrying a save that went through is a no-op. A token of
+// another user fails with ErrTokenTaken.
+func (r *redisBackend) saveUserTokenWithId(ctx context.Context, userId string, token string, value interface{}, expiresIn time.Duration) (bool, error) {
+	if err := checkExpiry(expiresIn); err != nil {
+		return false, err
+	}
+	if err := r.checkIssueRate(ctx, userId); err != nil {
+		return false, err
+	}
+	r.tryCleanupUserToken(ctx, userId)
+
+	now := r.opts.now()
+	expire := now.Add(expiresIn).UTC()
+	ttl := expire.Sub(now)
+	created, err := r.insertUserToken(ctx, userId, token, value, expire, ttl)
+	if err != nil {
+		return false, err
+	}
+	if !created {
+		owned, err := r.ownsToken(ctx, userId, token, value)
+		if err != nil {
+			return false, err
+		}
+		if !owned {
+			return false, ErrTokenTaken
+		}
+		pttl, err := r.client.PTTL(ctx, r.getTokenKey(userId, token)).Result()
+		if err != nil {
+			return false, err
+		}
+		if pttl == -2 {
+			return false, ErrTokenNotFound
+		}
+		if pttl > 0 {
+			expire = now.Add(pttl)
+		}
+		key := r.getUserTokenKey(userId)
+		return false, addUserTokenScript.Run(ctx, r.client, []string{key}, expireScore(expire), token, "NX").Err()
+	}
+	r.opts.warn(ctx, "recordCreated", userId, r.recordCreated(ctx, userId, token, now, expire))
+
+	if r.opts.ownerIndex {
+		err = r.client.Set(ctx, r.getTokenOwnerKey(token), userId, ttl).Err()
+		if err != nil {
+			r.tryDeleteUserToken(ctx, userId, token)
+			return false, err
+		}
+	}
+	if r.opts.maxUserTokens > 0 {
+		r.opts.warn(ctx, "trimUserToken", userId, r.trimUserToken(ctx, userId, r.opts.maxUserTokens))
+	}
+	return true, nil
+}
+
+// ownsToken reports whether the stored token belongs to userId, by its owner key
+// under WithTokenOwnerIndex and by its user token member otherwise. Without the
+// member, a token key holding value itself is a retry whose member write was lost.
+func (r *redisBackend) ownsToken(ctx context.Context, userId string, token string, value interface{}) (bool, error) {
+	var err error
+	if r.opts.ownerIndex {
+		var owner string
+		owner, err = r.client.Get(ctx, r.getTokenOwnerKey(token)).Result()
+		if err == nil {
+			return owner == userId, nil
+		}
+	} else {
+		_, err = r.client.ZScore(ctx, r.getUserTokenKey(userId), token).Result()
+		if err == nil {
+			return true, nil
+		}
+		if errors.Is(err, redis.Nil) {
+			v, encodeErr := r.opts.encodeValue(value)
+			if encodeErr != nil {
+				return false, encodeErr
+			}
+			var stored string
+			stored, err = r.client.Get(ctx, r.getTokenKey(userId, token)).Result()
+			if err == nil {
+				return stored == v, nil
+			}
+		}
+	}
+	if errors.Is(err, redis.Nil) {
+		return false, nil
+	}
+	return false, err
+}
+
+// saveUserTokens writes tokens of the user made elsewhere in one pipeline, skipping
+// entries already expired or whose token key already exists.
+func (r *redisBackend) saveUserTokens(ctx context.Context, userId string, entries []TokenEntry) error {
+	now := r.opts.now()
+	live := make([]TokenEntry, 0, len(entries))
+	values := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.ExpiresAt.After(now) {
+			continue
+		}
+		v, err := r.opts.encodeValue(entry.Value)
+		if err != nil {
+			return err
+		}
+		live = append(live, entry)
+		values = append(values, v)
+	}
+	if len(live) == 0 {
+		return nil
+	}
+	key := r.getUserTokenKey(userId)
+
+	saved := make([]bool, len(live))
+	if r.splitSlots() {
+		// the token keys may live in other slots than the user token key
+		sets := make([]*redis.BoolCmd, len(live))
+		_, err := r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for i, entry := range live {
+				sets[i] = pipe.SetNX(ctx, r.getTokenKey(userId, entry.Token), values[i], entry.ExpiresAt.Sub(now))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		_, err = r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for i, entry := range live {
+				if saved[i] = sets[i].Val(); saved[i] {
+					addUserTokenScript.Eval(ctx, pipe, []string{key}, expireScore(entry.ExpiresAt), entry.Token, "")
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	} else {
+		cmds := make([]*redis.Cmd, len(live))
+		_, err := r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for i, entry := range live {
+				keys := []string{r.getTokenKey(userId, entry.Token), key}
+				cmds[i] = saveUserTokenScript.Eval(ctx, pipe, keys, values[i], ttlMillis(entry.ExpiresAt.Sub(now)), expireScore(entry.ExpiresAt), entry.Token)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for i, cmd := range cmds {
+			saved[i], _ = cmd.Bool()
+		}
+	}
+
+	_, err := r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, entry := range live {
+			if !saved[i] {
+				continue
+			}
+			ttl := entry.ExpiresAt.Sub(now)
+			recordCreatedScript.Eval(ctx, pipe, []string{r.getUserTokenCreatedKey(userId)}, now.Unix(), entry.Token, expireScore(entry.ExpiresAt), now.Unix())
+			if len(entry.Metadata) != 0 {
+				metaKey := r.getTokenMetaKey(userId, entry.Token)
+				pipe.HSet(ctx, metaKey, entry.Metadata)
+				pipe.PExpire(ctx, metaKey, ttl)
+				r.indexScopes(ctx, pipe, userId, entry.Token, entry.Metadata, entry.ExpiresAt)
+			}
+			if r.opts.ownerIndex {
+				pipe.Set(ctx, r.getTokenOwnerKey(entry.Token), userId, ttl)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if r.opts.maxUserTokens > 0 {
+		return r.trimUserToken(ctx, userId, r.opts.maxUserTokens)
+	}
+	return nil
+}
+
+// saveUserTokenPipe queues saving a user token on the caller's pipe instead of
+// running it. The returned func reports the outcome once pipe is executed; a
+// collision can't be retried by then and fails with ErrTokenGenerationExhausted.
+func (r *redisBackend) saveUserTokenPipe(ctx context.Context, pipe redis.Pipeliner, userId string, genToken func() (string, error), value interface{}, expiresIn time.Duration) (string, func() error, error) {
+	if err := checkExpiry(expiresIn); err != nil {
+		return "", nil, err
+	}
+	if r.splitSlots() {
+		// the save script needs the token and user token keys in one slot
+		return "", nil, ErrNotSupported
+	}
+	v, err := r.opts.encodeValue(value)
+	if err != nil {
+		return "", nil, err
+	}
+	token, err := genToken()
+	if err != nil {
+		return "", nil, err
+	}
+
+	now := r.opts.now()
+	expire := now.Add(expiresIn).UTC()
+	keys := []string{r.getTokenKey(userId, token), r.getUserTokenKey(userId)}
+	cmd := saveUserTokenScript.Eval(ctx, pipe, keys, v, ttlMillis(expire.Sub(now)), expireScore(expire), token)
+	recordCreatedScript.Eval(ctx, pipe, []string{r.getUserTokenCreatedKey(userId)}, now.Unix(), token, expireScore(expire), now.Unix())
+	if r.opts.ownerIndex {
+		pipe.SetNX(ctx, r.getTokenOwnerKey(token), userId, expire.Sub(now))
+	}
+
+	return token, func() error {
+		ok, err := cmd.Bool()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return ErrTokenGenerationExhausted
+		}
+		if r.opts.maxUserTokens > 0 {
+			r.opts.warn(ctx, "trimUserToken", userId, r.trimUserToken(ctx, userId, r.opts.maxUserTokens))
+		}
+		return nil
+	}, nil
+}
+
+// insertUserToken writes the token value and its user token member together,
+// reporting false without writing anything when the token already exists.
+func (r *redisBackend) insertUserToken(ctx context.Context, userId string, token string, value interface{}, expire time.Time, ttl time.Duration) (bool, error) {
+	if r.splitSlots() || r.opts.transactionMode == TransactionNone {
+		// the keys may live in different slots, save then roll back on failure
+		ok, err := r.saveTokenOf(ctx, userId, token, value, ttl)
+		if err != nil || !ok {
+			return false, err
+		}
+		err = r.addUserToken(ctx, userId, token, expire, false)
+		if err != nil {
+			r.opts.warn(ctx, "deleteToken", userId, r.unlink(ctx, r.tokenKeys(userId, token)...))
+			return false, err
+		}
+		return true, nil
+	}
+
+	v, err := r.opts.encodeValue(value)
+	if err != nil {
+		return false, err
+	}
+	keys := []string{r.getTokenKey(userId, token), r.getUserTokenKey(userId)}
+	if r.opts.transactionMode == TransactionOptimistic {
+		return r.watchInsertUserToken(ctx, keys, token, v, expire, ttl)
+	}
+	return saveUserTokenScript.Run(ctx, r.client, keys, v, ttlMillis(ttl), expireScore(expire), token).Bool()
+}
+
+// watchInsertUserToken is saveUserTokenScript as a transaction watching the token
+// key and the user token key. It reports false when the token key exists or
+// either key changed before the transaction ran.
+func (r *redisBackend) watchInsertUserToken(ctx context.Context, keys []string, token string, v string, expire time.Time, ttl time.Duration) (bool, error) {
+	tokenKey, userKey := keys[0], keys[1]
+	err := r.client.Watch(ctx, func(tx *redis.Tx) error {
+		exists, err := tx.Exists(ctx, tokenKey).Result()
+		if err != nil {
+			return err
+		}
+		if exists != 0 {
+			return redis.TxFailedErr
+		}
+		top, err := tx.ZRangeWithScores(ctx, userKey, -1, -1).Result()
+		if err != nil {
+			return err
+		}
+		score := expireScore(expire)
+		if len(top) != 0 {
+			score = max(score, int64(top[0].Score))
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, tokenKey, v, ttl)
+			pipe.ZAdd(ctx, userKey, redis.Z{Score: float64(expireScore(expire)), Member: token})
+			pipe.ExpireAt(ctx, userKey, time.Unix(score, 0))
+			return nil
+		})
+		return err
+	}, tokenKey, userKey)
+	if errors.Is(err, redis.TxFailedErr) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (r *redisBackend) saveTokenMeta(ctx context.Context, userId string, token string, metadata map[string]string, expire time.Duration) error {
+	key := r.getTokenMetaKey(userId, token)
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, key)
+		pipe.HSet(ctx, key, metadata)
+		if expire > 0 {
+			pipe.PExpire(ctx, key, expire)
+		}
+		return nil
+	})
+	return err
+}
+
+// loadTokenMeta returns the metadata of each token in order, nil for none.
+func (r *redisBackend) loadTokenMeta(ctx context.Context, userId string, tokens ...string) ([]map[string]string, error) {
+	cmds := make([]*redis.MapStringStringCmd, len(tokens))
+	_, err := r.reader().Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, token := range tokens {
+			cmds[i] = pipe.HGetAll(ctx, r.getTokenMetaKey(userId, token))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	metadata := make([]map[string]string, len(tokens))
+	for i, cmd := range cmds {
+		if m := cmd.Val(); len(m) != 0 {
+			metadata[i] = m
+		}
+	}
+	return metadata, nil
+}
+
+// addUserToken sets the user token score to expire and keeps the user token key
+// alive as long as its furthest token, so the key of an inactive user expires.
+func (r *redisBackend) addUserToken(ctx context.Context, userId string, token string, expire time.Time, onlyExisting bool) error {
+	mode := ""
+	if onlyExisting {
+		mode = "XX"
+	}
+	return addUserTokenScript.Run(ctx, r.client, []string{r.getUserTokenKey(userId)}, expireScore(expire), token, mode).Err()
+}
+
+// trimUserToken keeps the newest max tokens of the user and deletes the rest
+func (r *redisBackend) trimUserToken(ctx context.Context, userId string, max int) error {
+	evicted, err := trimUserTokenScript.Run(ctx, r.client, []string{r.getUserTokenKey(userId)}, max).StringSlice()
+	if err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(evicted)*4)
+	members := make([]interface{}, len(evicted))
+	for i, token := range evicted {
+		keys = append(keys, r.tokenKeys(userId, token)...)
+		members[i] = token
+	}
+	if len(members) != 0 {
+		_, err := r.zrem(ctx, r.getUserTokenCreatedKey(userId), members)
+		r.opts.warn(ctx, "zrem", userId, err)
+	}
+	return r.unlink(ctx, keys...)
+}
+
+// user TokenString 내에 없으면 토큰도 지워줌
+func (r *redisBackend) loadUserToken(ctx context.Context, userId string, tokenString string) (*bUserTokenInfo, error) {
+	if r.opts.cleanupOnLoad() {
+		r.tryCleanupUserToken(ctx, userId)
+	}
+	key := r.getUserTokenKey(userId)
+
+	score, err := r.client.ZScore(ctx, key, tokenString).Result()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			r.opts.warn(ctx, "deleteToken", userId, r.unlink(ctx, r.tokenKeys(userId, tokenString)...))
+			return nil, ErrTokenNotFound
+		}
+		return nil, err
+	}
+	if int64(score) <= r.opts.now().Unix() {
+		// expired but not swept yet
+		return nil, ErrTokenNotFound
+	}
+
+	data, _, err := r.loadTokenOf(ctx, userId, tokenString)
+	if errors.Is(err, ErrTokenRevoked) {
+		return r.loadSoftRevokedUserToken(ctx, userId, tokenString, score)
+	}
+	if errors.Is(err, ErrTokenNotFound) && r.opts.strictConsistency {
+		return nil, orphanedToken(tokenString)
+	}
+	if err != nil {
+		return nil, err
+	}
+	expiresAt := time.Unix(int64(score), 0).UTC()
+	if d := r.opts.slidingExpiration; d > 0 {
+		err = r.refreshUserToken(ctx, userId, tokenString, d)
+		if err != nil {
+			return nil, err
+		}
+		expiresAt = time.Unix(expireScore(r.opts.now().Add(d)), 0).UTC()
+	}
+	metadata, err := r.loadTokenMeta(ctx, userId, tokenString)
+	if err != nil {
+		return nil, err
+	}
+	created, err := r.loadCreated(ctx, userId, tokenString)
+	if err != nil {
+		return nil, err
+	}
+	return &bUserTokenInfo{
+		TokenString: tokenString,
+		Fingerprint: Fingerprint(tokenString),
+		TokenData:   data,
+		ExpiresAt:   expiresAt,
+		Metadata:    metadata[0],
+		CreatedAt:   created[0],
+		opts:        r.opts,
+	}, nil
+}
+
+func (r *redisBackend) loadUserTokenList(ctx context.Context, userId string) ([]*bUserTokenInfo, error) {
+	r.tryCleanupUserToken(ctx, userId)
+	key := r.getUserTokenKey(userId)
+
+	members, err := r.reader().ZRangeArgsWithScores(ctx, r.opts.zRangeArgs(key, 0, 0)).Result()
+	if err != nil {
+		return nil, err
+	}
+	return r.loadUserTokenMembers(ctx, userId, members)
+}
+
+// indexScopes queues adding token to the scope keys of the scopes metadata grants.
+// A scope key isn't cleaned up with its tokens, it expires with the furthest one and
+// is only read intersected with the user token key.
+func (r *redisBackend) indexScopes(ctx context.Context, pipe redis.Pipeliner, userId string, token string, metadata map[string]string, expire time.Time) {
+	for _, scope := range scopes(metadata) {
+		addUserTokenScript.Eval(ctx, pipe, []string{r.getUserTokenScopeKey(userId, scope)}, expireScore(expire), token, "")
+	}
+}
+
+// extendScopes queues moving the score of tokens in the scope keys of the scopes
+// metadata grants each to expire, keeping each scope key alive as long as its
+// furthest token like indexScopes
+func (r *redisBackend) extendScopes(ctx context.Context, pipe redis.Pipeliner, userId string, tokens []string, metadata []map[string]string, expire time.Time) {
+	for i, token := range tokens {
+		for _, scope := range scopes(metadata[i]) {
+			addUserTokenScript.Eval(ctx, pipe, []string{r.getUserTokenScopeKey(userId, scope)}, expireScore(expire), token, "XX")
+		}
+	}
+}
+
+// loadUserTokensWithScope returns the user tokens granting scope, the user token
+// key intersected with the scope key. The metadata of a token is checked too, as
+// the scope key may hold tokens since saved again without the scope.
+func (r *redisBackend) loadUserTokensWithScope(ctx context.Context, userId string, scope string) ([]*bUserTokenInfo, error) {
+	r.tryCleanupUserToken(ctx, userId)
+	key, scopeKey := r.getUserTokenKey(userId), r.getUserTokenScopeKey(userId, scope)
+
+	var members []redis.Z
+	if r.splitSlots() {
+		// the keys may live in different slots, score the scope members one by one
+		tokens, err := r.reader().ZRange(ctx, scopeKey, 0, -1).Result()
+		if err != nil || len(tokens) == 0 {
+			return make([]*bUserTokenInfo, 0), err
+		}
+		scores, err := r.reader().ZMScore(ctx, key, tokens...).Result()
+		if err != nil {
+			return nil, err
+		}
+		for i, token := range tokens {
+			// a missing member scores 0
+			if scores[i] != 0 {
+				members = append(members, redis.Z{Score: scores[i], Member: token})
+			}
+		}
+		slices.SortFunc(members, func(a, b redis.Z) int {
+			return cmp.Compare(a.Score, b.Score)
+		})
+	} else {
+		var err error
+		members, err = r.reader().ZInterWithScores(ctx, &redis.ZStore{
+			Keys:    []string{key, scopeKey},
+			Weights: []float64{1, 0},
+		}).Result()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if r.opts.listOrder == Descending {
+		slices.Reverse(members)
+	}
+
+	userTokenList, err := r.loadUserTokenMembers(ctx, userId, members)
+	if err != nil {
+		return nil, err
+	}
+	return withScope(userTokenList, scope), nil
+}
+
+// loadUserTokenListPaged returns limit user tokens from offset, by expiry ascending,
+// and the number of user tokens in total.
+func (r *redisBackend) loadUserTokenListPaged(ctx context.Context, userId string, offset, limit int64) ([]*bUserTokenInfo, int64, error) {
+	r.tryCleanupUserToken(ctx, userId)
+	key := r.getUserTokenKey(userId)
+	if limit == 0 {
+		// ZRANGE without LIMIT would return everything
+		total, err := r.reader().ZCard(ctx, key).Result()
+		return make([]*bUserTokenInfo, 0), total, err
+	}
+
+	var members *redis.ZSliceCmd
+	var total *redis.IntCmd
+	_, err := r.reader().Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		members = pipe.ZRangeArgsWithScores(ctx, r.opts.zRangeArgs(key, offset, limit))
+		total = pipe.ZCard(ctx, key)
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	userTokenList, err := r.loadUserTokenMembers(ctx, userId, members.Val())
+	if err != nil {
+		return nil, 0, err
+	}
+	return userTokenList, total.Val(), nil
+}
+
+// loadUserTokenMembers fetches the values and metadata of user token members,
+// dropping members whose value is gone and skipping revoked ones.
+func (r *redisBackend) loadUserTokenMembers(ctx context.Context, userId string, members []redis.Z) ([]*bUserTokenInfo, error) {
+	if len(members) == 0 {
+		return make([]*bUserTokenInfo, 0), nil
+	}
+
+	// the values, then the revocations
+	keys := make([]string, len(members)*2)
+	for i, member := range members {
+		keys[i] = r.getTokenKey(userId, member.Member.(string))
+		keys[len(members)+i] = r.getRevokedTokenKey(userId, member.Member.(string))
+	}
+	values, err := r.mget(ctx, keys...)
+	if err != nil {
+		return nil, err
+	}
+
+	now := r.opts.now().Unix()
+	userTokenList := make([]*bUserTokenInfo, 0, len(members))
+	missing := make([]interface{}, 0)
+	for i, member := range members {
+		tokenString := member.Member.(string)
+		data, ok := values[i].(string)
+		if !ok && r.opts.strictConsistency && int64(member.Score) > now {
+			return nil, orphanedToken(tokenString)
+		}
+		if !ok {
+			// vanished between ZRANGE and MGET
+			missing = append(missing, tokenString)
+			continue
+		}
+		if values[len(members)+i] != nil {
+			continue
+		}
+		userTokenList = append(userTokenList, &bUserTokenInfo{
+			TokenString: tokenString,
+			Fingerprint: Fingerprint(tokenString),
+			TokenData:   data,
+			ExpiresAt:   time.Unix(int64(member.Score), 0).UTC(),
+			opts:        r.opts,
+		})
+	}
+	if len(missing) != 0 {
+		_, err := r.zrem(ctx, r.getUserTokenKey(userId), missing)
+		r.opts.warn(ctx, "zrem", userId, err)
+	}
+
+	tokenStringList := make([]string, len(userTokenList))
+	for i, userToken := range userTokenList {
+		tokenStringList[i] = userToken.TokenString
+	}
+	metadata, err := r.loadTokenMeta(ctx, userId, tokenStringList...)
+	if err != nil {
+		return nil, err
+	}
+	created, err := r.loadCreated(ctx, userId, tokenStringList...)
+	if err != nil {
+		return nil, err
+	}
+	for i, userToken := range userTokenList {
+		userToken.Metadata = metadata[i]
+		userToken.CreatedAt = created[i]
+	}
+	return userTokenList, nil
+}
+
+// iterateUserTokens streams the user tokens to fn a ZSCAN page at a time instead
+// of materializing them all. Order is unspecified, a non-nil error from fn stops it.
+func (r *redisBackend) iterateUserTokens(ctx context.Context, userId string, fn func(*bUserTokenInfo) error) error {
+	r.tryCleanupUserToken(ctx, userId)
+	key := r.getUserTokenKey(userId)
+
+	var cursor uint64
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		page, next, err := r.client.ZScan(ctx, key, cursor, "", r.opts.scanCount).Result()
+		if err != nil {
+			return err
+		}
+
+		members := make([]redis.Z, 0, len(page)/2)
+		for i := 0; i+1 < len(page); i += 2 {
+			score, err := strconv.ParseFloat(page[i+1], 64)
+			if err != nil {
+				return err
+			}
+			members = append(members, redis.Z{Member: page[i], Score: score})
+		}
+		userTokenList, err := r.loadUserTokenMembers(ctx, userId, members)
+		if err != nil {
+			return err
+		}
+		for _, userToken := range userTokenList {
+			err = fn(userToken)
+			if err != nil {
+				return err
+			}
+		}
+
+		cursor = next
+		if cursor == 0 {
+			return nil
+		}
+	}
+}
+
+// deleteUserToken removes the token values and their user token members in one
+// MULTI, so the index never points at a deleted token. It returns how many of the
+// tokens had a value or a member to remove.
+func (r *redisBackend) deleteUserToken(ctx context.Context, userId string, tokens ...string) (int64, error) {
+	if len(tokens) == 0 {
+		return 0, nil
+	}
+	key, createdKey := r.getUserTokenKey(userId), r.getUserTokenCreatedKey(userId)
+
+	members := make([]*redis.IntCmd, len(tokens))
+	values := make([]*redis.IntCmd, len(tokens))
+	fn := func(pipe redis.Pipeliner) error {
+		for i, token := range tokens {
+			members[i] = pipe.ZRem(ctx, key, token)
+			pipe.ZRem(ctx, createdKey, token)
+			keys := r.tokenKeys(userId, token)
+			values[i] = pipe.Unlink(ctx, keys[0])
+			for _, k := range keys[1:] {
+				pipe.Unlink(ctx, k)
+			}
+		}
+		return nil
+	}
+	var err error
+	if r.cluster {
+		// a transaction can't span slots, the pipeline still makes it one round trip
+		_, err = r.client.Pipelined(ctx, fn)
+	} else {
+		_, err = r.client.TxPipelined(ctx, fn)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return countDeleted(members, values), nil
+}
+
+// countDeleted counts the tokens whose member or value was removed, by the replies
+// of the commands removing them
+func countDeleted(members, values []*redis.IntCmd) int64 {
+	var n int64
+	for i := range members {
+		if members[i].Val() > 0 || values[i].Val() > 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// tryDeleteUserToken is deleteUserToken for best effort removals, logging its failure
+func (r *redisBackend) tryDeleteUserToken(ctx context.Context, userId string, tokens ...string) {
+	_, err := r.deleteUserToken(ctx, userId, tokens...)
+	r.opts.warn(ctx, "deleteUserToken", userId, err)
+}
+
+// deleteUserTokensExcept deletes every token of the user but keepToken, which must
+// be one of them
+func (r *redisBackend) deleteUserTokensExcept(ctx context.Context, userId string, keepToken string) error {
+	key := r.getUserTokenKey(userId)
+
+	var score *redis.FloatCmd
+	var members *redis.StringSliceCmd
+	_, err := r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		score = pipe.ZScore(ctx, key, keepToken)
+		members = pipe.ZRange(ctx, key, 0, -1)
+		return nil
+	})
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return err
+	}
+	if errors.Is(score.Err(), redis.Nil) {
+		return ErrTokenNotFound
+	}
+
+	tokens := slices.DeleteFunc(members.Val(), func(token string) bool { return token == keepToken })
+	_, err = r.deleteUserToken(ctx, userId, tokens...)
+	return err
+}
+
+// deleteUserTokenPipe queues deleteUserToken on the caller's pipe, the returned func
+// reports the outcome once pipe is executed
+func (r *redisBackend) deleteUserTokenPipe(ctx context.Context, pipe redis.Pipeliner, userId string, tokens ...string) func() error {
+	if len(tokens) == 0 {
+		return func() error { return nil }
+	}
+	members := make([]interface{}, len(tokens))
+	for i, token := range tokens {
+		members[i] = token
+	}
+
+	cmds := []redis.Cmder{pipe.ZRem(ctx, r.getUserTokenKey(userId), members...), pipe.ZRem(ctx, r.getUserTokenCreatedKey(userId), members...)}
+	for _, token := range tokens {
+		for _, key := range r.tokenKeys(userId, token) {
+			cmds = append(cmds, pipe.Unlink(ctx, key))
+		}
+	}
+	return func() error {
+		for _, cmd := range cmds {
+			if err := cmd.Err(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func (r *redisBackend) countUserTokens(ctx context.Context, userId string) (int64, error) {
+	_, err := r.cleanupUserToken(ctx, userId)
+	if err != nil {
+		return 0, err
+	}
+	return r.client.ZCard(ctx, r.getUserTokenKey(userId)).Result()
+}
+
+// userTokenExists reports whether tokenString is an active, unrevoked token of the user
+func (r *redisBackend) userTokenExists(ctx context.Context, userId string, tokenString string) (bool, error) {
+	_, err := r.cleanupUserToken(ctx, userId)
+	if err != nil {
+		return false, err
+	}
+
+	var score *redis.FloatCmd
+	var exists, revoked *redis.IntCmd
+	_, err = r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		score = pipe.ZScore(ctx, r.getUserTokenKey(userId), tokenString)
+		exists = pipe.Exists(ctx, r.getTokenKey(userId, tokenString))
+		revoked = pipe.Exists(ctx, r.getRevokedTokenKey(userId, tokenString))
+		return nil
+	})
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return false, err
+	}
+	if score.Err() != nil {
+		return false, nil
+	}
+	return exists.Val() > 0 && revoked.Val() == 0, nil
+}
+
+// refreshUserToken moves the expiry of both the token value and its user token score,
+// failing with ErrTokenRevoked for a revoked token
+func (r *redisBackend) refreshUserToken(ctx context.Context, userId string, tokenString string, expiresIn time.Duration) error {
+	if err := checkExpiry(expiresIn); err != nil {
+		return err
+	}
+	key := r.getUserTokenKey(userId)
+
+	_, err := r.client.ZScore(ctx, key, tokenString).Result()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return ErrTokenNotFound
+		}
+		return err
+	}
+
+	now := r.opts.now()
+	expire := now.Add(expiresIn).UTC()
+	extended, gone, err := r.extendActiveTokens(ctx, userId, []string{tokenString}, expire.Sub(now))
+	if err != nil {
+		return err
+	}
+	if len(gone) != 0 {
+		r.opts.warn(ctx, "zrem", userId, r.client.ZRem(ctx, key, tokenString).Err())
+		return ErrTokenNotFound
+	}
+	if len(extended) == 0 {
+		return ErrTokenRevoked
+	}
+	r.opts.warn(ctx, "pexpire", userId, r.client.PExpire(ctx, r.getTokenMetaKey(userId, tokenString), expire.Sub(now)).Err())
+	if r.opts.ownerIndex {
+		r.opts.warn(ctx, "pexpire", userId, r.client.PExpire(ctx, r.getTokenOwnerKey(tokenString), expire.Sub(now)).Err())
+	}
+	metadata, err := r.loadTokenMeta(ctx, userId, tokenString)
+	if err != nil {
+		return err
+	}
+	_, err = r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		addUserTokenScript.Eval(ctx, pipe, []string{key}, expireScore(expire), tokenString, "XX")
+		r.extendScopes(ctx, pipe, userId, []string{tokenString}, metadata, expire)
+		return nil
+	})
+	return err
+}
+
+// extendAllUserTokens moves the expiry of every active token of the user to expiresIn
+// from now. Members whose value vanished meanwhile are removed instead, revoked
+// tokens keep their expiry.
+func (r *redisBackend) extendAllUserTokens(ctx context.Context, userId string, expiresIn time.Duration) error {
+	if err := checkExpiry(expiresIn); err != nil {
+		return err
+	}
+	if _, err := r.cleanupUserToken(ctx, userId); err != nil {
+		return err
+	}
+	key := r.getUserTokenKey(userId)
+	tokens, err := r.client.ZRange(ctx, key, 0, -1).Result()
+	if err != nil || len(tokens) == 0 {
+		return err
+	}
+
+	now := r.opts.now()
+	expire := now.Add(expiresIn).UTC()
+	ttl := expire.Sub(now)
+	active, vanished, err := r.extendActiveTokens(ctx, userId, tokens, ttl)
+	if err != nil {
+		return err
+	}
+	if len(active) != 0 {
+		_, err = r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for _, token := range active {
+				for _, k := range r.tokenKeys(userId, token)[1:] {
+					pipe.PExpire(ctx, k, ttl)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	metadata, err := r.loadTokenMeta(ctx, userId, active...)
+	if err != nil {
+		return err
+	}
+
+	extended := make([]redis.Z, 0, len(active))
+	for _, token := range active {
+		extended = append(extended, redis.Z{Score: float64(expireScore(expire)), Member: token})
+	}
+	gone := make([]interface{}, 0, len(vanished))
+	for _, token := range vanished {
+		gone = append(gone, token)
+	}
+	// revoked tokens keep their score, which may outlast the extended ones
+	_, err = r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		if len(extended) != 0 {
+			pipe.ZAddXX(ctx, key, extended...)
+		}
+		if len(gone) != 0 {
+			pipe.ZRem(ctx, key, gone...)
+		}
+		expireUserTokenKeyScript.Eval(ctx, pipe, []string{key})
+		r.extendScopes(ctx, pipe, userId, active, metadata, expire)
+		return nil
+	})
+	return err
+}
+
+// reconcileUserToken moves the user token score to the remaining PTTL of the token
+// value, the value being the source of truth. A value without expiry is given the
+// expiry of its score; a member without value is removed with ErrTokenNotFound.
+func (r *redisBackend) reconcileUserToken(ctx context.Context, userId string, tokenString string) error {
+	key := r.getUserTokenKey(userId)
+	tokenKey := r.getTokenKey(userId, tokenString)
+
+	var score *redis.FloatCmd
+	var pttl *redis.DurationCmd
+	_, err := r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		score = pipe.ZScore(ctx, key, tokenString)
+		pttl = pipe.PTTL(ctx, tokenKey)
+		return nil
+	})
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return err
+	}
+	if errors.Is(score.Err(), redis.Nil) {
+		return ErrTokenNotFound
+	}
+	if score.Err() != nil {
+		return score.Err()
+	}
+
+	ttl := pttl.Val()
+	switch {
+	case ttl == -2:
+		r.tryDeleteUserToken(ctx, userId, tokenString)
+		return ErrTokenNotFound
+	case ttl < 0:
+		return r.client.ExpireAt(ctx, tokenKey, time.Unix(int64(score.Val()), 0)).Err()
+	}
+	now := r.opts.now()
+	for _, k := range r.tokenKeys(userId, tokenString)[1:] {
+		r.opts.warn(ctx, "pexpire", userId, r.client.PExpire(ctx, k, ttl).Err())
+	}
+	return r.addUserToken(ctx, userId, tokenString, now.Add(ttl), true)
+}
+
+// dumpUserTokens lists the user token members as they are, without cleaning up first
+func (r *redisBackend) dumpUserTokens(ctx context.Context, userId string) ([]UserTokenDebug, error) {
+	members, err := r.client.ZRangeWithScores(ctx, r.getUserTokenKey(userId), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	cmds := make([]*redis.DurationCmd, len(members))
+	_, err = r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, member := range members {
+			cmds[i] = pipe.PTTL(ctx, r.getTokenKey(userId, member.Member.(string)))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	dump := make([]UserTokenDebug, len(members))
+	for i, member := range members {
+		ttl := cmds[i].Val()
+		dump[i] = UserTokenDebug{
+			TokenString: member.Member.(string),
+			Score:       int64(member.Score),
+			TTL:         ttl,
+			Exists:      ttl != -2,
+		}
+	}
+	return dump, nil
+}
+
+// rotateUserToken replaces oldToken with a new token in one script, so exactly one
+// of them is valid at any time. The old token and its metadata are deleted.
+func (r *redisBackend) rotateUserToken(ctx context.Context, userId string, oldToken string, genToken func() (string, error), value interface{}, expiresIn time.Duration) (string, error) {
+	if err := checkExpiry(expiresIn); err != nil {
+		return "", err
+	}
+	if r.splitSlots() {
+		return r.rotateUserTokenPerKey(ctx, userId, oldToken, genToken, value, expiresIn)
+	}
+	v, err := r.opts.encodeValue(value)
+	if err != nil {
+		return "", err
+	}
+
+	var ttl time.Duration
+	var now, expire time.Time
+	token, err := r.opts.generateToken(ctx, genToken, func(token string) (bool, error) {
+		now = r.opts.now()
+		expire = now.Add(expiresIn).UTC()
+		ttl = expire.Sub(now)
+
+		keys := []string{
+			r.getUserTokenKey(userId),
+			r.getTokenKey(userId, oldToken),
+			r.getTokenMetaKey(userId, oldToken),
+			r.getRevokedTokenKey(userId, oldToken),
+			r.getTokenKey(userId, token),
+		}
+		result, err := rotateUserTokenScript.Run(ctx, r.client, keys, oldToken, token, v, ttlMillis(ttl), expireScore(expire), now.Unix()).Int()
+		switch {
+		case err != nil:
+			return false, err
+		case result == -1:
+			return false, ErrTokenNotFound
+		case result == -2:
+			return false, ErrTokenRevoked
+		}
+		return result == 1, nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	r.opts.warn(ctx, "zrem", userId, r.client.ZRem(ctx, r.getUserTokenCreatedKey(userId), oldToken).Err())
+	r.opts.warn(ctx, "recordCreated", userId, r.recordCreated(ctx, userId, token, now, expire))
+	if r.opts.ownerIndex {
+		r.opts.warn(ctx, "unlink", userId, r.client.Unlink(ctx, r.getTokenOwnerKey(oldToken)).Err())
+		err = r.client.Set(ctx, r.getTokenOwnerKey(token), userId, ttl).Err()
+		if err != nil {
+			r.tryDeleteUserToken(ctx, userId, token)
+			return "", err
+		}
+	}
+	return token, nil
+}
+
+// rotateUserTokenPerKey is the non scripted rotation for cluster deployments. The new
+// token is saved before the old one is deleted, so both are briefly valid.
+func (r *redisBackend) rotateUserTokenPerKey(ctx context.Context, userId string, oldToken string, genToken func() (string, error), value interface{}, expiresIn time.Duration) (string, error) {
+	ok, err := r.userTokenExists(ctx, userId, oldToken)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", ErrTokenNotFound
+	}
+
+	token, err := r.saveUserToken(ctx, userId, genToken, value, expiresIn, nil)
+	if err != nil {
+		return "", err
+	}
+	_, err = r.deleteUserToken(ctx, userId, oldToken)
+	if err != nil {
+		r.tryDeleteUserToken(ctx, userId, token)
+		return "", err
+	}
+	return token, nil
+}
+
+// deleteAllUserTokens drops every token of the users, failures are reported as *PartialFailureError
+func (r *redisBackend) deleteAllUserTokens(ctx context.Context, userIds ...string) error {
+	failed := make(map[string]error)
+
+	// the errors are told per user from the commands, the batches left unsent
+	// once ctx is done have none
+	ranges := make([]*redis.StringSliceCmd, len(userIds))
+	rangeErr := r.pipelined(ctx, r.client, len(userIds), func(pipe redis.Pipeliner, i int) {
+		ranges[i] = pipe.ZRange(ctx, r.getUserTokenKey(userIds[i]), 0, -1)
+	})
+
+	type userKey struct {
+		userId string
+		key    string
+	}
+	keys := make([]userKey, 0, len(userIds))
+	for i, userId := range userIds {
+		if ranges[i] == nil {
+			failed[userId] = rangeErr
+			continue
+		}
+		tokens, err := ranges[i].Result()
+		if err != nil {
+			failed[userId] = err
+			continue
+		}
+		for _, token := range tokens {
+			for _, key := range r.tokenKeys(userId, token) {
+				keys = append(keys, userKey{userId: userId, key: key})
+			}
+		}
+		keys = append(keys, userKey{userId: userId, key: r.getUserTokenKey(userId)}, userKey{userId: userId, key: r.getUserTokenCreatedKey(userId)})
+	}
+	cmds := make([]*redis.IntCmd, len(keys))
+	unlinkErr := r.pipelined(ctx, r.client, len(keys), func(pipe redis.Pipeliner, i int) {
+		cmds[i] = pipe.Unlink(ctx, keys[i].key)
+	})
+	for i, cmd := range cmds {
+		err := unlinkErr
+		if cmd != nil {
+			err = cmd.Err()
+		}
+		if err != nil {
+			if _, ok := failed[keys[i].userId]; !ok {
+				failed[keys[i].userId] = err
+			}
+		}
+	}
+
+	if len(failed) != 0 {
+		return &PartialFailureError{Errors: failed}
+	}
+	return nil
+}
+
+// moveUserTokens reassigns every token of fromUserId to toUserId, e.g. when the
+// accounts are merged. A token both users hold keeps the later expiry.
+func (r *redisBackend) moveUserTokens(ctx context.Context, fromUserId string, toUserId string) error {
+	if fromUserId == toUserId {
+		return nil
+	}
+	if r.opts.keyTagging {
+		// the token keys carry the tag of fromUserId
+		return ErrNotSupported
+	}
+	from, to := r.getUserTokenKey(fromUserId), r.getUserTokenKey(toUserId)
+	members, err := r.client.ZRangeWithScores(ctx, from, 0, -1).Result()
+	if err != nil || len(members) == 0 {
+		return err
+	}
+
+	scopeKeys, err := r.moveScopeKeys(ctx, fromUserId, toUserId, members)
+	if err != nil {
+		return err
+	}
+
+	if r.cluster {
+		// the keys may live in different slots, merge then drop each source
+		keys := append([]string{from, to}, scopeKeys...)
+		for i := 0; i < len(keys); i += 2 {
+			if err := r.mergeSortedSet(ctx, toUserId, keys[i], keys[i+1]); err != nil {
+				return err
+			}
+		}
+	} else {
+		err = moveUserTokensScript.Run(ctx, r.client, append([]string{from, to}, scopeKeys...)).Err()
+	}
+	if err != nil {
+		return err
+	}
+	r.opts.warn(ctx, "moveCreated", toUserId, r.moveCreated(ctx, fromUserId, toUserId, members))
+
+	if !r.opts.ownerIndex {
+		return nil
+	}
+	owners := make([]*redis.StatusCmd, len(members))
+	_, _ = r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, member := range members {
+			owners[i] = pipe.SetArgs(ctx, r.getTokenOwnerKey(member.Member.(string)), toUserId, redis.SetArgs{Mode: "XX", KeepTTL: true})
+		}
+		return nil
+	})
+	for _, cmd := range owners {
+		// a missing owner key went away with its token
+		if err := cmd.Err(); err != nil && !errors.Is(err, redis.Nil) {
+			return err
+		}
+	}
+	return nil
+}
+
+// moveScopeKeys returns the scope keys of the scopes the members of fromUserId grant,
+// each followed by the scope key of toUserId it moves to
+func (r *redisBackend) moveScopeKeys(ctx context.Context, fromUserId string, toUserId string, members []redis.Z) ([]string, error) {
+	tokens := make([]string, len(members))
+	for i, member := range members {
+		tokens[i] = member.Member.(string)
+	}
+	metadata, err := r.loadTokenMeta(ctx, fromUserId, tokens...)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	keys := make([]string, 0)
+	for _, m := range metadata {
+		for _, scope := range scopes(m) {
+			if !seen[scope] {
+				seen[scope] = true
+				keys = append(keys, r.getUserTokenScopeKey(fromUserId, scope), r.getUserTokenScopeKey(toUserId, scope))
+			}
+		}
+	}
+	return keys, nil
+}
+
+// mergeSortedSet moves the members of the sorted set from into to, keeping the
+// higher score of a member both hold, for keys that may live in different slots.
+// to expires with its furthest member.
+func (r *redisBackend) mergeSortedSet(ctx context.Context, userId string, from string, to string) error {
+	members, err := r.client.ZRangeWithScores(ctx, from, 0, -1).Result()
+	if err != nil || len(members) == 0 {
+		return err
+	}
+	if err := r.client.ZAddGT(ctx, to, members...).Err(); err != nil {
+		return err
+	}
+	top, err := r.client.ZRangeWithScores(ctx, to, -1, -1).Result()
+	if err != nil {
+		return err
+	}
+	if len(top) > 0 {
+		r.opts.warn(ctx, "expireat", userId, r.client.ExpireAt(ctx, to, time.Unix(int64(top[0].Score), 0)).Err())
+	}
+	return r.client.Del(ctx, from).Err()
+}
+
+// moveCreated moves the creation of the members of fromUserId to toUserId. A token
+// both users hold keeps the creation toUserId recorded.
+func (r *redisBackend) moveCreated(ctx context.Context, fromUserId string, toUserId string, members []redis.Z) error {
+	from, to := r.getUserTokenCreatedKey(fromUserId), r.getUserTokenCreatedKey(toUserId)
+	created, err := r.client.ZRangeWithScores(ctx, from, 0, -1).Result()
+	if err != nil {
+		return err
+	}
+	expires := make(map[string]float64, len(members))
+	for _, member := range members {
+		expires[member.Member.(string)] = member.Score
+	}
+
+	now := r.opts.now().Unix()
+	_, err = r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, c := range created {
+			token := c.Member.(string)
+			if expire, ok := expires[token]; ok {
+				recordCreatedScript.Eval(ctx, pipe, []string{to}, int64(c.Score), token, int64(expire), now)
+			}
+		}
+		pipe.Del(ctx, from)
+		return nil
+	})
+	return err
+}
+
+// scanUserIds calls fn with the id of every user token key, walking the keyspace
+// with SCAN so redis isn't blocked. Keys created meanwhile may or may not be seen.
+func (r *redisBackend) scanUserIds(ctx context.Context, fn func(userId string) error) error {
+	pattern := r.getUserTokenKey("*")
+	prefix, suffix, _ := strings.Cut(pattern, "*")
+
+	scan := func(ctx context.Context, client redis.UniversalClient) error {
+		var cursor uint64
+		for {
+			// the WithDefaultTimeout bounds each SCAN rather than the walk
+			scanCtx, cancel := r.opts.withDefaultTimeout(ctx)
+			keys, next, err := client.Scan(scanCtx, cursor, pattern, r.opts.scanCount).Result()
+			cancel()
+			if err != nil {
+				return err
+			}
+			for _, key := range keys {
+				if err := fn(strings.TrimSuffix(strings.TrimPrefix(key, prefix), suffix)); err != nil {
+					return err
+				}
+			}
+			if next == 0 {
+				return nil
+			}
+			cursor = next
+		}
+	}
+
+	if cluster, ok := r.client.(*redis.ClusterClient); ok {
+		return cluster.ForEachMaster(ctx, func(ctx context.Context, client *redis.Client) error {
+			return scan(ctx, client)
+		})
+	}
+	return scan(ctx, r.client)
+}
+
+// listActiveUserIds collects the ids of the users with a user token key, once each
+// although SCAN may return a key twice. It is a snapshot taken over many SCAN
+// calls, for admin and maintenance tooling, not hot paths.
+func listActiveUserIds(ctx context.Context, b backend) ([]string, error) {
+	seen := make(map[string]struct{})
+	userIds := make([]string, 0)
+	err := b.scanUserIds(ctx, func(userId string) error {
+		if _, ok := seen[userId]; !ok {
+			seen[userId] = struct{}{}
+			userIds = append(userIds, userId)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return userIds, nil
+}
+
+// exportedToken is a user token as exportUserTokens writes it, with its lifetime
+// left rather than its expiry so the clocks of the two ends needn't agree
+type exportedToken struct {
+	Token    string            `json:"token"`
+	Value    string            `json:"value"`
+	TTL      int64             `json:"ttl_ms"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// exportUserTokens serializes the active tokens of the user to JSON, for
+// importUserTokens. Soft revoked tokens are left out, they'd come back unrevoked.
+func exportUserTokens(ctx context.Context, b backend, now time.Time, userId string) ([]byte, error) {
+	tokens := make([]exportedToken, 0)
+	err := b.iterateUserTokens(ctx, userId, func(t *bUserTokenInfo) error {
+		if t.Revoked {
+			return nil
+		}
+		tokens = append(tokens, exportedToken{
+			Token:    t.TokenString,
+			Value:    t.TokenData,
+			TTL:      t.ExpiresAt.Sub(now).Milliseconds(),
+			Metadata: t.Metadata,
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(tokens)
+}
+
+// importUserTokens recreates the tokens of an exportUserTokens snapshot for the
+// user, expiring their remaining TTL from now. Tokens out of TTL are dropped, as
+// are those colliding with a stored token.
+func importUserTokens(ctx context.Context, b backend, now time.Time, userId string, data []byte) error {
+	var tokens []exportedToken
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		return err
+	}
+	entries := make([]TokenEntry, 0, len(tokens))
+	for _, t := range tokens {
+		if t.TTL <= 0 {
+			continue
+		}
+		entries = append(entries, TokenEntry{
+			Token:     t.Token,
+			Value:     t.Value,
+			ExpiresAt: now.Add(time.Duration(t.TTL) * time.Millisecond),
+			Metadata:  t.Metadata,
+		})
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+	return b.saveUserTokens(ctx, userId, entries)
+}
+
+// userIdForToken looks the owner of the token up in the WithTokenOwnerIndex keys
+func (r *redisBackend) userIdForToken(ctx context.Context, tokenString string) (string, error) {
+	if !r.opts.ownerIndex {
+		return "", ErrNotSupported
+	}
+	userId, err := r.client.Get(ctx, r.getTokenOwnerKey(tokenString)).Result()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return "", ErrTokenNotFound
+		}
+		return "", err
+	}
+	err = r.client.ZScore(ctx, r.getUserTokenKey(userId), tokenString).Err()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return "", ErrTokenNotFound
+		}
+		return "", err
+	}
+	return userId, nil
+}
+
+// watchRevocations calls fn with every token published on the revocation channel
+// until ctx is done
+func (r *redisBackend) watchRevocations(ctx context.Context, fn func(token string)) error {
+	if r.opts.revocationChannel == "" {
+		return ErrNotSupported
+	}
+	sub := r.client.Subscribe(ctx, r.joinKey(r.opts.revocationChannel))
+	defer sub.Close()
+	// wait for the subscription, so a failing connection is reported
+	if _, err := sub.Receive(ctx); err != nil {
+		return err
+	}
+
+	ch := sub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case msg, ok := <-ch:
+			if !ok {
+				return redis.ErrClosed
+			}
+			fn(msg.Payload)
+		}
+	}
+}
+
+func (r *redisBackend) ping(ctx context.Context) error {
+	return r.client.Ping(ctx).Err()
+}
+
+func (r *redisBackend) close() error {
+	return r.client.Close()
+}
+
+// mget returns the values of keys in order, nil for a missing key.
+func (r *redisBackend) mget(ctx context.Context, keys ...string) ([]interface{}, error) {
+	if !r.cluster {
+		return r.reader().MGet(ctx, keys...).Result()
+	}
+
+	cmds := make([]*redis.StringCmd, len(keys))
+	_, err := r.reader().Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, key := range keys {
+			cmds[i] = pipe.Get(ctx, key)
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return nil, err
+	}
+	values := make([]interface{}, len(keys))
+	for i, cmd := range cmds {
+		if v, err := cmd.Result(); err == nil {
+			values[i] = v
+		}
+	}
+	return values, nil
 }
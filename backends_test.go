@@ -0,0 +1,512 @@
+package tokenmanager
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// newTestBackend returns a redisBackend on a miniredis server closed with the test,
+// bound to its own copy of the default options, together with the server.
+func newTestBackend(t *testing.T) (*redisBackend, *miniredis.Miniredis) {
+	t.Helper()
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() {
+		_ = client.Close()
+	})
+	opts := &options{}
+	*opts = *defaultOptions
+	r := &redisBackend{client: client}
+	r.bind(opts)
+	return r, server
+}
+
+// fixedTokens returns the tokens in turn, then fails the test
+func fixedTokens(t *testing.T, tokens ...string) func() (string, error) {
+	return func() (string, error) {
+		if len(tokens) == 0 {
+			t.Fatal("no tokens left")
+		}
+		token := tokens[0]
+		tokens = tokens[1:]
+		return token, nil
+	}
+}
+
+func TestSaveUserTokenCollisionRetry(t *testing.T) {
+	ctx := context.Background()
+	r, _ := newTestBackend(t)
+	if _, err := r.saveUserToken(ctx, "user", fixedTokens(t, "taken"), "value", time.Hour, nil); err != nil {
+		t.Fatalf("saveUserToken: %v", err)
+	}
+
+	token, err := r.saveUserToken(ctx, "user", fixedTokens(t, "taken", "free"), "other", time.Hour, nil)
+	if err != nil {
+		t.Fatalf("saveUserToken of a colliding token: %v", err)
+	}
+	if token != "free" {
+		t.Fatalf("saveUserToken of a colliding token: got %q, want the retried one", token)
+	}
+	value, err := r.loadToken(ctx, "taken")
+	if err != nil {
+		t.Fatalf("loadToken: %v", err)
+	}
+	if want, _ := r.opts.encodeValue("value"); value != want {
+		t.Fatalf("loadToken of the collided token: got %q, want %q", value, want)
+	}
+	count, err := r.countUserTokens(ctx, "user")
+	if err != nil {
+		t.Fatalf("countUserTokens: %v", err)
+	}
+	if count != 2 {
+		t.Fatalf("countUserTokens: got %d, want 2", count)
+	}
+}
+
+func TestCleanupUserTokenPrunesExpired(t *testing.T) {
+	ctx := context.Background()
+	r, _ := newTestBackend(t)
+	clock := &conformanceClock{t: time.Now()}
+	r.opts.clock = clock
+	if _, err := r.saveUserToken(ctx, "user", fixedTokens(t, "short"), "value", time.Minute, nil); err != nil {
+		t.Fatalf("saveUserToken: %v", err)
+	}
+	if _, err := r.saveUserToken(ctx, "user", fixedTokens(t, "long"), "value", time.Hour, nil); err != nil {
+		t.Fatalf("saveUserToken: %v", err)
+	}
+
+	clock.advance(2 * time.Minute)
+	removed, err := r.cleanupUserToken(ctx, "user")
+	if err != nil {
+		t.Fatalf("cleanupUserToken: %v", err)
+	}
+	if removed != 1 {
+		t.Fatalf("cleanupUserToken: got %d removed, want 1", removed)
+	}
+	tokens, err := r.client.ZRange(ctx, r.getUserTokenKey("user"), 0, -1).Result()
+	if err != nil {
+		t.Fatalf("ZRange: %v", err)
+	}
+	if len(tokens) != 1 || tokens[0] != "long" {
+		t.Fatalf("user tokens after cleanup: got %v, want [long]", tokens)
+	}
+}
+
+func TestCleanupUserTokenAtExpiry(t *testing.T) {
+	ctx := context.Background()
+	start := time.Unix(time.Now().Unix(), 0)
+	expire := start.Add(10*time.Second + 500*time.Millisecond)
+	tests := []struct {
+		name string
+		now  time.Time
+		live bool
+	}{
+		{"just before the expiry", expire.Add(-time.Nanosecond), true},
+		{"at the score", time.Unix(expireScore(expire), 0), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, _ := newTestBackend(t)
+			// loadUserToken reads the score itself rather than sweeping first
+			WithLazyCleanup()(r.opts)
+			clock := &conformanceClock{t: start}
+			r.opts.clock = clock
+			if _, err := r.saveUserToken(ctx, "user", fixedTokens(t, "token"), "value", expire.Sub(start), nil); err != nil {
+				t.Fatalf("saveUserToken: %v", err)
+			}
+
+			clock.advance(tt.now.Sub(start))
+			_, err := r.loadUserToken(ctx, "user", "token")
+			if tt.live && err != nil {
+				t.Fatalf("loadUserToken: %v, want the token", err)
+			}
+			if !tt.live && !errors.Is(err, ErrTokenNotFound) {
+				t.Fatalf("loadUserToken: got %v, want ErrTokenNotFound", err)
+			}
+			removed, err := r.cleanupUserToken(ctx, "user")
+			if err != nil {
+				t.Fatalf("cleanupUserToken: %v", err)
+			}
+			if want := map[bool]int64{true: 0, false: 1}[tt.live]; removed != want {
+				t.Fatalf("cleanupUserToken: got %d removed, want %d", removed, want)
+			}
+		})
+	}
+}
+
+func TestCleanupUserTokenAllLive(t *testing.T) {
+	ctx := context.Background()
+	for _, cluster := range []bool{false, true} {
+		r, _ := newTestBackend(t)
+		// a cluster without key tagging takes the per key cleanup
+		r.cluster = cluster
+		for _, token := range []string{"a", "b"} {
+			if _, err := r.saveUserToken(ctx, "user", fixedTokens(t, token), "value", time.Hour, nil); err != nil {
+				t.Fatalf("saveUserToken: %v", err)
+			}
+		}
+		removed, err := r.cleanupUserToken(ctx, "user")
+		if err != nil {
+			t.Fatalf("cleanupUserToken with cluster %v: %v", cluster, err)
+		}
+		if removed != 0 {
+			t.Fatalf("cleanupUserToken with cluster %v: got %d removed, want 0", cluster, removed)
+		}
+		count, err := r.countUserTokens(ctx, "user")
+		if err != nil {
+			t.Fatalf("countUserTokens: %v", err)
+		}
+		if count != 2 {
+			t.Fatalf("countUserTokens with cluster %v: got %d, want 2", cluster, count)
+		}
+	}
+}
+
+func TestCleanupUserTokenConcurrentSaves(t *testing.T) {
+	ctx := context.Background()
+	for _, hashed := range []bool{false, true} {
+		r, server := newTestBackend(t)
+		if hashed {
+			r.opts.tokenHash = strings.ToUpper
+		}
+		if _, err := r.saveUserToken(ctx, "user", fixedTokens(t, "orphan"), "value", time.Hour, nil); err != nil {
+			t.Fatalf("saveUserToken: %v", err)
+		}
+		server.Del(r.getTokenKey("user", "orphan"))
+
+		const savers, saves = 4, 25
+		var wg sync.WaitGroup
+		errs := make(chan error, savers*saves*2)
+		for i := 0; i < savers; i++ {
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < saves; j++ {
+					token := "token" + strconv.Itoa(i*saves+j)
+					_, err := r.saveUserToken(ctx, "user", func() (string, error) { return token, nil }, "value", time.Hour, nil)
+					errs <- err
+				}
+			}()
+			go func() {
+				defer wg.Done()
+				for j := 0; j < saves; j++ {
+					_, err := r.cleanupUserToken(ctx, "user")
+					errs <- err
+				}
+			}()
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			if err != nil {
+				t.Fatalf("hashed %v: %v", hashed, err)
+			}
+		}
+
+		if _, err := r.cleanupUserToken(ctx, "user"); err != nil {
+			t.Fatalf("cleanupUserToken: %v", err)
+		}
+		tokens, err := r.client.ZRange(ctx, r.getUserTokenKey("user"), 0, -1).Result()
+		if err != nil {
+			t.Fatalf("ZRange: %v", err)
+		}
+		if len(tokens) != savers*saves {
+			t.Fatalf("hashed %v: got %d user tokens, want every saved one and no orphan", hashed, len(tokens))
+		}
+		for _, token := range tokens {
+			if token == "orphan" {
+				t.Fatalf("hashed %v: the orphan survived the cleanup", hashed)
+			}
+		}
+	}
+}
+
+func TestScanUserIdsOutlastsDefaultTimeout(t *testing.T) {
+	ctx := context.Background()
+	r, _ := newTestBackend(t)
+	r.opts.defaultTimeout = 20 * time.Millisecond
+	r.opts.scanCount = 1
+	for _, userId := range []string{"a", "b", "c", "d"} {
+		if _, err := r.saveUserToken(ctx, userId, nil, "value", time.Hour, nil); err != nil {
+			t.Fatalf("saveUserToken: %v", err)
+		}
+	}
+
+	b := &instrumentedBackend{next: r, opts: r.opts}
+	seen := 0
+	err := b.scanUserIds(ctx, func(userId string) error {
+		seen++
+		time.Sleep(15 * time.Millisecond)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("scanUserIds: %v", err)
+	}
+	if seen < 4 {
+		t.Fatalf("scanUserIds: got %d users, want 4", seen)
+	}
+}
+
+func TestLoadValidatorRejectsListedToken(t *testing.T) {
+	ctx := context.Background()
+	errRejected := errors.New("rejected")
+	r, _ := newTestBackend(t)
+	r.opts.loadValidator = func(ctx context.Context, token string, value string) error {
+		if token == "rejected" {
+			return errRejected
+		}
+		return nil
+	}
+	b := &validatedBackend{backend: r, opts: r.opts}
+	for _, token := range []string{"kept", "rejected"} {
+		if _, err := b.saveUserToken(ctx, "user", fixedTokens(t, token), "value", time.Hour, map[string]string{ScopeMetadataKey: "read"}); err != nil {
+			t.Fatalf("saveUserToken: %v", err)
+		}
+	}
+
+	if _, err := b.loadUserTokenList(ctx, "user"); !errors.Is(err, errRejected) {
+		t.Fatalf("loadUserTokenList: got %v, want the validator error", err)
+	}
+	if _, err := b.loadUserTokensWithScope(ctx, "user", "read"); !errors.Is(err, errRejected) {
+		t.Fatalf("loadUserTokensWithScope: got %v, want the validator error", err)
+	}
+	if _, _, err := b.loadUserTokenListPaged(ctx, "user", 0, 10); !errors.Is(err, errRejected) {
+		t.Fatalf("loadUserTokenListPaged: got %v, want the validator error", err)
+	}
+	err := b.iterateUserTokens(ctx, "user", func(*bUserTokenInfo) error { return nil })
+	if !errors.Is(err, errRejected) {
+		t.Fatalf("iterateUserTokens: got %v, want the validator error", err)
+	}
+}
+
+func TestDeleteAllUserTokensCanceled(t *testing.T) {
+	r, _ := newTestBackend(t)
+	if _, err := r.saveUserToken(context.Background(), "user", nil, "value", time.Hour, nil); err != nil {
+		t.Fatalf("saveUserToken: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := r.deleteAllUserTokens(ctx, "user", "other")
+	var partial *PartialFailureError
+	if !errors.As(err, &partial) || !errors.Is(partial.Errors["user"], context.Canceled) {
+		t.Fatalf("deleteAllUserTokens on a canceled ctx: got %v, want every user failed with it", err)
+	}
+}
+
+func TestMoveUserTokensMovesScopes(t *testing.T) {
+	ctx := context.Background()
+	for _, cluster := range []bool{false, true} {
+		r, server := newTestBackend(t)
+		r.cluster = cluster
+		token, err := r.saveUserToken(ctx, "from", nil, "value", time.Hour, map[string]string{ScopeMetadataKey: "admin"})
+		if err != nil {
+			t.Fatalf("saveUserToken: %v", err)
+		}
+		if err := r.moveUserTokens(ctx, "from", "to"); err != nil {
+			t.Fatalf("moveUserTokens with cluster %v: %v", cluster, err)
+		}
+
+		list, err := r.loadUserTokensWithScope(ctx, "to", "admin")
+		if err != nil {
+			t.Fatalf("loadUserTokensWithScope: %v", err)
+		}
+		if len(list) != 1 || list[0].TokenString != token {
+			t.Fatalf("loadUserTokensWithScope after the move with cluster %v: got %d tokens, want the moved one", cluster, len(list))
+		}
+		if server.Exists(r.getUserTokenScopeKey("from", "admin")) {
+			t.Fatalf("the scope key of the source user survived the move with cluster %v", cluster)
+		}
+	}
+}
+
+func TestExtendUserTokensExtendsScopes(t *testing.T) {
+	ctx := context.Background()
+	extend := map[string]func(r *redisBackend, token string) error{
+		"extendAllUserTokens": func(r *redisBackend, token string) error {
+			return r.extendAllUserTokens(ctx, "user", time.Hour)
+		},
+		"refreshUserToken": func(r *redisBackend, token string) error {
+			return r.refreshUserToken(ctx, "user", token, time.Hour)
+		},
+	}
+	for name, fn := range extend {
+		t.Run(name, func(t *testing.T) {
+			r, server := newTestBackend(t)
+			clock := &conformanceClock{t: time.Now()}
+			r.opts.clock = clock
+			server.SetTime(clock.t)
+			token, err := r.saveUserToken(ctx, "user", nil, "value", time.Minute, map[string]string{ScopeMetadataKey: "admin"})
+			if err != nil {
+				t.Fatalf("saveUserToken: %v", err)
+			}
+			if err := fn(r, token); err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+
+			clock.advance(2 * time.Minute)
+			server.FastForward(2 * time.Minute)
+			list, err := r.loadUserTokensWithScope(ctx, "user", "admin")
+			if err != nil {
+				t.Fatalf("loadUserTokensWithScope: %v", err)
+			}
+			if len(list) != 1 || list[0].TokenString != token {
+				t.Fatalf("loadUserTokensWithScope after %s: got %d tokens, want the extended one", name, len(list))
+			}
+		})
+	}
+}
+
+// assertUserTokenKeyOutlivesTokens fails the test when the user token key expires
+// before its furthest member, server being at now
+func assertUserTokenKeyOutlivesTokens(t *testing.T, r *redisBackend, server *miniredis.Miniredis, now time.Time, userId string) {
+	t.Helper()
+	key := r.getUserTokenKey(userId)
+	top, err := r.client.ZRangeWithScores(context.Background(), key, -1, -1).Result()
+	if err != nil {
+		t.Fatalf("ZRangeWithScores: %v", err)
+	}
+	if len(top) == 0 {
+		t.Fatal("the user token key has no members")
+	}
+	ttl := server.TTL(key)
+	if ttl <= 0 {
+		t.Fatalf("the user token key has no expiry: TTL %v", ttl)
+	}
+	if expireAt := now.Add(ttl).Unix(); expireAt < int64(top[0].Score) {
+		t.Fatalf("the user token key expires at %d, before its furthest member at %d", expireAt, int64(top[0].Score))
+	}
+}
+
+func TestUserTokenKeyExpiresWithTokens(t *testing.T) {
+	ctx := context.Background()
+	r, server := newTestBackend(t)
+	clock := &conformanceClock{t: time.Now()}
+	r.opts.clock = clock
+	server.SetTime(clock.t)
+	if _, err := r.saveUserToken(ctx, "user", nil, "value", time.Hour, nil); err != nil {
+		t.Fatalf("saveUserToken: %v", err)
+	}
+	if _, err := r.saveUserToken(ctx, "user", nil, "value", time.Minute, nil); err != nil {
+		t.Fatalf("saveUserToken: %v", err)
+	}
+	assertUserTokenKeyOutlivesTokens(t, r, server, clock.t, "user")
+	if err := r.extendAllUserTokens(ctx, "user", 2*time.Hour); err != nil {
+		t.Fatalf("extendAllUserTokens: %v", err)
+	}
+	assertUserTokenKeyOutlivesTokens(t, r, server, clock.t, "user")
+
+	server.FastForward(2*time.Hour + time.Second)
+	if server.Exists(r.getUserTokenKey("user")) {
+		t.Fatal("the user token key outlived every token")
+	}
+}
+
+func TestExtendAllUserTokensKeepsKeyPastRevoked(t *testing.T) {
+	ctx := context.Background()
+	r, server := newTestBackend(t)
+	clock := &conformanceClock{t: time.Now()}
+	r.opts.clock = clock
+	server.SetTime(clock.t)
+	if _, err := r.saveUserToken(ctx, "user", fixedTokens(t, "active"), "value", time.Hour, nil); err != nil {
+		t.Fatalf("saveUserToken: %v", err)
+	}
+	if _, err := r.saveUserToken(ctx, "user", fixedTokens(t, "revoked"), "value", 2*time.Hour, nil); err != nil {
+		t.Fatalf("saveUserToken: %v", err)
+	}
+	if err := r.revokeToken(ctx, "revoked"); err != nil {
+		t.Fatalf("revokeToken: %v", err)
+	}
+
+	if err := r.extendAllUserTokens(ctx, "user", 30*time.Minute); err != nil {
+		t.Fatalf("extendAllUserTokens: %v", err)
+	}
+	assertUserTokenKeyOutlivesTokens(t, r, server, clock.t, "user")
+}
+
+func TestSaveUserTokenWithIdOfAnotherUser(t *testing.T) {
+	ctx := context.Background()
+	for _, ownerIndex := range []bool{false, true} {
+		t.Run("ownerIndex="+strconv.FormatBool(ownerIndex), func(t *testing.T) {
+			r, server := newTestBackend(t)
+			r.opts.ownerIndex = ownerIndex
+			if _, err := r.saveUserTokenWithId(ctx, "alice", "idem-1", "value", time.Hour); err != nil {
+				t.Fatalf("saveUserTokenWithId: %v", err)
+			}
+			_, err := r.saveUserTokenWithId(ctx, "bob", "idem-1", "other", time.Hour)
+			if !errors.Is(err, ErrTokenTaken) {
+				t.Fatalf("saveUserTokenWithId of another user's token: got %v, want ErrTokenTaken", err)
+			}
+			if server.Exists(r.getUserTokenKey("bob")) {
+				t.Fatal("saveUserTokenWithId of another user's token added it to that user")
+			}
+			if _, err := r.saveUserTokenWithId(ctx, "alice", "idem-1", "value", time.Hour); err != nil {
+				t.Fatalf("saveUserTokenWithId retried by its owner: %v", err)
+			}
+		})
+	}
+
+	t.Run("memory", func(t *testing.T) {
+		m := NewMemoryBackend().(*memoryBackend)
+		opts := &options{}
+		*opts = *defaultOptions
+		m.bind(opts)
+		if _, err := m.saveUserTokenWithId(ctx, "alice", "idem-1", "value", time.Hour); err != nil {
+			t.Fatalf("saveUserTokenWithId: %v", err)
+		}
+		if _, err := m.saveUserTokenWithId(ctx, "bob", "idem-1", "other", time.Hour); !errors.Is(err, ErrTokenTaken) {
+			t.Fatalf("saveUserTokenWithId of another user's token: got %v, want ErrTokenTaken", err)
+		}
+		count, err := m.countUserTokens(ctx, "bob")
+		if err != nil {
+			t.Fatalf("countUserTokens: %v", err)
+		}
+		if count != 0 {
+			t.Fatalf("countUserTokens of the other user: got %d, want 0", count)
+		}
+	})
+}
+
+func TestLocalCacheDropsTrimmedTokens(t *testing.T) {
+	ctx := context.Background()
+	r, _ := newTestBackend(t)
+	WithMaxUserTokens(1)(r.opts)
+	WithLocalCache(100, time.Minute)(r.opts)
+	b := &cachedBackend{backend: r}
+	b.bind(r.opts)
+
+	saves := map[string]func(userId, token string, expiresIn time.Duration) error{
+		"saveUserToken": func(userId, token string, expiresIn time.Duration) error {
+			_, err := b.saveUserToken(ctx, userId, fixedTokens(t, token), "value", expiresIn, nil)
+			return err
+		},
+		"saveUserTokenWithId": func(userId, token string, expiresIn time.Duration) error {
+			_, err := b.saveUserTokenWithId(ctx, userId, token, "value", expiresIn)
+			return err
+		},
+		"saveUserTokens": func(userId, token string, expiresIn time.Duration) error {
+			return b.saveUserTokens(ctx, userId, []TokenEntry{{Token: token, Value: "value", ExpiresAt: time.Now().Add(expiresIn)}})
+		},
+	}
+	for name, save := range saves {
+		if err := save(name, name+"-old", time.Hour); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if _, err := b.loadToken(ctx, name+"-old"); err != nil {
+			t.Fatalf("loadToken: %v", err)
+		}
+		if err := save(name, name+"-new", 2*time.Hour); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if _, err := b.loadToken(ctx, name+"-old"); !errors.Is(err, ErrTokenNotFound) {
+			t.Fatalf("loadToken of the token %s trimmed: got %v, want ErrTokenNotFound", name, err)
+		}
+	}
+}
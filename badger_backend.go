@@ -0,0 +1,1500 @@
+package tokenmanager
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/dgraph-io/badger/v4"
+	"github.com/redis/go-redis/v9"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// badgerBackend keeps tokens in an embedded BadgerDB. It mirrors the redis layout
+// with keys expiring through Badger's TTL:
+//
+//	TOKENS:<token>                     badgerToken record
+//	REVOKED_TOKENS:<token>             revocation marker
+//	USER_TOKENS:<userId> NUL <token>   user token member, valued with its expire score
+//
+// Every operation runs in one transaction, retried when it conflicts with another.
+type badgerBackend struct {
+	opts *options
+	db   *badger.DB
+}
+
+// badgerToken is the record stored under a token key
+type badgerToken struct {
+	Value       string            `json:"v"`
+	ExpireAt    int64             `json:"e,omitempty"` // unix nanoseconds, 0 for never
+	UserID      string            `json:"u,omitempty"`
+	Metadata    map[string]string `json:"m,omitempty"`
+	Unconfirmed bool              `json:"c,omitempty"`
+	SoftRevoked bool              `json:"s,omitempty"`
+	Partner     string            `json:"p,omitempty"` // other token of the pair saved by saveTokenPair
+	CreatedAt   int64             `json:"t,omitempty"` // unix nanoseconds, 0 for tokens saved before it was kept
+}
+
+func (t *badgerToken) created() time.Time {
+	if t.CreatedAt == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, t.CreatedAt).UTC()
+}
+
+func (t *badgerToken) expired(now time.Time) bool {
+	return t.ExpireAt != 0 && now.UnixNano() >= t.ExpireAt
+}
+
+func (t *badgerToken) ttl(now time.Time) time.Duration {
+	if t.ExpireAt == 0 {
+		return 0
+	}
+	return time.Unix(0, t.ExpireAt).Sub(now)
+}
+
+type badgerMember struct {
+	token string
+	score int64
+}
+
+// badgerIssueWindow counts the tokens a user issued until ResetAt
+type badgerIssueWindow struct {
+	Count   int   `json:"n"`
+	ResetAt int64 `json:"r"` // unix nanoseconds
+}
+
+// badgerConflictRetries bounds the retries of a transaction losing to a concurrent one
+const badgerConflictRetries = 10
+
+// NewBadgerBackend returns a backend persisting tokens in db, for single node
+// services without redis. Closing the manager closes db.
+func NewBadgerBackend(db *badger.DB) Backend {
+	return &badgerBackend{
+		opts: defaultOptions,
+		db:   db,
+	}
+}
+
+func (b *badgerBackend) bind(opts *options) {
+	b.opts = opts
+}
+
+func (b *badgerBackend) key(segments ...string) string {
+	if b.opts.namespace != "" {
+		segments = append([]string{b.opts.namespace}, segments...)
+	}
+	return strings.Join(segments, ":")
+}
+
+func (b *badgerBackend) hashToken(tokenString string) string {
+	if b.opts.tokenHash == nil {
+		return tokenString
+	}
+	return b.opts.tokenHash(tokenString)
+}
+
+func (b *badgerBackend) getTokenKey(tokenString string) []byte {
+	return []byte(b.key(b.opts.tokenPrefix, b.hashToken(tokenString)))
+}
+
+func (b *badgerBackend) getRevokedTokenKey(tokenString string) []byte {
+	return []byte(b.key("REVOKED_TOKENS", b.hashToken(tokenString)))
+}
+
+func (b *badgerBackend) getIssueRateKey(userId string) []byte {
+	return []byte(b.key("TOKEN_ISSUE_RATE", userId))
+}
+
+func (b *badgerBackend) getUserLockKey(userId string) []byte {
+	return []byte(b.key("USER_TOKEN_LOCKS", userId))
+}
+
+// getUserTokenPrefix prefixes the members of the user. The NUL ends the user id,
+// so the members of "a" aren't taken for those of "a:b".
+func (b *badgerBackend) getUserTokenPrefix(userId string) []byte {
+	return []byte(b.key(b.opts.userTokenPrefix, userId) + "\x00")
+}
+
+func (b *badgerBackend) getUserTokenKey(userId string, tokenString string) []byte {
+	return append(b.getUserTokenPrefix(userId), tokenString...)
+}
+
+// update runs fn in a read-write transaction, running it again on conflicts
+func (b *badgerBackend) update(fn func(txn *badger.Txn) error) error {
+	var err error
+	for i := 0; i < badgerConflictRetries; i++ {
+		err = b.db.Update(fn)
+		if !errors.Is(err, badger.ErrConflict) {
+			return err
+		}
+	}
+	return err
+}
+
+// expiringEntry is an entry removed by Badger once expireAt passes, never before
+// as Badger expires entries by the second.
+func expiringEntry(key, value []byte, expireAt int64) *badger.Entry {
+	e := badger.NewEntry(key, value)
+	if expireAt != 0 {
+		e.ExpiresAt = uint64(expireScore(time.Unix(0, expireAt)))
+	}
+	return e
+}
+
+// getToken returns the live record of the token, nil when missing or expired
+func (b *badgerBackend) getToken(txn *badger.Txn, tokenString string, now time.Time) (*badgerToken, error) {
+	item, err := txn.Get(b.getTokenKey(tokenString))
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var t badgerToken
+	err = item.Value(func(val []byte) error {
+		return json.Unmarshal(val, &t)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if t.expired(now) {
+		return nil, nil
+	}
+	return &t, nil
+}
+
+func (b *badgerBackend) setToken(txn *badger.Txn, tokenString string, t *badgerToken) error {
+	data, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	return txn.SetEntry(expiringEntry(b.getTokenKey(tokenString), data, t.ExpireAt))
+}
+
+// saveTokenTxn stores a new record unless a live one exists, like SET NX
+func (b *badgerBackend) saveTokenTxn(txn *badger.Txn, tokenString string, t *badgerToken, now time.Time) (bool, error) {
+	existing, err := b.getToken(txn, tokenString, now)
+	if err != nil || existing != nil {
+		return false, err
+	}
+	t.CreatedAt = now.UnixNano()
+	return true, b.setToken(txn, tokenString, t)
+}
+
+func (b *badgerBackend) isRevoked(txn *badger.Txn, tokenString string) (bool, error) {
+	_, err := txn.Get(b.getRevokedTokenKey(tokenString))
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// members returns the members of the user ordered like ZRANGE: by score, then by token
+func (b *badgerBackend) members(txn *badger.Txn, userId string) ([]badgerMember, error) {
+	prefix := b.getUserTokenPrefix(userId)
+	it := txn.NewIterator(badger.IteratorOptions{Prefix: prefix, PrefetchValues: true, PrefetchSize: 100})
+	defer it.Close()
+
+	members := make([]badgerMember, 0)
+	for it.Rewind(); it.Valid(); it.Next() {
+		item := it.Item()
+		var score int64
+		err := item.Value(func(val []byte) error {
+			var err error
+			score, err = strconv.ParseInt(string(val), 10, 64)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, badgerMember{token: string(item.Key()[len(prefix):]), score: score})
+	}
+	sort.Slice(members, func(i, j int) bool {
+		if members[i].score != members[j].score {
+			return members[i].score < members[j].score
+		}
+		return members[i].token < members[j].token
+	})
+	return members, nil
+}
+
+// listedMembers returns the members of the user in the WithListOrder order
+func (b *badgerBackend) listedMembers(txn *badger.Txn, userId string) ([]badgerMember, error) {
+	members, err := b.members(txn, userId)
+	if err != nil {
+		return nil, err
+	}
+	if b.opts.listOrder == Descending {
+		slices.Reverse(members)
+	}
+	return members, nil
+}
+
+func (b *badgerBackend) memberScore(txn *badger.Txn, userId string, tokenString string) (int64, bool, error) {
+	item, err := txn.Get(b.getUserTokenKey(userId, tokenString))
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	var score int64
+	err = item.Value(func(val []byte) error {
+		score, err = strconv.ParseInt(string(val), 10, 64)
+		return err
+	})
+	return score, err == nil, err
+}
+
+func (b *badgerBackend) setMember(txn *badger.Txn, userId string, tokenString string, score int64) error {
+	e := badger.NewEntry(b.getUserTokenKey(userId, tokenString), []byte(strconv.FormatInt(score, 10)))
+	e.ExpiresAt = uint64(score)
+	return txn.SetEntry(e)
+}
+
+func (b *badgerBackend) deleteMember(txn *badger.Txn, userId string, tokenString string) error {
+	return txn.Delete(b.getUserTokenKey(userId, tokenString))
+}
+
+// deleteUserTokenTxn removes both the member and the record of the token
+func (b *badgerBackend) deleteUserTokenTxn(txn *badger.Txn, userId string, tokenString string) error {
+	if err := b.deleteMember(txn, userId, tokenString); err != nil {
+		return err
+	}
+	return txn.Delete(b.getTokenKey(tokenString))
+}
+
+func (b *badgerBackend) checkIssueRateTxn(txn *badger.Txn, userId string, now time.Time) error {
+	if b.opts.issueRateMax <= 0 {
+		return nil
+	}
+	key := b.getIssueRateKey(userId)
+	var w badgerIssueWindow
+	item, err := txn.Get(key)
+	switch {
+	case errors.Is(err, badger.ErrKeyNotFound):
+	case err != nil:
+		return err
+	default:
+		err = item.Value(func(val []byte) error {
+			return json.Unmarshal(val, &w)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if now.UnixNano() >= w.ResetAt {
+		w = badgerIssueWindow{ResetAt: now.Add(b.opts.issueRateWindow).UnixNano()}
+	}
+	w.Count++
+	data, err := json.Marshal(w)
+	if err != nil {
+		return err
+	}
+	if err := txn.SetEntry(expiringEntry(key, data, w.ResetAt)); err != nil {
+		return err
+	}
+	if w.Count > b.opts.issueRateMax {
+		return ErrRateLimited
+	}
+	return nil
+}
+
+// cleanupUserTokenTxn removes the expired and dangling members of the user
+func (b *badgerBackend) cleanupUserTokenTxn(txn *badger.Txn, userId string, now time.Time) (int64, error) {
+	members, err := b.members(txn, userId)
+	if err != nil {
+		return 0, err
+	}
+	var removed int64
+	for _, member := range members {
+		if member.score > now.Unix() {
+			t, err := b.getToken(txn, member.token, now)
+			if err != nil {
+				return removed, err
+			}
+			if t != nil {
+				continue
+			}
+		}
+		if err := b.deleteMember(txn, userId, member.token); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// trimUserTokenTxn keeps the newest WithMaxUserTokens tokens of the user
+func (b *badgerBackend) trimUserTokenTxn(txn *badger.Txn, userId string) error {
+	max := b.opts.maxUserTokens
+	if max <= 0 {
+		return nil
+	}
+	members, err := b.members(txn, userId)
+	if err != nil || len(members) <= max {
+		return err
+	}
+	for _, member := range members[:len(members)-max] {
+		if err := b.deleteUserTokenTxn(txn, userId, member.token); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// saveUserTokenTxn generates and stores a token of the user
+func (b *badgerBackend) saveUserTokenTxn(ctx context.Context, txn *badger.Txn, userId string, genToken func() (string, error), value string, expiresIn time.Duration, t badgerToken, now time.Time) (string, error) {
+	expire := now.Add(expiresIn).UTC()
+	t.Value = value
+	t.UserID = userId
+	t.ExpireAt = expire.UnixNano()
+	token, err := b.opts.generateToken(ctx, genToken, func(token string) (bool, error) {
+		return b.saveTokenTxn(txn, token, &t, now)
+	})
+	if err != nil {
+		return "", err
+	}
+	if err := b.setMember(txn, userId, token, expireScore(expire)); err != nil {
+		return "", err
+	}
+	return token, b.trimUserTokenTxn(txn, userId)
+}
+
+func (b *badgerBackend) saveToken(ctx context.Context, token string, value interface{}, expire time.Duration) (bool, error) {
+	if expire < 0 {
+		return false, ErrInvalidExpiry
+	}
+	v, err := b.opts.encodeValue(value)
+	if err != nil {
+		return false, err
+	}
+
+	var ok bool
+	err = b.update(func(txn *badger.Txn) error {
+		now := b.opts.now()
+		t := &badgerToken{Value: v}
+		if expire > 0 {
+			t.ExpireAt = now.Add(expire).UnixNano()
+		}
+		ok, err = b.saveTokenTxn(txn, token, t, now)
+		return err
+	})
+	return ok, err
+}
+
+func (b *badgerBackend) loadToken(ctx context.Context, token string) (string, error) {
+	value, _, err := b.loadTokenWithTTL(ctx, token)
+	return value, err
+}
+
+func (b *badgerBackend) loadTokenWithTTL(ctx context.Context, token string) (string, time.Duration, error) {
+	var value string
+	var ttl time.Duration
+	err := b.db.View(func(txn *badger.Txn) error {
+		now := b.opts.now()
+		revoked, err := b.isRevoked(txn, token)
+		if err != nil {
+			return err
+		}
+		if revoked {
+			return ErrTokenRevoked
+		}
+		t, err := b.getToken(txn, token, now)
+		if err != nil {
+			return err
+		}
+		if t == nil {
+			return ErrTokenNotFound
+		}
+		if t.Unconfirmed {
+			return ErrTokenUnconfirmed
+		}
+		value, ttl = t.Value, t.ttl(now)
+		return nil
+	})
+	if err != nil {
+		return "", 0, err
+	}
+	return value, ttl, nil
+}
+
+func (b *badgerBackend) deleteToken(ctx context.Context, tokens ...string) error {
+	return b.update(func(txn *badger.Txn) error {
+		for _, token := range tokens {
+			if err := txn.Delete(b.getTokenKey(token)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (b *badgerBackend) deleteTokenIfValue(ctx context.Context, token string, expected string) (bool, error) {
+	var deleted bool
+	err := b.update(func(txn *badger.Txn) error {
+		t, err := b.getToken(txn, token, b.opts.now())
+		if err != nil || t == nil || t.Value != expected {
+			deleted = false
+			return err
+		}
+		deleted = true
+		return txn.Delete(b.getTokenKey(token))
+	})
+	return deleted, err
+}
+
+func (b *badgerBackend) updateTokenValue(ctx context.Context, token string, value interface{}) error {
+	v, err := b.opts.encodeValue(value)
+	if err != nil {
+		return err
+	}
+	return b.update(func(txn *badger.Txn) error {
+		t, err := b.getToken(txn, token, b.opts.now())
+		if err != nil {
+			return err
+		}
+		if t == nil {
+			return ErrTokenNotFound
+		}
+		t.Value = v
+		return b.setToken(txn, token, t)
+	})
+}
+
+func (b *badgerBackend) updateTokenValueIfActive(ctx context.Context, userId string, token string, value interface{}) error {
+	v, err := b.opts.encodeValue(value)
+	if err != nil {
+		return err
+	}
+	return b.update(func(txn *badger.Txn) error {
+		now := b.opts.now()
+		score, ok, err := b.memberScore(txn, userId, token)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return ErrTokenNotFound
+		}
+		_, t, err := b.loadUserTokenTxn(txn, token, score, now)
+		if err != nil {
+			return err
+		}
+		t.Value = v
+		return b.setToken(txn, token, t)
+	})
+}
+
+func (b *badgerBackend) isTokenExist(ctx context.Context, token string) (bool, error) {
+	var ok bool
+	err := b.db.View(func(txn *badger.Txn) error {
+		t, err := b.getToken(txn, token, b.opts.now())
+		ok = t != nil
+		return err
+	})
+	return ok, err
+}
+
+func (b *badgerBackend) areTokensExist(ctx context.Context, tokens ...string) (map[string]bool, error) {
+	exists := make(map[string]bool, len(tokens))
+	err := b.db.View(func(txn *badger.Txn) error {
+		now := b.opts.now()
+		for _, token := range tokens {
+			t, err := b.getToken(txn, token, now)
+			if err != nil {
+				return err
+			}
+			exists[token] = t != nil
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return exists, nil
+}
+
+// revokeToken marks the token revoked until the token itself expires
+func (b *badgerBackend) revokeToken(ctx context.Context, token string) error {
+	return b.update(func(txn *badger.Txn) error {
+		now := b.opts.now()
+		t, err := b.getToken(txn, token, now)
+		if err != nil {
+			return err
+		}
+		if t == nil {
+			return ErrTokenNotFound
+		}
+		if err := b.revokeTxn(txn, token, t); err != nil {
+			return err
+		}
+		if t.Partner == "" {
+			return nil
+		}
+		p, err := b.getToken(txn, t.Partner, now)
+		if err != nil || p == nil {
+			return err
+		}
+		return b.revokeTxn(txn, t.Partner, p)
+	})
+}
+
+func (b *badgerBackend) revokeTxn(txn *badger.Txn, token string, t *badgerToken) error {
+	if t.SoftRevoked {
+		t.SoftRevoked = false
+		if err := b.setToken(txn, token, t); err != nil {
+			return err
+		}
+	}
+	return txn.SetEntry(expiringEntry(b.getRevokedTokenKey(token), []byte("1"), t.ExpireAt))
+}
+
+func (b *badgerBackend) softRevokeUserToken(ctx context.Context, userId string, token string, grace time.Duration) error {
+	return b.update(func(txn *badger.Txn) error {
+		now := b.opts.now()
+		t, err := b.getToken(txn, token, now)
+		if err != nil {
+			return err
+		}
+		if err := b.softRevokeTxn(txn, userId, token, grace, now); err != nil {
+			return err
+		}
+		if t.Partner == "" {
+			return nil
+		}
+		if err := b.softRevokeTxn(txn, userId, t.Partner, grace, now); !errors.Is(err, ErrTokenNotFound) {
+			return err
+		}
+		return nil
+	})
+}
+
+func (b *badgerBackend) softRevokeTxn(txn *badger.Txn, userId string, token string, grace time.Duration, now time.Time) error {
+	score, ok, err := b.memberScore(txn, userId, token)
+	if err != nil {
+		return err
+	}
+	if !ok || score <= now.Unix() {
+		return ErrTokenNotFound
+	}
+	t, err := b.getToken(txn, token, now)
+	if err != nil {
+		return err
+	}
+	if t == nil {
+		return ErrTokenNotFound
+	}
+
+	expire := now.Add(grace).UTC()
+	if t.ExpireAt != 0 && time.Unix(0, t.ExpireAt).Before(expire) {
+		expire = time.Unix(0, t.ExpireAt)
+	}
+	t.ExpireAt = expire.UnixNano()
+	t.SoftRevoked = true
+	if err := b.setToken(txn, token, t); err != nil {
+		return err
+	}
+	if err := txn.SetEntry(expiringEntry(b.getRevokedTokenKey(token), []byte(softRevokedMarker), t.ExpireAt)); err != nil {
+		return err
+	}
+	return b.setMember(txn, userId, token, expireScore(expire))
+}
+
+func (b *badgerBackend) cleanupUserToken(ctx context.Context, userId string) (int64, error) {
+	var removed int64
+	err := b.update(func(txn *badger.Txn) error {
+		var err error
+		removed, err = b.cleanupUserTokenTxn(txn, userId, b.opts.now())
+		return err
+	})
+	return removed, err
+}
+
+func (b *badgerBackend) previewCleanupUserToken(ctx context.Context, userId string) ([]string, error) {
+	preview := make([]string, 0)
+	err := b.db.View(func(txn *badger.Txn) error {
+		now := b.opts.now()
+		members, err := b.members(txn, userId)
+		if err != nil {
+			return err
+		}
+		for _, member := range members {
+			if member.score > now.Unix() {
+				t, err := b.getToken(txn, member.token, now)
+				if err != nil {
+					return err
+				}
+				if t != nil {
+					continue
+				}
+			}
+			preview = append(preview, member.token)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return preview, nil
+}
+
+func (b *badgerBackend) saveUserToken(ctx context.Context, userId string, genToken func() (string, error), value interface{}, expiresIn time.Duration, metadata map[string]string) (string, error) {
+	if err := checkExpiry(expiresIn); err != nil {
+		return "", err
+	}
+	v, err := b.opts.encodeValue(value)
+	if err != nil {
+		return "", err
+	}
+
+	var token string
+	err = b.update(func(txn *badger.Txn) error {
+		now := b.opts.now()
+		if err := b.checkIssueRateTxn(txn, userId, now); err != nil {
+			return err
+		}
+		if _, err := b.cleanupUserTokenTxn(txn, userId, now); err != nil {
+			return err
+		}
+		token, err = b.saveUserTokenTxn(ctx, txn, userId, genToken, v, expiresIn, badgerToken{Metadata: copyMetadata(metadata)}, now)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+func (b *badgerBackend) saveTokenPair(ctx context.Context, userId string, genAccess, genRefresh func() (string, error), accessValue, refreshValue interface{}, accessTTL, refreshTTL time.Duration, metadata map[string]string) (string, string, error) {
+	if err := checkExpiry(accessTTL); err != nil {
+		return "", "", err
+	}
+	if err := checkExpiry(refreshTTL); err != nil {
+		return "", "", err
+	}
+	av, err := b.opts.encodeValue(accessValue)
+	if err != nil {
+		return "", "", err
+	}
+	rv, err := b.opts.encodeValue(refreshValue)
+	if err != nil {
+		return "", "", err
+	}
+
+	var access, refresh string
+	err = b.update(func(txn *badger.Txn) error {
+		now := b.opts.now()
+		if err := b.checkIssueRateTxn(txn, userId, now); err != nil {
+			return err
+		}
+		if _, err := b.cleanupUserTokenTxn(txn, userId, now); err != nil {
+			return err
+		}
+		access, err = b.saveUserTokenTxn(ctx, txn, userId, genAccess, av, accessTTL, badgerToken{Metadata: copyMetadata(metadata)}, now)
+		if err != nil {
+			return err
+		}
+		refresh, err = b.saveUserTokenTxn(ctx, txn, userId, genRefresh, rv, refreshTTL, badgerToken{Metadata: copyMetadata(metadata), Partner: access}, now)
+		if err != nil {
+			return err
+		}
+		t, err := b.getToken(txn, access, now)
+		if err != nil || t == nil {
+			return err
+		}
+		t.Partner = refresh
+		return b.setToken(txn, access, t)
+	})
+	if err != nil {
+		return "", "", err
+	}
+	return access, refresh, nil
+}
+
+func (b *badgerBackend) saveUnconfirmedUserToken(ctx context.Context, userId string, genToken func() (string, error), value interface{}, expiresIn time.Duration) (string, error) {
+	if err := checkExpiry(expiresIn); err != nil {
+		return "", err
+	}
+	v, err := b.opts.encodeValue(value)
+	if err != nil {
+		return "", err
+	}
+
+	var token string
+	err = b.update(func(txn *badger.Txn) error {
+		now := b.opts.now()
+		if err := b.checkIssueRateTxn(txn, userId, now); err != nil {
+			return err
+		}
+		if _, err := b.cleanupUserTokenTxn(txn, userId, now); err != nil {
+			return err
+		}
+		token, err = b.saveUserTokenTxn(ctx, txn, userId, genToken, v, expiresIn, badgerToken{Unconfirmed: true}, now)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+func (b *badgerBackend) confirmUserToken(ctx context.Context, userId string, tokenString string) error {
+	return b.update(func(txn *badger.Txn) error {
+		now := b.opts.now()
+		score, ok, err := b.memberScore(txn, userId, tokenString)
+		if err != nil {
+			return err
+		}
+		if !ok || score <= now.Unix() {
+			return ErrTokenNotFound
+		}
+		t, err := b.getToken(txn, tokenString, now)
+		if err != nil {
+			return err
+		}
+		if t == nil {
+			return ErrTokenNotFound
+		}
+		if !t.Unconfirmed {
+			return nil
+		}
+		t.Unconfirmed = false
+		return b.setToken(txn, tokenString, t)
+	})
+}
+
+// getOrCreateUserToken reads and writes the user lock key, so concurrent callers
+// conflict and the losers find the token of the winner when retried.
+func (b *badgerBackend) getOrCreateUserToken(ctx context.Context, userId string, genToken func() (string, error), value interface{}, expiresIn time.Duration) (string, bool, error) {
+	if err := checkExpiry(expiresIn); err != nil {
+		return "", false, err
+	}
+	v, err := b.opts.encodeValue(value)
+	if err != nil {
+		return "", false, err
+	}
+
+	var token string
+	var created bool
+	err = b.update(func(txn *badger.Txn) error {
+		now := b.opts.now()
+		lockKey := b.getUserLockKey(userId)
+		if _, err := txn.Get(lockKey); err != nil && !errors.Is(err, badger.ErrKeyNotFound) {
+			return err
+		}
+		if err := txn.SetEntry(badger.NewEntry(lockKey, nil).WithTTL(userLockTTL)); err != nil {
+			return err
+		}
+
+		if _, err := b.cleanupUserTokenTxn(txn, userId, now); err != nil {
+			return err
+		}
+		members, err := b.members(txn, userId)
+		if err != nil {
+			return err
+		}
+		if len(members) != 0 {
+			token, created = members[len(members)-1].token, false
+			return nil
+		}
+		if err := b.checkIssueRateTxn(txn, userId, now); err != nil {
+			return err
+		}
+		token, err = b.saveUserTokenTxn(ctx, txn, userId, genToken, v, expiresIn, badgerToken{}, now)
+		created = err == nil
+		return err
+	})
+	if err != nil {
+		return "", false, err
+	}
+	return token, created, nil
+}
+
+func (b *badgerBackend) saveUserTokenWithId(ctx context.Context, userId string, token string, value interface{}, expiresIn time.Duration) (bool, error) {
+	if err := checkExpiry(expiresIn); err != nil {
+		return false, err
+	}
+	v, err := b.opts.encodeValue(value)
+	if err != nil {
+		return false, err
+	}
+
+	var created bool
+	err = b.update(func(txn *badger.Txn) error {
+		now := b.opts.now()
+		if err := b.checkIssueRateTxn(txn, userId, now); err != nil {
+			return err
+		}
+		if _, err := b.cleanupUserTokenTxn(txn, userId, now); err != nil {
+			return err
+		}
+		expire := now.Add(expiresIn).UTC()
+		existing, err := b.getToken(txn, token, now)
+		if err != nil {
+			return err
+		}
+		if existing != nil {
+			if existing.UserID != userId {
+				return ErrTokenTaken
+			}
+			// a retry of a save that went through: make sure the member is there too
+			created = false
+			_, ok, err := b.memberScore(txn, userId, token)
+			if err != nil || ok {
+				return err
+			}
+			if existing.ExpireAt != 0 {
+				expire = time.Unix(0, existing.ExpireAt)
+			}
+			return b.setMember(txn, userId, token, expireScore(expire))
+		}
+
+		created = true
+		t := &badgerToken{Value: v, UserID: userId, ExpireAt: expire.UnixNano(), CreatedAt: now.UnixNano()}
+		if err := b.setToken(txn, token, t); err != nil {
+			return err
+		}
+		if err := b.setMember(txn, userId, token, expireScore(expire)); err != nil {
+			return err
+		}
+		return b.trimUserTokenTxn(txn, userId)
+	})
+	return created, err
+}
+
+// saveUserTokens skips entries already expired or whose token is already stored
+func (b *badgerBackend) saveUserTokens(ctx context.Context, userId string, entries []TokenEntry) error {
+	values := make([]string, len(entries))
+	for i, entry := range entries {
+		v, err := b.opts.encodeValue(entry.Value)
+		if err != nil {
+			return err
+		}
+		values[i] = v
+	}
+
+	return b.update(func(txn *badger.Txn) error {
+		now := b.opts.now()
+		for i, entry := range entries {
+			if !entry.ExpiresAt.After(now) {
+				continue
+			}
+			t := &badgerToken{
+				Value:    values[i],
+				ExpireAt: entry.ExpiresAt.UnixNano(),
+				UserID:   userId,
+				Metadata: copyMetadata(entry.Metadata),
+			}
+			ok, err := b.saveTokenTxn(txn, entry.Token, t, now)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				continue
+			}
+			if err := b.setMember(txn, userId, entry.Token, expireScore(entry.ExpiresAt)); err != nil {
+				return err
+			}
+		}
+		return b.trimUserTokenTxn(txn, userId)
+	})
+}
+
+// saveUserTokenPipe and deleteUserTokenPipe need a redis pipeline
+func (b *badgerBackend) saveUserTokenPipe(ctx context.Context, pipe redis.Pipeliner, userId string, genToken func() (string, error), value interface{}, expiresIn time.Duration) (string, func() error, error) {
+	return "", nil, ErrNotSupported
+}
+
+func (b *badgerBackend) deleteUserTokenPipe(ctx context.Context, pipe redis.Pipeliner, userId string, tokens ...string) func() error {
+	return func() error { return ErrNotSupported }
+}
+
+// loadUserTokenTxn returns the user token of a member whose score is known
+func (b *badgerBackend) loadUserTokenTxn(txn *badger.Txn, tokenString string, score int64, now time.Time) (*bUserTokenInfo, *badgerToken, error) {
+	if score <= now.Unix() {
+		return nil, nil, ErrTokenNotFound
+	}
+	revoked, err := b.isRevoked(txn, tokenString)
+	if err != nil {
+		return nil, nil, err
+	}
+	if revoked {
+		return nil, nil, ErrTokenRevoked
+	}
+	t, err := b.getToken(txn, tokenString, now)
+	if err != nil {
+		return nil, nil, err
+	}
+	if t == nil {
+		return nil, nil, ErrTokenNotFound
+	}
+	return &bUserTokenInfo{
+		TokenString: tokenString,
+		Fingerprint: Fingerprint(tokenString),
+		TokenData:   t.Value,
+		ExpiresAt:   time.Unix(score, 0).UTC(),
+		Metadata:    copyMetadata(t.Metadata),
+		CreatedAt:   t.created(),
+		opts:        b.opts,
+	}, t, nil
+}
+
+// loadSoftRevokedUserTokenTxn loads a revoked user token in its grace period,
+// failing with ErrTokenRevoked for a token revoked by revokeToken
+func (b *badgerBackend) loadSoftRevokedUserTokenTxn(txn *badger.Txn, tokenString string, score int64, now time.Time) (*bUserTokenInfo, error) {
+	t, err := b.getToken(txn, tokenString, now)
+	if err != nil {
+		return nil, err
+	}
+	if t == nil {
+		return nil, ErrTokenNotFound
+	}
+	if !t.SoftRevoked {
+		return nil, ErrTokenRevoked
+	}
+	return &bUserTokenInfo{
+		TokenString: tokenString,
+		Fingerprint: Fingerprint(tokenString),
+		TokenData:   t.Value,
+		ExpiresAt:   time.Unix(score, 0).UTC(),
+		Metadata:    copyMetadata(t.Metadata),
+		Revoked:     true,
+		CreatedAt:   t.created(),
+		opts:        b.opts,
+	}, nil
+}
+
+func (b *badgerBackend) loadUserToken(ctx context.Context, userId string, tokenString string) (*bUserTokenInfo, error) {
+	var userToken *bUserTokenInfo
+	err := b.update(func(txn *badger.Txn) error {
+		now := b.opts.now()
+		if b.opts.cleanupOnLoad() {
+			if _, err := b.cleanupUserTokenTxn(txn, userId, now); err != nil {
+				return err
+			}
+		}
+		revoked, err := b.isRevoked(txn, tokenString)
+		if err != nil {
+			return err
+		}
+		if d := b.opts.slidingExpiration; d > 0 && !revoked {
+			if err := b.refreshUserTokenTxn(txn, userId, tokenString, d, now); err != nil {
+				return err
+			}
+		}
+		score, ok, err := b.memberScore(txn, userId, tokenString)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return ErrTokenNotFound
+		}
+		var t *badgerToken
+		userToken, t, err = b.loadUserTokenTxn(txn, tokenString, score, now)
+		if errors.Is(err, ErrTokenRevoked) {
+			userToken, err = b.loadSoftRevokedUserTokenTxn(txn, tokenString, score, now)
+			return err
+		}
+		if err != nil {
+			return err
+		}
+		if t.Unconfirmed {
+			return ErrTokenUnconfirmed
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return userToken, nil
+}
+
+// loadUserTokenMembers returns the user tokens of members, skipping those that can't be used
+func (b *badgerBackend) loadUserTokenMembers(txn *badger.Txn, members []badgerMember, now time.Time) ([]*bUserTokenInfo, error) {
+	userTokenList := make([]*bUserTokenInfo, 0, len(members))
+	for _, member := range members {
+		userToken, _, err := b.loadUserTokenTxn(txn, member.token, member.score, now)
+		if errors.Is(err, ErrTokenNotFound) || errors.Is(err, ErrTokenRevoked) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		userTokenList = append(userTokenList, userToken)
+	}
+	return userTokenList, nil
+}
+
+func (b *badgerBackend) loadUserTokensWithScope(ctx context.Context, userId string, scope string) ([]*bUserTokenInfo, error) {
+	list, err := b.loadUserTokenList(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+	return withScope(list, scope), nil
+}
+
+func (b *badgerBackend) loadUserTokenList(ctx context.Context, userId string) ([]*bUserTokenInfo, error) {
+	var userTokenList []*bUserTokenInfo
+	err := b.update(func(txn *badger.Txn) error {
+		now := b.opts.now()
+		if _, err := b.cleanupUserTokenTxn(txn, userId, now); err != nil {
+			return err
+		}
+		members, err := b.listedMembers(txn, userId)
+		if err != nil {
+			return err
+		}
+		userTokenList, err = b.loadUserTokenMembers(txn, members, now)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return userTokenList, nil
+}
+
+func (b *badgerBackend) loadUserTokenListPaged(ctx context.Context, userId string, offset, limit int64) ([]*bUserTokenInfo, int64, error) {
+	var userTokenList []*bUserTokenInfo
+	var total int64
+	err := b.update(func(txn *badger.Txn) error {
+		now := b.opts.now()
+		if _, err := b.cleanupUserTokenTxn(txn, userId, now); err != nil {
+			return err
+		}
+		members, err := b.listedMembers(txn, userId)
+		if err != nil {
+			return err
+		}
+		total = int64(len(members))
+		start := min(max(offset, 0), total)
+		end := total
+		if limit >= 0 {
+			end = min(start+limit, total)
+		}
+		userTokenList, err = b.loadUserTokenMembers(txn, members[start:end], now)
+		return err
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return userTokenList, total, nil
+}
+
+func (b *badgerBackend) deleteUserToken(ctx context.Context, userId string, tokens ...string) (int64, error) {
+	var deleted int64
+	err := b.update(func(txn *badger.Txn) error {
+		deleted = 0
+		for _, token := range tokens {
+			member, err := b.exists(txn, b.getUserTokenKey(userId, token))
+			if err != nil {
+				return err
+			}
+			value, err := b.exists(txn, b.getTokenKey(token))
+			if err != nil {
+				return err
+			}
+			if member || value {
+				deleted++
+			}
+			if err := b.deleteUserTokenTxn(txn, userId, token); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return deleted, err
+}
+
+func (b *badgerBackend) exists(txn *badger.Txn, key []byte) (bool, error) {
+	_, err := txn.Get(key)
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (b *badgerBackend) deleteAllUserTokens(ctx context.Context, userIds ...string) error {
+	failed := make(map[string]error)
+	for _, userId := range userIds {
+		err := b.update(func(txn *badger.Txn) error {
+			members, err := b.members(txn, userId)
+			if err != nil {
+				return err
+			}
+			for _, member := range members {
+				if err := b.deleteUserTokenTxn(txn, userId, member.token); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			failed[userId] = err
+		}
+	}
+	if len(failed) != 0 {
+		return &PartialFailureError{Errors: failed}
+	}
+	return nil
+}
+
+func (b *badgerBackend) moveUserTokens(ctx context.Context, fromUserId string, toUserId string) error {
+	if fromUserId == toUserId {
+		return nil
+	}
+	return b.update(func(txn *badger.Txn) error {
+		now := b.opts.now()
+		members, err := b.members(txn, fromUserId)
+		if err != nil {
+			return err
+		}
+		for _, member := range members {
+			current, ok, err := b.memberScore(txn, toUserId, member.token)
+			if err != nil {
+				return err
+			}
+			if !ok || current < member.score {
+				if err := b.setMember(txn, toUserId, member.token, member.score); err != nil {
+					return err
+				}
+			}
+			if err := b.deleteMember(txn, fromUserId, member.token); err != nil {
+				return err
+			}
+			t, err := b.getToken(txn, member.token, now)
+			if err != nil {
+				return err
+			}
+			if t != nil && t.UserID == fromUserId {
+				t.UserID = toUserId
+				if err := b.setToken(txn, member.token, t); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func (b *badgerBackend) deleteUserTokensExcept(ctx context.Context, userId string, keepToken string) error {
+	return b.update(func(txn *badger.Txn) error {
+		members, err := b.members(txn, userId)
+		if err != nil {
+			return err
+		}
+		if !slices.ContainsFunc(members, func(member badgerMember) bool { return member.token == keepToken }) {
+			return ErrTokenNotFound
+		}
+		for _, member := range members {
+			if member.token == keepToken {
+				continue
+			}
+			if err := b.deleteUserTokenTxn(txn, userId, member.token); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (b *badgerBackend) countUserTokens(ctx context.Context, userId string) (int64, error) {
+	var count int64
+	err := b.update(func(txn *badger.Txn) error {
+		if _, err := b.cleanupUserTokenTxn(txn, userId, b.opts.now()); err != nil {
+			return err
+		}
+		members, err := b.members(txn, userId)
+		count = int64(len(members))
+		return err
+	})
+	return count, err
+}
+
+// userTokenExists reports whether tokenString is an active, unrevoked token of the user
+func (b *badgerBackend) userTokenExists(ctx context.Context, userId string, tokenString string) (bool, error) {
+	var ok bool
+	err := b.update(func(txn *badger.Txn) error {
+		now := b.opts.now()
+		if _, err := b.cleanupUserTokenTxn(txn, userId, now); err != nil {
+			return err
+		}
+		score, member, err := b.memberScore(txn, userId, tokenString)
+		if err != nil || !member {
+			ok = false
+			return err
+		}
+		_, _, err = b.loadUserTokenTxn(txn, tokenString, score, now)
+		ok = err == nil
+		if errors.Is(err, ErrTokenNotFound) || errors.Is(err, ErrTokenRevoked) {
+			return nil
+		}
+		return err
+	})
+	return ok, err
+}
+
+func (b *badgerBackend) refreshUserTokenTxn(txn *badger.Txn, userId string, tokenString string, expiresIn time.Duration, now time.Time) error {
+	_, ok, err := b.memberScore(txn, userId, tokenString)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrTokenNotFound
+	}
+	t, err := b.getToken(txn, tokenString, now)
+	if err != nil {
+		return err
+	}
+	if t == nil {
+		if err := b.deleteMember(txn, userId, tokenString); err != nil {
+			return err
+		}
+		return ErrTokenNotFound
+	}
+	revoked, err := b.isRevoked(txn, tokenString)
+	if err != nil {
+		return err
+	}
+	if revoked {
+		// the revocation expires with the expiry the token had
+		return ErrTokenRevoked
+	}
+
+	expire := now.Add(expiresIn).UTC()
+	t.ExpireAt = expire.UnixNano()
+	if err := b.setToken(txn, tokenString, t); err != nil {
+		return err
+	}
+	return b.setMember(txn, userId, tokenString, expireScore(expire))
+}
+
+func (b *badgerBackend) refreshUserToken(ctx context.Context, userId string, tokenString string, expiresIn time.Duration) error {
+	if err := checkExpiry(expiresIn); err != nil {
+		return err
+	}
+	var missing bool
+	err := b.update(func(txn *badger.Txn) error {
+		err := b.refreshUserTokenTxn(txn, userId, tokenString, expiresIn, b.opts.now())
+		// keep the removal of a dangling member
+		missing = errors.Is(err, ErrTokenNotFound)
+		if missing {
+			return nil
+		}
+		return err
+	})
+	if err == nil && missing {
+		return ErrTokenNotFound
+	}
+	return err
+}
+
+func (b *badgerBackend) extendAllUserTokens(ctx context.Context, userId string, expiresIn time.Duration) error {
+	if err := checkExpiry(expiresIn); err != nil {
+		return err
+	}
+	return b.update(func(txn *badger.Txn) error {
+		now := b.opts.now()
+		if _, err := b.cleanupUserTokenTxn(txn, userId, now); err != nil {
+			return err
+		}
+		members, err := b.members(txn, userId)
+		if err != nil {
+			return err
+		}
+		for _, member := range members {
+			err := b.refreshUserTokenTxn(txn, userId, member.token, expiresIn, now)
+			if err != nil && !errors.Is(err, ErrTokenRevoked) {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (b *badgerBackend) rotateUserToken(ctx context.Context, userId string, oldToken string, genToken func() (string, error), value interface{}, expiresIn time.Duration) (string, error) {
+	if err := checkExpiry(expiresIn); err != nil {
+		return "", err
+	}
+	v, err := b.opts.encodeValue(value)
+	if err != nil {
+		return "", err
+	}
+
+	var token string
+	err = b.update(func(txn *badger.Txn) error {
+		now := b.opts.now()
+		score, ok, err := b.memberScore(txn, userId, oldToken)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return ErrTokenNotFound
+		}
+		if _, _, err := b.loadUserTokenTxn(txn, oldToken, score, now); err != nil {
+			return err
+		}
+		if err := b.deleteUserTokenTxn(txn, userId, oldToken); err != nil {
+			return err
+		}
+		token, err = b.saveUserTokenTxn(ctx, txn, userId, genToken, v, expiresIn, badgerToken{}, now)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+func (b *badgerBackend) userIdForToken(ctx context.Context, tokenString string) (string, error) {
+	var userId string
+	err := b.db.View(func(txn *badger.Txn) error {
+		t, err := b.getToken(txn, tokenString, b.opts.now())
+		if err != nil {
+			return err
+		}
+		if t == nil || t.UserID == "" {
+			return ErrTokenNotFound
+		}
+		_, ok, err := b.memberScore(txn, t.UserID, tokenString)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return ErrTokenNotFound
+		}
+		userId = t.UserID
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return userId, nil
+}
+
+// reconcileUserToken moves the member score to the expiry of the record, giving a
+// record without expiry the expiry of its score.
+func (b *badgerBackend) reconcileUserToken(ctx context.Context, userId string, tokenString string) error {
+	var missing bool
+	err := b.update(func(txn *badger.Txn) error {
+		score, ok, err := b.memberScore(txn, userId, tokenString)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return ErrTokenNotFound
+		}
+		t, err := b.getToken(txn, tokenString, b.opts.now())
+		if err != nil {
+			return err
+		}
+		if t == nil {
+			missing = true
+			return b.deleteMember(txn, userId, tokenString)
+		}
+		if t.ExpireAt == 0 {
+			t.ExpireAt = time.Unix(score, 0).UnixNano()
+			return b.setToken(txn, tokenString, t)
+		}
+		return b.setMember(txn, userId, tokenString, expireScore(time.Unix(0, t.ExpireAt)))
+	})
+	if err == nil && missing {
+		return ErrTokenNotFound
+	}
+	return err
+}
+
+func (b *badgerBackend) dumpUserTokens(ctx context.Context, userId string) ([]UserTokenDebug, error) {
+	var dump []UserTokenDebug
+	err := b.db.View(func(txn *badger.Txn) error {
+		now := b.opts.now()
+		members, err := b.members(txn, userId)
+		if err != nil {
+			return err
+		}
+		dump = make([]UserTokenDebug, 0, len(members))
+		for _, member := range members {
+			entry := UserTokenDebug{
+				TokenString: member.token,
+				Score:       member.score,
+				TTL:         -2,
+			}
+			t, err := b.getToken(txn, member.token, now)
+			if err != nil {
+				return err
+			}
+			if t != nil {
+				entry.Exists = true
+				entry.TTL = -1
+				if t.ExpireAt != 0 {
+					entry.TTL = t.ttl(now)
+				}
+			}
+			dump = append(dump, entry)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return dump, nil
+}
+
+// scanUserIds walks the member keys, which sort by user id first
+func (b *badgerBackend) scanUserIds(ctx context.Context, fn func(userId string) error) error {
+	prefix := []byte(b.key(b.opts.userTokenPrefix) + ":")
+	userIds := make([]string, 0)
+	err := b.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.IteratorOptions{Prefix: prefix})
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			rest := string(it.Item().Key()[len(prefix):])
+			userId, _, ok := strings.Cut(rest, "\x00")
+			if ok && (len(userIds) == 0 || userIds[len(userIds)-1] != userId) {
+				userIds = append(userIds, userId)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, userId := range userIds {
+		if err := fn(userId); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *badgerBackend) iterateUserTokens(ctx context.Context, userId string, fn func(*bUserTokenInfo) error) error {
+	userTokenList, err := b.loadUserTokenList(ctx, userId)
+	if err != nil {
+		return err
+	}
+	for _, userToken := range userTokenList {
+		if err := fn(userToken); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *badgerBackend) watchRevocations(ctx context.Context, fn func(token string)) error {
+	return ErrNotSupported
+}
+
+func (b *badgerBackend) ping(ctx context.Context) error {
+	if b.db.IsClosed() {
+		return badger.ErrDBClosed
+	}
+	return nil
+}
+
+func (b *badgerBackend) close() error {
+	return b.db.Close()
+}
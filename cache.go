@@ -0,0 +1,309 @@
+package tokenmanager
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"github.com/redis/go-redis/v9"
+	"sync"
+	"time"
+)
+
+// cacheWatchBackoff is the wait before resubscribing to the revocation channel
+const cacheWatchBackoff = time.Second
+
+// cachedBackend memoizes the loadToken results of the next backend in an LRU of
+// WithLocalCache size. An entry lives for the cache ttl but never past the expiry
+// of its token, and is dropped when this instance changes the token or another
+// one announces its revocation on the WithRevocationChannel channel.
+type cachedBackend struct {
+	backend
+	opts *options
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List // front is the most recently used
+
+	stop func()
+	done chan struct{}
+}
+
+type cacheEntry struct {
+	key      string
+	value    string
+	expireAt time.Time // expiry of the token, zero for none
+	until    time.Time // the entry is stale from then on
+}
+
+func (b *cachedBackend) bind(opts *options) {
+	b.opts = opts
+	b.backend.bind(opts)
+	b.entries = make(map[string]*list.Element)
+	b.lru = list.New()
+	if opts.revocationChannel != "" && b.stop == nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		b.stop = cancel
+		b.done = make(chan struct{})
+		go b.watch(ctx)
+	}
+}
+
+// watch invalidates the tokens revoked by other instances until ctx is done.
+// Revocations published while resubscribing are missed, so the cache is purged.
+func (b *cachedBackend) watch(ctx context.Context) {
+	defer close(b.done)
+	for {
+		err := b.backend.watchRevocations(ctx, b.invalidateKey)
+		if ctx.Err() != nil || errors.Is(err, ErrNotSupported) {
+			return
+		}
+		b.opts.warn(ctx, "watchRevocations", "", err)
+		b.purge()
+		timer := time.NewTimer(cacheWatchBackoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// cacheKey is the form of token revocations are published in
+func (b *cachedBackend) cacheKey(token string) string {
+	if b.opts.tokenHash == nil {
+		return token
+	}
+	return b.opts.tokenHash(token)
+}
+
+func (b *cachedBackend) get(token string, now time.Time) (*cacheEntry, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	el, ok := b.entries[b.cacheKey(token)]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*cacheEntry)
+	if !now.Before(e.until) {
+		b.lru.Remove(el)
+		delete(b.entries, e.key)
+		return nil, false
+	}
+	b.lru.MoveToFront(el)
+	return e, true
+}
+
+func (b *cachedBackend) put(token string, value string, ttl time.Duration, now time.Time) {
+	e := &cacheEntry{key: b.cacheKey(token), value: value, until: now.Add(b.opts.localCacheTTL)}
+	if ttl > 0 {
+		e.expireAt = now.Add(ttl)
+		if e.expireAt.Before(e.until) {
+			e.until = e.expireAt
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if el, ok := b.entries[e.key]; ok {
+		el.Value = e
+		b.lru.MoveToFront(el)
+		return
+	}
+	b.entries[e.key] = b.lru.PushFront(e)
+	for b.lru.Len() > b.opts.localCacheSize {
+		oldest := b.lru.Back()
+		b.lru.Remove(oldest)
+		delete(b.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+func (b *cachedBackend) invalidate(tokens ...string) {
+	for _, token := range tokens {
+		b.invalidateKey(b.cacheKey(token))
+	}
+}
+
+func (b *cachedBackend) invalidateKey(key string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if el, ok := b.entries[key]; ok {
+		b.lru.Remove(el)
+		delete(b.entries, key)
+	}
+}
+
+// purge drops every entry, for changes to tokens the cache can't name
+func (b *cachedBackend) purge() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.entries = make(map[string]*list.Element)
+	b.lru.Init()
+}
+
+func (b *cachedBackend) loadToken(ctx context.Context, token string) (string, error) {
+	value, _, err := b.loadTokenWithTTL(ctx, token)
+	return value, err
+}
+
+func (b *cachedBackend) loadTokenWithTTL(ctx context.Context, token string) (string, time.Duration, error) {
+	now := b.opts.now()
+	if e, ok := b.get(token, now); ok {
+		var ttl time.Duration
+		if !e.expireAt.IsZero() {
+			ttl = e.expireAt.Sub(now)
+		}
+		return e.value, ttl, nil
+	}
+	value, ttl, err := b.backend.loadTokenWithTTL(ctx, token)
+	if err != nil {
+		return "", 0, err
+	}
+	b.put(token, value, ttl, now)
+	return value, ttl, nil
+}
+
+func (b *cachedBackend) deleteToken(ctx context.Context, tokens ...string) error {
+	defer b.invalidate(tokens...)
+	return b.backend.deleteToken(ctx, tokens...)
+}
+
+func (b *cachedBackend) deleteTokenIfValue(ctx context.Context, token string, expected string) (bool, error) {
+	defer b.invalidate(token)
+	return b.backend.deleteTokenIfValue(ctx, token, expected)
+}
+
+func (b *cachedBackend) updateTokenValue(ctx context.Context, token string, value interface{}) error {
+	defer b.invalidate(token)
+	return b.backend.updateTokenValue(ctx, token, value)
+}
+
+func (b *cachedBackend) updateTokenValueIfActive(ctx context.Context, userId string, token string, value interface{}) error {
+	defer b.invalidate(token)
+	return b.backend.updateTokenValueIfActive(ctx, userId, token, value)
+}
+
+func (b *cachedBackend) revokeToken(ctx context.Context, token string) error {
+	defer b.invalidate(token)
+	return b.backend.revokeToken(ctx, token)
+}
+
+func (b *cachedBackend) softRevokeUserToken(ctx context.Context, userId string, token string, grace time.Duration) error {
+	defer b.invalidate(token)
+	return b.backend.softRevokeUserToken(ctx, userId, token, grace)
+}
+
+// deleteUserTokenPipe can only invalidate before the pipe runs
+func (b *cachedBackend) deleteUserTokenPipe(ctx context.Context, pipe redis.Pipeliner, userId string, tokens ...string) func() error {
+	b.invalidate(tokens...)
+	return b.backend.deleteUserTokenPipe(ctx, pipe, userId, tokens...)
+}
+
+func (b *cachedBackend) deleteUserToken(ctx context.Context, userId string, tokens ...string) (int64, error) {
+	defer b.invalidate(tokens...)
+	return b.backend.deleteUserToken(ctx, userId, tokens...)
+}
+
+func (b *cachedBackend) deleteAllUserTokens(ctx context.Context, userIds ...string) error {
+	defer b.purge()
+	return b.backend.deleteAllUserTokens(ctx, userIds...)
+}
+
+func (b *cachedBackend) deleteUserTokensExcept(ctx context.Context, userId string, keepToken string) error {
+	defer b.purge()
+	return b.backend.deleteUserTokensExcept(ctx, userId, keepToken)
+}
+
+// trimmed purges after a save that WithMaxUserTokens may have made evict other
+// tokens of the user, which the cache can't name
+func (b *cachedBackend) trimmed() {
+	if b.opts.maxUserTokens > 0 {
+		b.purge()
+	}
+}
+
+func (b *cachedBackend) saveUserToken(ctx context.Context, userId string, genToken func() (string, error), value interface{}, expiresIn time.Duration, metadata map[string]string) (string, error) {
+	defer b.trimmed()
+	return b.backend.saveUserToken(ctx, userId, genToken, value, expiresIn, metadata)
+}
+
+func (b *cachedBackend) saveTokenPair(ctx context.Context, userId string, genAccess, genRefresh func() (string, error), accessValue, refreshValue interface{}, accessTTL, refreshTTL time.Duration, metadata map[string]string) (string, string, error) {
+	defer b.trimmed()
+	return b.backend.saveTokenPair(ctx, userId, genAccess, genRefresh, accessValue, refreshValue, accessTTL, refreshTTL, metadata)
+}
+
+func (b *cachedBackend) saveUnconfirmedUserToken(ctx context.Context, userId string, genToken func() (string, error), value interface{}, expiresIn time.Duration) (string, error) {
+	defer b.trimmed()
+	return b.backend.saveUnconfirmedUserToken(ctx, userId, genToken, value, expiresIn)
+}
+
+func (b *cachedBackend) getOrCreateUserToken(ctx context.Context, userId string, genToken func() (string, error), value interface{}, expiresIn time.Duration) (string, bool, error) {
+	defer b.trimmed()
+	return b.backend.getOrCreateUserToken(ctx, userId, genToken, value, expiresIn)
+}
+
+func (b *cachedBackend) saveUserTokenWithId(ctx context.Context, userId string, token string, value interface{}, expiresIn time.Duration) (bool, error) {
+	defer b.trimmed()
+	return b.backend.saveUserTokenWithId(ctx, userId, token, value, expiresIn)
+}
+
+func (b *cachedBackend) saveUserTokens(ctx context.Context, userId string, entries []TokenEntry) error {
+	defer b.trimmed()
+	return b.backend.saveUserTokens(ctx, userId, entries)
+}
+
+// saveUserTokenPipe trims once the pipe ran, when its result is read
+func (b *cachedBackend) saveUserTokenPipe(ctx context.Context, pipe redis.Pipeliner, userId string, genToken func() (string, error), value interface{}, expiresIn time.Duration) (string, func() error, error) {
+	token, result, err := b.backend.saveUserTokenPipe(ctx, pipe, userId, genToken, value, expiresIn)
+	if err != nil {
+		return token, result, err
+	}
+	return token, func() error {
+		defer b.trimmed()
+		return result()
+	}, nil
+}
+
+func (b *cachedBackend) cleanupUserToken(ctx context.Context, userId string) (int64, error) {
+	defer b.purge()
+	return b.backend.cleanupUserToken(ctx, userId)
+}
+
+func (b *cachedBackend) moveUserTokens(ctx context.Context, fromUserId string, toUserId string) error {
+	defer b.purge()
+	return b.backend.moveUserTokens(ctx, fromUserId, toUserId)
+}
+
+// reconcileUserToken may shorten the expiry like refreshUserToken
+func (b *cachedBackend) reconcileUserToken(ctx context.Context, userId string, tokenString string) error {
+	defer b.invalidate(tokenString)
+	return b.backend.reconcileUserToken(ctx, userId, tokenString)
+}
+
+// refreshUserToken may shorten the expiry, which a cached entry would outlive
+func (b *cachedBackend) refreshUserToken(ctx context.Context, userId string, tokenString string, expiresIn time.Duration) error {
+	defer b.invalidate(tokenString)
+	return b.backend.refreshUserToken(ctx, userId, tokenString, expiresIn)
+}
+
+func (b *cachedBackend) extendAllUserTokens(ctx context.Context, userId string, expiresIn time.Duration) error {
+	defer b.purge()
+	return b.backend.extendAllUserTokens(ctx, userId, expiresIn)
+}
+
+func (b *cachedBackend) rotateUserToken(ctx context.Context, userId string, oldToken string, genToken func() (string, error), value interface{}, expiresIn time.Duration) (string, error) {
+	defer b.invalidate(oldToken)
+	return b.backend.rotateUserToken(ctx, userId, oldToken, genToken, value, expiresIn)
+}
+
+func (b *cachedBackend) close() error {
+	if b.stop != nil {
+		b.stop()
+		<-b.done
+	}
+	return b.backend.close()
+}
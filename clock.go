@@ -0,0 +1,16 @@
+package tokenmanager
+
+import "time"
+
+// Clock tells the backends what time it is, so expiry can be tested without sleeping
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (o *options) now() time.Time {
+	return o.clock.Now().UTC()
+}
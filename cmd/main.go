@@ -35,14 +35,9 @@ func main() {
 
 	fmt.Println(r)
 
-	options := []tokenmanager.Option{
-		tokenmanager.WithOpaqueToken(),
-		tokenmanager.WithRedisBackend(cli),
-	}
-
-	tkm := tokenmanager.CreateManager[TokenPayload](options)
+	tkm := tokenmanager.New[TokenPayload](cli, tokenmanager.WithOpaqueToken())
 
-	p, e := tkm.CreateTokenPair(ctx, UserID, &TokenPayload{
+	p, e := tkm.User.CreateTokenPair(ctx, UserID, &TokenPayload{
 		Name: "test",
 	})
 	if e != nil {
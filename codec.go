@@ -0,0 +1,116 @@
+package tokenmanager
+
+import (
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+type codec struct {
+	encode func(any) ([]byte, error)
+	decode func([]byte, any) error
+}
+
+var jsonCodec = codec{
+	encode: json.Marshal,
+	decode: json.Unmarshal,
+}
+
+// encodeValue passes values the backends store natively and encodes everything else
+func (c codec) encodeValue(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case []byte:
+		return string(v), nil
+	case encoding.BinaryMarshaler:
+		b, err := v.MarshalBinary()
+		if err != nil {
+			return "", err
+		}
+		return string(b), nil
+	default:
+		b, err := c.encode(v)
+		if err != nil {
+			return "", err
+		}
+		return string(b), nil
+	}
+}
+
+// encodeValue encodes value with the configured codec, rejecting values over the
+// WithMaxValueSize limit
+func (o *options) encodeValue(value interface{}) (string, error) {
+	v, err := o.codec.encodeValue(value)
+	if err != nil {
+		return "", err
+	}
+	if o.maxValueSize > 0 && len(v) > o.maxValueSize {
+		return "", ErrValueTooLarge
+	}
+	return v, nil
+}
+
+// payloadVersionMarker starts a versioned payload, followed by the version byte.
+// Neither JSON nor a codec marshaling a struct starts a value with it.
+const payloadVersionMarker = 0x00
+
+var payloadVersions = struct {
+	mu     sync.RWMutex
+	decode map[int]func([]byte) (any, error)
+}{decode: make(map[int]func([]byte) (any, error))}
+
+// RegisterPayloadVersion registers how payloads written under an older
+// WithPayloadVersion v are read. decode returns the payload in any form the codec
+// encodes to the current schema, e.g. the current payload type filled in from the
+// old one. It panics when v isn't from 1 to 255 or is registered twice.
+func RegisterPayloadVersion(v int, decode func([]byte) (any, error)) {
+	if v < 1 || v > 255 {
+		panic(fmt.Sprintf("tokenmanager: payload version %d out of range", v))
+	}
+	payloadVersions.mu.Lock()
+	defer payloadVersions.mu.Unlock()
+	if _, ok := payloadVersions.decode[v]; ok {
+		panic(fmt.Sprintf("tokenmanager: payload version %d registered twice", v))
+	}
+	payloadVersions.decode[v] = decode
+}
+
+// encodePayload encodes a token payload with the codec, behind the WithPayloadVersion
+// prefix when one is set
+func (o *options) encodePayload(v any) ([]byte, error) {
+	b, err := o.codec.encode(v)
+	if err != nil || o.payloadVersion == 0 {
+		return b, err
+	}
+	return append([]byte{payloadVersionMarker, byte(o.payloadVersion)}, b...), nil
+}
+
+// decodePayload decodes a token payload into dest. Payloads of the current version
+// or without one are decoded as they are, older ones through their registered decoder.
+func (o *options) decodePayload(data []byte, dest any) error {
+	if len(data) < 2 || data[0] != payloadVersionMarker {
+		return o.codec.decode(data, dest)
+	}
+	version, payload := int(data[1]), data[2:]
+	if version == o.payloadVersion {
+		return o.codec.decode(payload, dest)
+	}
+
+	payloadVersions.mu.RLock()
+	decode, ok := payloadVersions.decode[version]
+	payloadVersions.mu.RUnlock()
+	if !ok {
+		return fmt.Errorf("%w: %d", ErrUnknownPayloadVersion, version)
+	}
+	v, err := decode(payload)
+	if err != nil {
+		return err
+	}
+	b, err := o.codec.encode(v)
+	if err != nil {
+		return err
+	}
+	return o.codec.decode(b, dest)
+}
@@ -0,0 +1,302 @@
+package tokenmanager
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// conformanceClock is a clock moved by hand, so expiry is checked without sleeping.
+// Redis still expires values on its own clock, hence expiry is only asserted
+// through user token scores, which every backend compares against the clock.
+type conformanceClock struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+func (c *conformanceClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+func (c *conformanceClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.t = c.t.Add(d)
+}
+
+// RunBackendConformanceTests checks that a backend behaves like the others on
+// saving, loading, deleting and cleaning up tokens. newBackend is called for every
+// subtest and must return an empty backend, e.g. from a fresh miniredis; it is
+// closed when the subtest ends. Operations the backend doesn't support are skipped.
+func RunBackendConformanceTests(t *testing.T, newBackend func() Backend) {
+	setup := func(t *testing.T) (backend, *conformanceClock) {
+		clock := &conformanceClock{t: time.Now()}
+		opts := &options{}
+		*opts = *defaultOptions
+		opts.clock = clock
+		b := newBackend()
+		b.bind(opts)
+		t.Cleanup(func() {
+			if err := b.close(); err != nil {
+				t.Logf("close: %v", err)
+			}
+		})
+		return b, clock
+	}
+	ctx := context.Background()
+	genToken := func() (string, error) {
+		return newTokenID(), nil
+	}
+	check := func(t *testing.T, op string, err error) {
+		t.Helper()
+		if errors.Is(err, ErrNotSupported) {
+			t.Skipf("%s not supported", op)
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", op, err)
+		}
+	}
+	expectErr := func(t *testing.T, op string, err error, want error) {
+		t.Helper()
+		if errors.Is(err, ErrNotSupported) {
+			t.Skipf("%s not supported", op)
+		}
+		if !errors.Is(err, want) {
+			t.Fatalf("%s: got %v, want %v", op, err, want)
+		}
+	}
+
+	t.Run("SaveTokenSetNX", func(t *testing.T) {
+		b, _ := setup(t)
+		ok, err := b.saveToken(ctx, "token", "first", time.Hour)
+		check(t, "saveToken", err)
+		if !ok {
+			t.Fatal("saveToken of a new token: got false")
+		}
+		ok, err = b.saveToken(ctx, "token", "second", time.Hour)
+		check(t, "saveToken", err)
+		if ok {
+			t.Fatal("saveToken of a stored token: got true")
+		}
+		value, err := b.loadToken(ctx, "token")
+		check(t, "loadToken", err)
+		if want, _ := defaultOptions.encodeValue("first"); value != want {
+			t.Fatalf("loadToken: got %q, want %q", value, want)
+		}
+	})
+
+	t.Run("MissingToken", func(t *testing.T) {
+		b, _ := setup(t)
+		_, err := b.loadToken(ctx, "missing")
+		expectErr(t, "loadToken", err, ErrTokenNotFound)
+		ok, err := b.isTokenExist(ctx, "missing")
+		check(t, "isTokenExist", err)
+		if ok {
+			t.Fatal("isTokenExist of a missing token: got true")
+		}
+		check(t, "deleteToken", b.deleteToken(ctx, "missing"))
+		expectErr(t, "revokeToken", b.revokeToken(ctx, "missing"), ErrTokenNotFound)
+		_, err = b.loadUserToken(ctx, "user", "missing")
+		expectErr(t, "loadUserToken", err, ErrTokenNotFound)
+	})
+
+	t.Run("RevokeToken", func(t *testing.T) {
+		b, _ := setup(t)
+		_, err := b.saveToken(ctx, "token", "value", time.Hour)
+		check(t, "saveToken", err)
+		check(t, "revokeToken", b.revokeToken(ctx, "token"))
+		_, err = b.loadToken(ctx, "token")
+		expectErr(t, "loadToken", err, ErrTokenRevoked)
+	})
+
+	t.Run("RevokedUserTokenList", func(t *testing.T) {
+		b, _ := setup(t)
+		revoked, err := b.saveUserToken(ctx, "user", genToken, "value", time.Hour, nil)
+		check(t, "saveUserToken", err)
+		token, err := b.saveUserToken(ctx, "user", genToken, "value", time.Hour, nil)
+		check(t, "saveUserToken", err)
+		check(t, "revokeToken", b.revokeToken(ctx, revoked))
+		list, err := b.loadUserTokenList(ctx, "user")
+		check(t, "loadUserTokenList", err)
+		if len(list) != 1 || list[0].TokenString != token {
+			t.Fatalf("loadUserTokenList: got %d tokens, want the unrevoked one", len(list))
+		}
+	})
+
+	t.Run("RefreshRevokedUserToken", func(t *testing.T) {
+		b, clock := setup(t)
+		revoked, err := b.saveUserToken(ctx, "user", genToken, "value", time.Minute, nil)
+		check(t, "saveUserToken", err)
+		token, err := b.saveUserToken(ctx, "user", genToken, "value", time.Minute, nil)
+		check(t, "saveUserToken", err)
+		check(t, "revokeToken", b.revokeToken(ctx, revoked))
+		expectErr(t, "refreshUserToken of a revoked token", b.refreshUserToken(ctx, "user", revoked, time.Hour), ErrTokenRevoked)
+		check(t, "extendAllUserTokens", b.extendAllUserTokens(ctx, "user", time.Hour))
+
+		clock.advance(2 * time.Minute)
+		_, err = b.loadUserToken(ctx, "user", token)
+		check(t, "loadUserToken of an extended token", err)
+		_, err = b.loadUserToken(ctx, "user", revoked)
+		if err == nil {
+			t.Fatal("loadUserToken of a revoked token past its expiry: got no error")
+		}
+	})
+
+	t.Run("UserTokensWithScope", func(t *testing.T) {
+		b, _ := setup(t)
+		admin, err := b.saveUserToken(ctx, "user", genToken, "value", time.Hour, map[string]string{ScopeMetadataKey: "read admin"})
+		check(t, "saveUserToken", err)
+		_, err = b.saveUserToken(ctx, "user", genToken, "value", time.Hour, map[string]string{ScopeMetadataKey: "read"})
+		check(t, "saveUserToken", err)
+		_, err = b.deleteUserToken(ctx, "user", admin)
+		check(t, "deleteUserToken", err)
+		granted, err := b.saveUserToken(ctx, "user", genToken, "value", 2*time.Hour, map[string]string{ScopeMetadataKey: "admin"})
+		check(t, "saveUserToken", err)
+		list, err := b.loadUserTokensWithScope(ctx, "user", "admin")
+		check(t, "loadUserTokensWithScope", err)
+		if len(list) != 1 || list[0].TokenString != granted {
+			t.Fatalf("loadUserTokensWithScope: got %d tokens, want the undeleted admin one", len(list))
+		}
+		list, err = b.loadUserTokensWithScope(ctx, "user", "write")
+		check(t, "loadUserTokensWithScope", err)
+		if len(list) != 0 {
+			t.Fatalf("loadUserTokensWithScope: got %d tokens of an ungranted scope", len(list))
+		}
+	})
+
+	t.Run("UserToken", func(t *testing.T) {
+		b, _ := setup(t)
+		token, err := b.saveUserToken(ctx, "user", genToken, "value", time.Hour, map[string]string{"k": "v"})
+		check(t, "saveUserToken", err)
+		userToken, err := b.loadUserToken(ctx, "user", token)
+		check(t, "loadUserToken", err)
+		if want, _ := defaultOptions.encodeValue("value"); userToken.TokenData != want {
+			t.Fatalf("loadUserToken: got %q, want %q", userToken.TokenData, want)
+		}
+		if userToken.Metadata["k"] != "v" {
+			t.Fatalf("loadUserToken metadata: got %v", userToken.Metadata)
+		}
+		list, err := b.loadUserTokenList(ctx, "user")
+		check(t, "loadUserTokenList", err)
+		if len(list) != 1 || list[0].TokenString != token {
+			t.Fatalf("loadUserTokenList: got %d tokens", len(list))
+		}
+		_, err = b.loadUserToken(ctx, "other", token)
+		expectErr(t, "loadUserToken of another user", err, ErrTokenNotFound)
+
+		deleted, err := b.deleteUserToken(ctx, "user", token, "missing")
+		check(t, "deleteUserToken", err)
+		if deleted != 1 {
+			t.Fatalf("deleteUserToken: got %d deleted, want 1", deleted)
+		}
+		_, err = b.loadUserToken(ctx, "user", token)
+		expectErr(t, "loadUserToken", err, ErrTokenNotFound)
+		count, err := b.countUserTokens(ctx, "user")
+		check(t, "countUserTokens", err)
+		if count != 0 {
+			t.Fatalf("countUserTokens: got %d, want 0", count)
+		}
+	})
+
+	t.Run("InvalidExpiry", func(t *testing.T) {
+		b, _ := setup(t)
+		_, err := b.saveToken(ctx, "token", "value", -time.Second)
+		expectErr(t, "saveToken", err, ErrInvalidExpiry)
+		_, err = b.saveUserToken(ctx, "user", genToken, "value", 0, nil)
+		expectErr(t, "saveUserToken", err, ErrInvalidExpiry)
+		count, err := b.countUserTokens(ctx, "user")
+		check(t, "countUserTokens", err)
+		if count != 0 {
+			t.Fatalf("countUserTokens: got %d, want 0", count)
+		}
+	})
+
+	t.Run("UserTokenCollision", func(t *testing.T) {
+		b, _ := setup(t)
+		fixed := func() (string, error) {
+			return "fixed", nil
+		}
+		_, err := b.saveUserToken(ctx, "user", fixed, "value", time.Hour, nil)
+		check(t, "saveUserToken", err)
+		_, err = b.saveUserToken(ctx, "user", fixed, "value", time.Hour, nil)
+		expectErr(t, "saveUserToken of a colliding token", err, ErrTokenGenerationExhausted)
+	})
+
+	t.Run("UserTokenExpiry", func(t *testing.T) {
+		b, clock := setup(t)
+		token, err := b.saveUserToken(ctx, "user", genToken, "value", time.Minute, nil)
+		check(t, "saveUserToken", err)
+		clock.advance(time.Minute - time.Second)
+		_, err = b.loadUserToken(ctx, "user", token)
+		check(t, "loadUserToken before expiry", err)
+
+		clock.advance(2 * time.Second)
+		_, err = b.loadUserToken(ctx, "user", token)
+		expectErr(t, "loadUserToken after expiry", err, ErrTokenNotFound)
+		list, err := b.loadUserTokenList(ctx, "user")
+		check(t, "loadUserTokenList", err)
+		if len(list) != 0 {
+			t.Fatalf("loadUserTokenList after expiry: got %d tokens", len(list))
+		}
+		_, err = b.cleanupUserToken(ctx, "user")
+		check(t, "cleanupUserToken", err)
+		count, err := b.countUserTokens(ctx, "user")
+		check(t, "countUserTokens", err)
+		if count != 0 {
+			t.Fatalf("countUserTokens after expiry: got %d, want 0", count)
+		}
+	})
+
+	t.Run("CleanupOrphan", func(t *testing.T) {
+		b, _ := setup(t)
+		orphan, err := b.saveUserToken(ctx, "user", genToken, "value", time.Hour, nil)
+		check(t, "saveUserToken", err)
+		kept, err := b.saveUserToken(ctx, "user", genToken, "value", time.Hour, nil)
+		check(t, "saveUserToken", err)
+		check(t, "deleteToken", b.deleteToken(ctx, orphan))
+
+		_, err = b.cleanupUserToken(ctx, "user")
+		check(t, "cleanupUserToken", err)
+		list, err := b.loadUserTokenList(ctx, "user")
+		check(t, "loadUserTokenList", err)
+		if len(list) != 1 || list[0].TokenString != kept {
+			t.Fatalf("loadUserTokenList after cleanup: got %d tokens", len(list))
+		}
+		count, err := b.countUserTokens(ctx, "user")
+		check(t, "countUserTokens", err)
+		if count != 1 {
+			t.Fatalf("countUserTokens after cleanup: got %d, want 1", count)
+		}
+	})
+
+	t.Run("DeleteAllUserTokens", func(t *testing.T) {
+		b, _ := setup(t)
+		for _, userId := range []string{"a", "b"} {
+			_, err := b.saveUserToken(ctx, userId, genToken, "value", time.Hour, nil)
+			check(t, "saveUserToken", err)
+		}
+		check(t, "deleteAllUserTokens", b.deleteAllUserTokens(ctx, "a", "b"))
+		for _, userId := range []string{"a", "b"} {
+			count, err := b.countUserTokens(ctx, userId)
+			check(t, "countUserTokens", err)
+			if count != 0 {
+				t.Fatalf("countUserTokens of %s: got %d, want 0", userId, count)
+			}
+		}
+	})
+}
+
+func TestRedisBackendConformance(t *testing.T) {
+	RunBackendConformanceTests(t, func() Backend {
+		r, _ := newTestBackend(t)
+		return r
+	})
+}
+
+func TestMemoryBackendConformance(t *testing.T) {
+	RunBackendConformanceTests(t, NewMemoryBackend)
+}
@@ -1,6 +1,11 @@
 package tokenmanager
 
-import "errors"
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+)
 
 var (
 	ErrTokenNotFound = errors.New("ErrTokenNotFound")
@@ -9,4 +14,78 @@ var (
 var (
 	ErrInvalidTokenType = errors.New("Invalid token type")
 	ErrInvalidToken     = errors.New("Invalid token")
+	ErrTokenRevoked     = errors.New("Token revoked")
+	ErrNotSupported     = errors.New("Not supported")
+	ErrValueTooLarge    = errors.New("Token value too large")
+	ErrRateLimited      = errors.New("Token issuance rate limited")
+	ErrTokenUnconfirmed = errors.New("Token unconfirmed")
+	ErrInvalidExpiry    = errors.New("Token expiry must be positive")
+
+	ErrTokenGenerationExhausted = errors.New("Token generation exhausted")
+	ErrUnknownPayloadVersion    = errors.New("Unknown token payload version")
+	ErrOrphanedToken            = errors.New("Orphaned user token")
+	ErrTokenTaken               = errors.New("Token string taken by another user")
 )
+
+// BackendError wraps a failure reaching the token storage, e.g. redis being
+// unreachable, so callers can tell it apart from an invalid token with errors.As.
+type BackendError struct {
+	Err error
+}
+
+func (e *BackendError) Error() string {
+	return "token backend: " + e.Err.Error()
+}
+
+func (e *BackendError) Unwrap() error {
+	return e.Err
+}
+
+// PartialFailureError reports the users a multi-user operation failed for
+type PartialFailureError struct {
+	Errors map[string]error // userId -> cause
+}
+
+func (e *PartialFailureError) UserIDs() []string {
+	ids := make([]string, 0, len(e.Errors))
+	for id := range e.Errors {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func (e *PartialFailureError) Error() string {
+	return "failed for users: " + strings.Join(e.UserIDs(), ", ")
+}
+
+func (e *PartialFailureError) Unwrap() []error {
+	errs := make([]error, 0, len(e.Errors))
+	for _, id := range e.UserIDs() {
+		errs = append(errs, e.Errors[id])
+	}
+	return errs
+}
+
+// HTTPStatus maps an error of this package to a response status: 401 for tokens
+// that can't be used, 404 for missing ones, 413 for oversized values, 429 for rate
+// limited issuance and 500 for anything else.
+func HTTPStatus(err error) int {
+	switch {
+	case err == nil:
+		return http.StatusOK
+	case errors.Is(err, ErrInvalidToken), errors.Is(err, ErrTokenRevoked), errors.Is(err, ErrInvalidTokenType),
+		errors.Is(err, ErrTokenUnconfirmed):
+		return http.StatusUnauthorized
+	case errors.Is(err, ErrTokenNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrValueTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, ErrRateLimited):
+		return http.StatusTooManyRequests
+	case errors.Is(err, ErrTokenTaken):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
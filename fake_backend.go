@@ -0,0 +1,148 @@
+package tokenmanager
+
+import (
+	"context"
+	"time"
+)
+
+// FakeBackend is an in-memory backend whose operations can be made to fail, for
+// testing how callers handle storage errors. A hook returning a non-nil error fails
+// the operation with it before anything is stored; without hooks it behaves like
+// NewMemoryBackend. Set the hooks before the backend is in use.
+type FakeBackend struct {
+	*memoryBackend
+
+	OnSaveToken        func(ctx context.Context, token string, value interface{}, expire time.Duration) error
+	OnLoadToken        func(ctx context.Context, token string) error
+	OnDeleteToken      func(ctx context.Context, tokens ...string) error
+	OnRevokeToken      func(ctx context.Context, token string) error
+	OnSaveUserToken    func(ctx context.Context, userId string, value interface{}, expiresIn time.Duration) error
+	OnLoadUserToken    func(ctx context.Context, userId string, tokenString string) error
+	OnLoadUserTokens   func(ctx context.Context, userId string) error
+	OnDeleteUserToken  func(ctx context.Context, userId string, tokens ...string) error
+	OnRefreshUserToken func(ctx context.Context, userId string, tokenString string, expiresIn time.Duration) error
+}
+
+func NewFakeBackend() *FakeBackend {
+	return &FakeBackend{memoryBackend: newMemoryBackend()}
+}
+
+func (f *FakeBackend) saveToken(ctx context.Context, token string, value interface{}, expire time.Duration) (bool, error) {
+	if f.OnSaveToken != nil {
+		if err := f.OnSaveToken(ctx, token, value, expire); err != nil {
+			return false, err
+		}
+	}
+	return f.memoryBackend.saveToken(ctx, token, value, expire)
+}
+
+func (f *FakeBackend) loadToken(ctx context.Context, token string) (string, error) {
+	if f.OnLoadToken != nil {
+		if err := f.OnLoadToken(ctx, token); err != nil {
+			return "", err
+		}
+	}
+	return f.memoryBackend.loadToken(ctx, token)
+}
+
+func (f *FakeBackend) loadTokenWithTTL(ctx context.Context, token string) (string, time.Duration, error) {
+	if f.OnLoadToken != nil {
+		if err := f.OnLoadToken(ctx, token); err != nil {
+			return "", 0, err
+		}
+	}
+	return f.memoryBackend.loadTokenWithTTL(ctx, token)
+}
+
+func (f *FakeBackend) deleteToken(ctx context.Context, tokens ...string) error {
+	if f.OnDeleteToken != nil {
+		if err := f.OnDeleteToken(ctx, tokens...); err != nil {
+			return err
+		}
+	}
+	return f.memoryBackend.deleteToken(ctx, tokens...)
+}
+
+func (f *FakeBackend) revokeToken(ctx context.Context, token string) error {
+	if f.OnRevokeToken != nil {
+		if err := f.OnRevokeToken(ctx, token); err != nil {
+			return err
+		}
+	}
+	return f.memoryBackend.revokeToken(ctx, token)
+}
+
+func (f *FakeBackend) saveUserToken(ctx context.Context, userId string, genToken func() (string, error), value interface{}, expiresIn time.Duration, metadata map[string]string) (string, error) {
+	if f.OnSaveUserToken != nil {
+		if err := f.OnSaveUserToken(ctx, userId, value, expiresIn); err != nil {
+			return "", err
+		}
+	}
+	return f.memoryBackend.saveUserToken(ctx, userId, genToken, value, expiresIn, metadata)
+}
+
+func (f *FakeBackend) saveTokenPair(ctx context.Context, userId string, genAccess, genRefresh func() (string, error), accessValue, refreshValue interface{}, accessTTL, refreshTTL time.Duration, metadata map[string]string) (string, string, error) {
+	if f.OnSaveUserToken != nil {
+		if err := f.OnSaveUserToken(ctx, userId, accessValue, accessTTL); err != nil {
+			return "", "", err
+		}
+		if err := f.OnSaveUserToken(ctx, userId, refreshValue, refreshTTL); err != nil {
+			return "", "", err
+		}
+	}
+	return f.memoryBackend.saveTokenPair(ctx, userId, genAccess, genRefresh, accessValue, refreshValue, accessTTL, refreshTTL, metadata)
+}
+
+func (f *FakeBackend) loadUserToken(ctx context.Context, userId string, tokenString string) (*bUserTokenInfo, error) {
+	if f.OnLoadUserToken != nil {
+		if err := f.OnLoadUserToken(ctx, userId, tokenString); err != nil {
+			return nil, err
+		}
+	}
+	return f.memoryBackend.loadUserToken(ctx, userId, tokenString)
+}
+
+func (f *FakeBackend) loadUserTokenList(ctx context.Context, userId string) ([]*bUserTokenInfo, error) {
+	if f.OnLoadUserTokens != nil {
+		if err := f.OnLoadUserTokens(ctx, userId); err != nil {
+			return nil, err
+		}
+	}
+	return f.memoryBackend.loadUserTokenList(ctx, userId)
+}
+
+func (f *FakeBackend) loadUserTokensWithScope(ctx context.Context, userId string, scope string) ([]*bUserTokenInfo, error) {
+	if f.OnLoadUserTokens != nil {
+		if err := f.OnLoadUserTokens(ctx, userId); err != nil {
+			return nil, err
+		}
+	}
+	return f.memoryBackend.loadUserTokensWithScope(ctx, userId, scope)
+}
+
+func (f *FakeBackend) iterateUserTokens(ctx context.Context, userId string, fn func(*bUserTokenInfo) error) error {
+	if f.OnLoadUserTokens != nil {
+		if err := f.OnLoadUserTokens(ctx, userId); err != nil {
+			return err
+		}
+	}
+	return f.memoryBackend.iterateUserTokens(ctx, userId, fn)
+}
+
+func (f *FakeBackend) deleteUserToken(ctx context.Context, userId string, tokens ...string) (int64, error) {
+	if f.OnDeleteUserToken != nil {
+		if err := f.OnDeleteUserToken(ctx, userId, tokens...); err != nil {
+			return 0, err
+		}
+	}
+	return f.memoryBackend.deleteUserToken(ctx, userId, tokens...)
+}
+
+func (f *FakeBackend) refreshUserToken(ctx context.Context, userId string, tokenString string, expiresIn time.Duration) error {
+	if f.OnRefreshUserToken != nil {
+		if err := f.OnRefreshUserToken(ctx, userId, tokenString, expiresIn); err != nil {
+			return err
+		}
+	}
+	return f.memoryBackend.refreshUserToken(ctx, userId, tokenString, expiresIn)
+}
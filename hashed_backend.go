@@ -0,0 +1,690 @@
+package tokenmanager
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/redis/go-redis/v9"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// StorageLayout selects how the redis backends lay out the tokens of a user
+type StorageLayout int
+
+const (
+	// Separate stores every token under its own key, indexed by a user token sorted set
+	Separate StorageLayout = iota
+	// Hashed stores the tokens of a user as fields of a single hash, with a parallel
+	// sorted set for their expiry. Tokens are only reachable through their user.
+	Hashed
+)
+
+// hashedRedisBackend is the Hashed layout of a redis backend. Hash fields can't
+// expire on their own, so the expiry set is authoritative and cleanup drops the
+// fields of its expired members.
+type hashedRedisBackend struct {
+	r *redisBackend
+}
+
+func (h *hashedRedisBackend) bind(opts *options) {
+	h.r.bind(opts)
+}
+
+// userTokenKeys returns the value hash, expiry set and metadata hash of the user
+func (h *hashedRedisBackend) userTokenKeys(userId string) []string {
+	return []string{
+		h.r.getUserTokenKey(userId),
+		h.r.joinKey(h.r.opts.userTokenPrefix+"_EXPIRY", h.r.userSegment(userId)),
+		h.r.joinKey(h.r.opts.userTokenPrefix+"_META", h.r.userSegment(userId)),
+	}
+}
+
+func (h *hashedRedisBackend) saveToken(ctx context.Context, token string, value interface{}, expire time.Duration) (bool, error) {
+	return false, ErrNotSupported
+}
+
+func (h *hashedRedisBackend) loadToken(ctx context.Context, token string) (string, error) {
+	return "", ErrNotSupported
+}
+
+func (h *hashedRedisBackend) loadTokenWithTTL(ctx context.Context, token string) (string, time.Duration, error) {
+	return "", 0, ErrNotSupported
+}
+
+func (h *hashedRedisBackend) deleteToken(ctx context.Context, tokens ...string) error {
+	return ErrNotSupported
+}
+
+func (h *hashedRedisBackend) deleteTokenIfValue(ctx context.Context, token string, expected string) (bool, error) {
+	return false, ErrNotSupported
+}
+
+func (h *hashedRedisBackend) updateTokenValue(ctx context.Context, token string, value interface{}) error {
+	return ErrNotSupported
+}
+
+func (h *hashedRedisBackend) updateTokenValueIfActive(ctx context.Context, userId string, token string, value interface{}) error {
+	return ErrNotSupported
+}
+
+func (h *hashedRedisBackend) isTokenExist(ctx context.Context, token string) (bool, error) {
+	return false, ErrNotSupported
+}
+
+func (h *hashedRedisBackend) areTokensExist(ctx context.Context, tokens ...string) (map[string]bool, error) {
+	return nil, ErrNotSupported
+}
+
+func (h *hashedRedisBackend) revokeToken(ctx context.Context, token string) error {
+	return ErrNotSupported
+}
+
+func (h *hashedRedisBackend) softRevokeUserToken(ctx context.Context, userId string, token string, grace time.Duration) error {
+	return ErrNotSupported
+}
+
+func (h *hashedRedisBackend) userIdForToken(ctx context.Context, tokenString string) (string, error) {
+	return "", ErrNotSupported
+}
+
+func (h *hashedRedisBackend) cleanupUserToken(ctx context.Context, userId string) (int64, error) {
+	now := h.r.opts.now().Unix()
+	return hashedCleanupUserTokenScript.Run(ctx, h.r.client, h.userTokenKeys(userId), now).Int64()
+}
+
+// previewCleanupUserToken returns the expired members, which are all a cleanup removes
+func (h *hashedRedisBackend) previewCleanupUserToken(ctx context.Context, userId string) ([]string, error) {
+	now := h.r.opts.now().Unix()
+	return h.r.client.ZRangeByScore(ctx, h.userTokenKeys(userId)[1], &redis.ZRangeBy{
+		Min: "0",
+		Max: strconv.FormatInt(now, 10),
+	}).Result()
+}
+
+func (h *hashedRedisBackend) tryCleanupUserToken(ctx context.Context, userId string) {
+	_, err := h.cleanupUserToken(ctx, userId)
+	h.r.opts.warn(ctx, "cleanupUserToken", userId, err)
+}
+
+func (h *hashedRedisBackend) saveUserToken(ctx context.Context, userId string, genToken func() (string, error), value interface{}, expiresIn time.Duration, metadata map[string]string) (string, error) {
+	if err := checkExpiry(expiresIn); err != nil {
+		return "", err
+	}
+	if err := h.r.checkIssueRate(ctx, userId); err != nil {
+		return "", err
+	}
+	h.tryCleanupUserToken(ctx, userId)
+
+	v, err := h.r.opts.encodeValue(value)
+	if err != nil {
+		return "", err
+	}
+	meta := ""
+	if len(metadata) != 0 {
+		b, err := json.Marshal(metadata)
+		if err != nil {
+			return "", err
+		}
+		meta = string(b)
+	}
+
+	keys := h.userTokenKeys(userId)
+	return h.r.opts.generateToken(ctx, genToken, func(token string) (bool, error) {
+		expire := h.r.opts.now().Add(expiresIn).UTC()
+		return hashedSaveUserTokenScript.Run(ctx, h.r.client, keys, token, v, expireScore(expire), meta, h.r.opts.maxUserTokens).Bool()
+	})
+}
+
+// saveTokenPair saves the tokens unlinked, the layout has no token revocation to cascade
+func (h *hashedRedisBackend) saveTokenPair(ctx context.Context, userId string, genAccess, genRefresh func() (string, error), accessValue, refreshValue interface{}, accessTTL, refreshTTL time.Duration, metadata map[string]string) (string, string, error) {
+	access, err := h.saveUserToken(ctx, userId, genAccess, accessValue, accessTTL, metadata)
+	if err != nil {
+		return "", "", err
+	}
+	refresh, err := h.saveUserToken(ctx, userId, genRefresh, refreshValue, refreshTTL, metadata)
+	if err != nil {
+		_, delErr := h.deleteUserToken(ctx, userId, access)
+		h.r.opts.warn(ctx, "deleteUserToken", userId, delErr)
+		return "", "", err
+	}
+	return access, refresh, nil
+}
+
+func (h *hashedRedisBackend) saveUnconfirmedUserToken(ctx context.Context, userId string, genToken func() (string, error), value interface{}, expiresIn time.Duration) (string, error) {
+	return "", ErrNotSupported
+}
+
+func (h *hashedRedisBackend) confirmUserToken(ctx context.Context, userId string, tokenString string) error {
+	return ErrNotSupported
+}
+
+func (h *hashedRedisBackend) getOrCreateUserToken(ctx context.Context, userId string, genToken func() (string, error), value interface{}, expiresIn time.Duration) (string, bool, error) {
+	if err := checkExpiry(expiresIn); err != nil {
+		return "", false, err
+	}
+	key := h.userTokenKeys(userId)[1]
+	return h.r.getOrCreate(ctx, userId, func() (string, error) {
+		h.tryCleanupUserToken(ctx, userId)
+		tokens, err := h.r.client.ZRange(ctx, key, -1, -1).Result()
+		if err != nil || len(tokens) == 0 {
+			return "", err
+		}
+		return tokens[0], nil
+	}, func() (string, error) {
+		return h.saveUserToken(ctx, userId, genToken, value, expiresIn, nil)
+	})
+}
+
+// saveUserTokenWithId reports false when the token is already stored. Its hash
+// field and expiry member are written together, so there's nothing to repair.
+func (h *hashedRedisBackend) saveUserTokenWithId(ctx context.Context, userId string, token string, value interface{}, expiresIn time.Duration) (bool, error) {
+	if err := checkExpiry(expiresIn); err != nil {
+		return false, err
+	}
+	if err := h.r.checkIssueRate(ctx, userId); err != nil {
+		return false, err
+	}
+	h.tryCleanupUserToken(ctx, userId)
+
+	v, err := h.r.opts.encodeValue(value)
+	if err != nil {
+		return false, err
+	}
+	expire := h.r.opts.now().Add(expiresIn).UTC()
+	return hashedSaveUserTokenScript.Run(ctx, h.r.client, h.userTokenKeys(userId), token, v, expireScore(expire), "", h.r.opts.maxUserTokens).Bool()
+}
+
+func (h *hashedRedisBackend) saveUserTokens(ctx context.Context, userId string, entries []TokenEntry) error {
+	now := h.r.opts.now()
+	keys := h.userTokenKeys(userId)
+
+	args := make([][]interface{}, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.ExpiresAt.After(now) {
+			continue
+		}
+		v, err := h.r.opts.encodeValue(entry.Value)
+		if err != nil {
+			return err
+		}
+		meta := ""
+		if len(entry.Metadata) != 0 {
+			b, err := json.Marshal(entry.Metadata)
+			if err != nil {
+				return err
+			}
+			meta = string(b)
+		}
+		args = append(args, []interface{}{entry.Token, v, expireScore(entry.ExpiresAt), meta, h.r.opts.maxUserTokens})
+	}
+	if len(args) == 0 {
+		return nil
+	}
+
+	_, err := h.r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, a := range args {
+			hashedSaveUserTokenScript.Eval(ctx, pipe, keys, a...)
+		}
+		return nil
+	})
+	return err
+}
+
+func (h *hashedRedisBackend) saveUserTokenPipe(ctx context.Context, pipe redis.Pipeliner, userId string, genToken func() (string, error), value interface{}, expiresIn time.Duration) (string, func() error, error) {
+	if err := checkExpiry(expiresIn); err != nil {
+		return "", nil, err
+	}
+	v, err := h.r.opts.encodeValue(value)
+	if err != nil {
+		return "", nil, err
+	}
+	token, err := genToken()
+	if err != nil {
+		return "", nil, err
+	}
+
+	expire := h.r.opts.now().Add(expiresIn).UTC()
+	cmd := hashedSaveUserTokenScript.Eval(ctx, pipe, h.userTokenKeys(userId), token, v, expireScore(expire), "", h.r.opts.maxUserTokens)
+	return token, func() error {
+		ok, err := cmd.Bool()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return ErrTokenGenerationExhausted
+		}
+		return nil
+	}, nil
+}
+
+func (h *hashedRedisBackend) loadUserToken(ctx context.Context, userId string, tokenString string) (*bUserTokenInfo, error) {
+	if h.r.opts.cleanupOnLoad() {
+		h.tryCleanupUserToken(ctx, userId)
+	}
+	score, err := h.r.client.ZScore(ctx, h.userTokenKeys(userId)[1], tokenString).Result()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return nil, ErrTokenNotFound
+		}
+		return nil, err
+	}
+	if int64(score) <= h.r.opts.now().Unix() {
+		return nil, ErrTokenNotFound
+	}
+
+	list, err := h.loadUserTokenMembers(ctx, userId, []redis.Z{{Member: tokenString, Score: score}})
+	if err != nil {
+		return nil, err
+	}
+	if len(list) == 0 {
+		return nil, ErrTokenNotFound
+	}
+	if d := h.r.opts.slidingExpiration; d > 0 {
+		err = h.refreshUserToken(ctx, userId, tokenString, d)
+		if err != nil {
+			return nil, err
+		}
+		list[0].ExpiresAt = time.Unix(expireScore(h.r.opts.now().Add(d)), 0).UTC()
+	}
+	return list[0], nil
+}
+
+// loadUserTokensWithScope filters the user token list, the hashed layout keeping
+// no scope index
+func (h *hashedRedisBackend) loadUserTokensWithScope(ctx context.Context, userId string, scope string) ([]*bUserTokenInfo, error) {
+	list, err := h.loadUserTokenList(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+	return withScope(list, scope), nil
+}
+
+func (h *hashedRedisBackend) loadUserTokenList(ctx context.Context, userId string) ([]*bUserTokenInfo, error) {
+	h.tryCleanupUserToken(ctx, userId)
+
+	members, err := h.r.client.ZRangeArgsWithScores(ctx, h.r.opts.zRangeArgs(h.userTokenKeys(userId)[1], 0, 0)).Result()
+	if err != nil {
+		return nil, err
+	}
+	return h.loadUserTokenMembers(ctx, userId, members)
+}
+
+func (h *hashedRedisBackend) loadUserTokenListPaged(ctx context.Context, userId string, offset, limit int64) ([]*bUserTokenInfo, int64, error) {
+	h.tryCleanupUserToken(ctx, userId)
+	key := h.userTokenKeys(userId)[1]
+	if limit == 0 {
+		// ZRANGE without LIMIT would return everything
+		total, err := h.r.client.ZCard(ctx, key).Result()
+		return make([]*bUserTokenInfo, 0), total, err
+	}
+
+	var members *redis.ZSliceCmd
+	var total *redis.IntCmd
+	_, err := h.r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		members = pipe.ZRangeArgsWithScores(ctx, h.r.opts.zRangeArgs(key, offset, limit))
+		total = pipe.ZCard(ctx, key)
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	userTokenList, err := h.loadUserTokenMembers(ctx, userId, members.Val())
+	if err != nil {
+		return nil, 0, err
+	}
+	return userTokenList, total.Val(), nil
+}
+
+// loadUserTokenMembers reads the hash fields of expiry set members, skipping
+// members without a value.
+func (h *hashedRedisBackend) loadUserTokenMembers(ctx context.Context, userId string, members []redis.Z) ([]*bUserTokenInfo, error) {
+	if len(members) == 0 {
+		return make([]*bUserTokenInfo, 0), nil
+	}
+	keys := h.userTokenKeys(userId)
+
+	fields := make([]string, len(members))
+	for i, member := range members {
+		fields[i] = member.Member.(string)
+	}
+	var values, metas *redis.SliceCmd
+	_, err := h.r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		values = pipe.HMGet(ctx, keys[0], fields...)
+		metas = pipe.HMGet(ctx, keys[2], fields...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	now := h.r.opts.now().Unix()
+	userTokenList := make([]*bUserTokenInfo, 0, len(members))
+	for i, member := range members {
+		data, ok := values.Val()[i].(string)
+		if !ok && h.r.opts.strictConsistency && int64(member.Score) > now {
+			return nil, orphanedToken(fields[i])
+		}
+		if !ok {
+			continue
+		}
+		userToken := &bUserTokenInfo{
+			TokenString: fields[i],
+			Fingerprint: Fingerprint(fields[i]),
+			TokenData:   data,
+			ExpiresAt:   time.Unix(int64(member.Score), 0).UTC(),
+			opts:        h.r.opts,
+		}
+		if meta, ok := metas.Val()[i].(string); ok {
+			err = json.Unmarshal([]byte(meta), &userToken.Metadata)
+			if err != nil {
+				return nil, err
+			}
+		}
+		userTokenList = append(userTokenList, userToken)
+	}
+	return userTokenList, nil
+}
+
+func (h *hashedRedisBackend) iterateUserTokens(ctx context.Context, userId string, fn func(*bUserTokenInfo) error) error {
+	h.tryCleanupUserToken(ctx, userId)
+	key := h.userTokenKeys(userId)[1]
+
+	var cursor uint64
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		page, next, err := h.r.client.ZScan(ctx, key, cursor, "", h.r.opts.scanCount).Result()
+		if err != nil {
+			return err
+		}
+
+		members := make([]redis.Z, 0, len(page)/2)
+		for i := 0; i+1 < len(page); i += 2 {
+			score, err := strconv.ParseFloat(page[i+1], 64)
+			if err != nil {
+				return err
+			}
+			members = append(members, redis.Z{Member: page[i], Score: score})
+		}
+		userTokenList, err := h.loadUserTokenMembers(ctx, userId, members)
+		if err != nil {
+			return err
+		}
+		for _, userToken := range userTokenList {
+			err = fn(userToken)
+			if err != nil {
+				return err
+			}
+		}
+
+		cursor = next
+		if cursor == 0 {
+			return nil
+		}
+	}
+}
+
+func (h *hashedRedisBackend) deleteUserToken(ctx context.Context, userId string, tokens ...string) (int64, error) {
+	if len(tokens) == 0 {
+		return 0, nil
+	}
+	keys := h.userTokenKeys(userId)
+
+	members := make([]*redis.IntCmd, len(tokens))
+	values := make([]*redis.IntCmd, len(tokens))
+	_, err := h.r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, token := range tokens {
+			values[i] = pipe.HDel(ctx, keys[0], token)
+			members[i] = pipe.ZRem(ctx, keys[1], token)
+		}
+		pipe.HDel(ctx, keys[2], tokens...)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return countDeleted(members, values), nil
+}
+
+// tryDeleteUserToken is deleteUserToken for best effort removals, logging its failure
+func (h *hashedRedisBackend) tryDeleteUserToken(ctx context.Context, userId string, tokens ...string) {
+	_, err := h.deleteUserToken(ctx, userId, tokens...)
+	h.r.opts.warn(ctx, "deleteUserToken", userId, err)
+}
+
+func (h *hashedRedisBackend) deleteUserTokenPipe(ctx context.Context, pipe redis.Pipeliner, userId string, tokens ...string) func() error {
+	if len(tokens) == 0 {
+		return func() error { return nil }
+	}
+	keys := h.userTokenKeys(userId)
+	members := make([]interface{}, len(tokens))
+	for i, token := range tokens {
+		members[i] = token
+	}
+
+	cmds := []redis.Cmder{
+		pipe.HDel(ctx, keys[0], tokens...),
+		pipe.ZRem(ctx, keys[1], members...),
+		pipe.HDel(ctx, keys[2], tokens...),
+	}
+	return func() error {
+		for _, cmd := range cmds {
+			if err := cmd.Err(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func (h *hashedRedisBackend) deleteAllUserTokens(ctx context.Context, userIds ...string) error {
+	failed := make(map[string]error)
+
+	cmds := make([]*redis.IntCmd, len(userIds))
+	_, _ = h.r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, userId := range userIds {
+			cmds[i] = pipe.Del(ctx, h.userTokenKeys(userId)...)
+		}
+		return nil
+	})
+	for i, cmd := range cmds {
+		if err := cmd.Err(); err != nil {
+			failed[userIds[i]] = err
+		}
+	}
+
+	if len(failed) != 0 {
+		return &PartialFailureError{Errors: failed}
+	}
+	return nil
+}
+
+func (h *hashedRedisBackend) moveUserTokens(ctx context.Context, fromUserId string, toUserId string) error {
+	if fromUserId == toUserId {
+		return nil
+	}
+	if h.r.cluster || h.r.opts.keyTagging {
+		// the script needs the keys of both users in one slot
+		return ErrNotSupported
+	}
+	keys := append(h.userTokenKeys(fromUserId), h.userTokenKeys(toUserId)...)
+	return hashedMoveUserTokensScript.Run(ctx, h.r.client, keys).Err()
+}
+
+func (h *hashedRedisBackend) deleteUserTokensExcept(ctx context.Context, userId string, keepToken string) error {
+	key := h.userTokenKeys(userId)[1]
+
+	var score *redis.FloatCmd
+	var members *redis.StringSliceCmd
+	_, err := h.r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		score = pipe.ZScore(ctx, key, keepToken)
+		members = pipe.ZRange(ctx, key, 0, -1)
+		return nil
+	})
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return err
+	}
+	if errors.Is(score.Err(), redis.Nil) {
+		return ErrTokenNotFound
+	}
+
+	tokens := slices.DeleteFunc(members.Val(), func(token string) bool { return token == keepToken })
+	_, err = h.deleteUserToken(ctx, userId, tokens...)
+	return err
+}
+
+func (h *hashedRedisBackend) countUserTokens(ctx context.Context, userId string) (int64, error) {
+	_, err := h.cleanupUserToken(ctx, userId)
+	if err != nil {
+		return 0, err
+	}
+	return h.r.client.ZCard(ctx, h.userTokenKeys(userId)[1]).Result()
+}
+
+func (h *hashedRedisBackend) userTokenExists(ctx context.Context, userId string, tokenString string) (bool, error) {
+	_, err := h.cleanupUserToken(ctx, userId)
+	if err != nil {
+		return false, err
+	}
+	keys := h.userTokenKeys(userId)
+
+	var score *redis.FloatCmd
+	var exists *redis.BoolCmd
+	_, err = h.r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		score = pipe.ZScore(ctx, keys[1], tokenString)
+		exists = pipe.HExists(ctx, keys[0], tokenString)
+		return nil
+	})
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return false, err
+	}
+	return score.Err() == nil && exists.Val(), nil
+}
+
+func (h *hashedRedisBackend) refreshUserToken(ctx context.Context, userId string, tokenString string, expiresIn time.Duration) error {
+	if err := checkExpiry(expiresIn); err != nil {
+		return err
+	}
+	expire := h.r.opts.now().Add(expiresIn).UTC()
+	ok, err := hashedRefreshUserTokenScript.Run(ctx, h.r.client, h.userTokenKeys(userId), expireScore(expire), tokenString).Bool()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrTokenNotFound
+	}
+	return nil
+}
+
+func (h *hashedRedisBackend) extendAllUserTokens(ctx context.Context, userId string, expiresIn time.Duration) error {
+	if err := checkExpiry(expiresIn); err != nil {
+		return err
+	}
+	if _, err := h.cleanupUserToken(ctx, userId); err != nil {
+		return err
+	}
+	expire := h.r.opts.now().Add(expiresIn).UTC()
+	return hashedExtendUserTokensScript.Run(ctx, h.r.client, h.userTokenKeys(userId), expireScore(expire)).Err()
+}
+
+// reconcileUserToken drops the token when only its value or only its expiry member
+// is left. The expiry set is the only expiry of the layout, so scores are left alone.
+func (h *hashedRedisBackend) reconcileUserToken(ctx context.Context, userId string, tokenString string) error {
+	keys := h.userTokenKeys(userId)
+
+	var score *redis.FloatCmd
+	var exists *redis.BoolCmd
+	_, err := h.r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		score = pipe.ZScore(ctx, keys[1], tokenString)
+		exists = pipe.HExists(ctx, keys[0], tokenString)
+		return nil
+	})
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return err
+	}
+	if score.Err() != nil || !exists.Val() {
+		h.tryDeleteUserToken(ctx, userId, tokenString)
+		return ErrTokenNotFound
+	}
+	return nil
+}
+
+// dumpUserTokens reports no TTL, hash fields have none of their own
+func (h *hashedRedisBackend) dumpUserTokens(ctx context.Context, userId string) ([]UserTokenDebug, error) {
+	keys := h.userTokenKeys(userId)
+
+	var members *redis.ZSliceCmd
+	var fields *redis.StringSliceCmd
+	_, err := h.r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		members = pipe.ZRangeWithScores(ctx, keys[1], 0, -1)
+		fields = pipe.HKeys(ctx, keys[0])
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	exists := make(map[string]bool, len(fields.Val()))
+	for _, field := range fields.Val() {
+		exists[field] = true
+	}
+	dump := make([]UserTokenDebug, len(members.Val()))
+	for i, member := range members.Val() {
+		token := member.Member.(string)
+		dump[i] = UserTokenDebug{
+			TokenString: token,
+			Score:       int64(member.Score),
+			TTL:         -1,
+			Exists:      exists[token],
+		}
+		if !exists[token] {
+			dump[i].TTL = -2
+		}
+	}
+	return dump, nil
+}
+
+func (h *hashedRedisBackend) rotateUserToken(ctx context.Context, userId string, oldToken string, genToken func() (string, error), value interface{}, expiresIn time.Duration) (string, error) {
+	if err := checkExpiry(expiresIn); err != nil {
+		return "", err
+	}
+	v, err := h.r.opts.encodeValue(value)
+	if err != nil {
+		return "", err
+	}
+
+	keys := h.userTokenKeys(userId)
+	return h.r.opts.generateToken(ctx, genToken, func(token string) (bool, error) {
+		now := h.r.opts.now()
+		expire := now.Add(expiresIn).UTC()
+
+		result, err := hashedRotateUserTokenScript.Run(ctx, h.r.client, keys, oldToken, token, v, expireScore(expire), now.Unix()).Int()
+		switch {
+		case err != nil:
+			return false, err
+		case result == -1:
+			return false, ErrTokenNotFound
+		}
+		return result == 1, nil
+	})
+}
+
+// scanUserIds matches the value hashes, which take the user token key
+func (h *hashedRedisBackend) scanUserIds(ctx context.Context, fn func(userId string) error) error {
+	return h.r.scanUserIds(ctx, fn)
+}
+
+func (h *hashedRedisBackend) watchRevocations(ctx context.Context, fn func(token string)) error {
+	return ErrNotSupported
+}
+
+func (h *hashedRedisBackend) ping(ctx context.Context) error {
+	return h.r.ping(ctx)
+}
+
+func (h *hashedRedisBackend) close() error {
+	return h.r.close()
+}
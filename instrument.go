@@ -0,0 +1,331 @@
+package tokenmanager
+
+import (
+	"context"
+	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"time"
+)
+
+// Observer is notified after every backend operation, e.g. to feed metrics.
+// err is ErrTokenNotFound for cache misses.
+type Observer interface {
+	ObserveOp(name string, d time.Duration, err error)
+}
+
+type nopObserver struct{}
+
+func (nopObserver) ObserveOp(string, time.Duration, error) {}
+
+// instrumentedBackend wraps the configured backend, counting its operations for
+// Stats and tracing, observing and bounding them when enabled
+type instrumentedBackend struct {
+	next backend
+	opts *options
+}
+
+// start is trace bounding ctx by the WithDefaultTimeout when it has no deadline
+func (b *instrumentedBackend) start(ctx context.Context, op string, userId ...string) (context.Context, func(error)) {
+	ctx, cancel := b.opts.withDefaultTimeout(ctx)
+	ctx, end := b.trace(ctx, op, userId...)
+	return ctx, func(err error) {
+		end(err)
+		cancel()
+	}
+}
+
+func (b *instrumentedBackend) trace(ctx context.Context, op string, userId ...string) (context.Context, func(error)) {
+	begin := time.Now()
+
+	var span trace.Span
+	if b.opts.tracer != nil {
+		ctx, span = b.opts.tracer.Start(ctx, "tokenmanager."+op)
+		span.SetAttributes(attribute.String("tokenmanager.operation", op))
+		for _, id := range userId {
+			if b.opts.traceUserIDHash {
+				id = sha256Hex(id)
+			}
+			span.SetAttributes(attribute.String("tokenmanager.user_id", id))
+		}
+	}
+
+	return ctx, func(err error) {
+		b.opts.stats.record(op, err)
+		b.opts.observer.ObserveOp(op, time.Since(begin), err)
+		if span != nil {
+			if err != nil {
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+			}
+			span.End()
+		}
+	}
+}
+
+func (b *instrumentedBackend) bind(opts *options) {
+	b.opts = opts
+	b.next.bind(opts)
+}
+
+func (b *instrumentedBackend) saveToken(ctx context.Context, token string, value interface{}, expire time.Duration) (ok bool, err error) {
+	ctx, end := b.start(ctx, "saveToken")
+	defer func() { end(err) }()
+	return b.next.saveToken(ctx, token, value, expire)
+}
+
+func (b *instrumentedBackend) loadToken(ctx context.Context, token string) (value string, err error) {
+	ctx, end := b.start(ctx, "loadToken")
+	defer func() { end(err) }()
+	return b.next.loadToken(ctx, token)
+}
+
+func (b *instrumentedBackend) loadTokenWithTTL(ctx context.Context, token string) (value string, ttl time.Duration, err error) {
+	ctx, end := b.start(ctx, "loadTokenWithTTL")
+	defer func() { end(err) }()
+	return b.next.loadTokenWithTTL(ctx, token)
+}
+
+func (b *instrumentedBackend) deleteToken(ctx context.Context, tokens ...string) (err error) {
+	ctx, end := b.start(ctx, "deleteToken")
+	defer func() { end(err) }()
+	return b.next.deleteToken(ctx, tokens...)
+}
+
+func (b *instrumentedBackend) deleteTokenIfValue(ctx context.Context, token string, expected string) (deleted bool, err error) {
+	ctx, end := b.start(ctx, "deleteTokenIfValue")
+	defer func() { end(err) }()
+	return b.next.deleteTokenIfValue(ctx, token, expected)
+}
+
+func (b *instrumentedBackend) updateTokenValue(ctx context.Context, token string, value interface{}) (err error) {
+	ctx, end := b.start(ctx, "updateTokenValue")
+	defer func() { end(err) }()
+	return b.next.updateTokenValue(ctx, token, value)
+}
+
+func (b *instrumentedBackend) updateTokenValueIfActive(ctx context.Context, userId string, token string, value interface{}) (err error) {
+	ctx, end := b.start(ctx, "updateTokenValueIfActive", userId)
+	defer func() { end(err) }()
+	return b.next.updateTokenValueIfActive(ctx, userId, token, value)
+}
+
+func (b *instrumentedBackend) isTokenExist(ctx context.Context, token string) (ok bool, err error) {
+	ctx, end := b.start(ctx, "isTokenExist")
+	defer func() { end(err) }()
+	return b.next.isTokenExist(ctx, token)
+}
+
+func (b *instrumentedBackend) areTokensExist(ctx context.Context, tokens ...string) (exists map[string]bool, err error) {
+	ctx, end := b.start(ctx, "areTokensExist")
+	defer func() { end(err) }()
+	return b.next.areTokensExist(ctx, tokens...)
+}
+
+func (b *instrumentedBackend) revokeToken(ctx context.Context, token string) (err error) {
+	ctx, end := b.start(ctx, "revokeToken")
+	defer func() { end(err) }()
+	return b.next.revokeToken(ctx, token)
+}
+
+func (b *instrumentedBackend) softRevokeUserToken(ctx context.Context, userId string, token string, grace time.Duration) (err error) {
+	ctx, end := b.start(ctx, "softRevokeUserToken", userId)
+	defer func() { end(err) }()
+	return b.next.softRevokeUserToken(ctx, userId, token, grace)
+}
+
+func (b *instrumentedBackend) cleanupUserToken(ctx context.Context, userId string) (removed int64, err error) {
+	ctx, end := b.start(ctx, "cleanupUserToken", userId)
+	defer func() { end(err) }()
+	return b.next.cleanupUserToken(ctx, userId)
+}
+
+func (b *instrumentedBackend) previewCleanupUserToken(ctx context.Context, userId string) (preview []string, err error) {
+	ctx, end := b.start(ctx, "previewCleanupUserToken", userId)
+	defer func() { end(err) }()
+	return b.next.previewCleanupUserToken(ctx, userId)
+}
+
+func (b *instrumentedBackend) saveUserToken(ctx context.Context, userId string, genToken func() (string, error), value interface{}, expiresIn time.Duration, metadata map[string]string) (token string, err error) {
+	ctx, end := b.start(ctx, "saveUserToken", userId)
+	defer func() { end(err) }()
+	return b.next.saveUserToken(ctx, userId, genToken, value, expiresIn, metadata)
+}
+
+func (b *instrumentedBackend) saveTokenPair(ctx context.Context, userId string, genAccess, genRefresh func() (string, error), accessValue, refreshValue interface{}, accessTTL, refreshTTL time.Duration, metadata map[string]string) (access string, refresh string, err error) {
+	ctx, end := b.start(ctx, "saveTokenPair", userId)
+	defer func() { end(err) }()
+	return b.next.saveTokenPair(ctx, userId, genAccess, genRefresh, accessValue, refreshValue, accessTTL, refreshTTL, metadata)
+}
+
+func (b *instrumentedBackend) saveUnconfirmedUserToken(ctx context.Context, userId string, genToken func() (string, error), value interface{}, expiresIn time.Duration) (token string, err error) {
+	ctx, end := b.start(ctx, "saveUnconfirmedUserToken", userId)
+	defer func() { end(err) }()
+	return b.next.saveUnconfirmedUserToken(ctx, userId, genToken, value, expiresIn)
+}
+
+func (b *instrumentedBackend) confirmUserToken(ctx context.Context, userId string, tokenString string) (err error) {
+	ctx, end := b.start(ctx, "confirmUserToken", userId)
+	defer func() { end(err) }()
+	return b.next.confirmUserToken(ctx, userId, tokenString)
+}
+
+func (b *instrumentedBackend) getOrCreateUserToken(ctx context.Context, userId string, genToken func() (string, error), value interface{}, expiresIn time.Duration) (token string, created bool, err error) {
+	ctx, end := b.start(ctx, "getOrCreateUserToken", userId)
+	defer func() { end(err) }()
+	return b.next.getOrCreateUserToken(ctx, userId, genToken, value, expiresIn)
+}
+
+func (b *instrumentedBackend) saveUserTokenWithId(ctx context.Context, userId string, token string, value interface{}, expiresIn time.Duration) (created bool, err error) {
+	ctx, end := b.start(ctx, "saveUserTokenWithId", userId)
+	defer func() { end(err) }()
+	return b.next.saveUserTokenWithId(ctx, userId, token, value, expiresIn)
+}
+
+func (b *instrumentedBackend) saveUserTokens(ctx context.Context, userId string, entries []TokenEntry) (err error) {
+	ctx, end := b.start(ctx, "saveUserTokens", userId)
+	defer func() { end(err) }()
+	return b.next.saveUserTokens(ctx, userId, entries)
+}
+
+func (b *instrumentedBackend) saveUserTokenPipe(ctx context.Context, pipe redis.Pipeliner, userId string, genToken func() (string, error), value interface{}, expiresIn time.Duration) (token string, result func() error, err error) {
+	// the result func runs on ctx after we return, it can't be cancelled yet
+	ctx, end := b.trace(ctx, "saveUserTokenPipe", userId)
+	defer func() { end(err) }()
+	return b.next.saveUserTokenPipe(ctx, pipe, userId, genToken, value, expiresIn)
+}
+
+func (b *instrumentedBackend) deleteUserTokenPipe(ctx context.Context, pipe redis.Pipeliner, userId string, tokens ...string) func() error {
+	ctx, end := b.trace(ctx, "deleteUserTokenPipe", userId)
+	defer end(nil)
+	return b.next.deleteUserTokenPipe(ctx, pipe, userId, tokens...)
+}
+
+func (b *instrumentedBackend) loadUserToken(ctx context.Context, userId string, tokenString string) (info *bUserTokenInfo, err error) {
+	ctx, end := b.start(ctx, "loadUserToken", userId)
+	defer func() { end(err) }()
+	return b.next.loadUserToken(ctx, userId, tokenString)
+}
+
+func (b *instrumentedBackend) loadUserTokenList(ctx context.Context, userId string) (list []*bUserTokenInfo, err error) {
+	ctx, end := b.start(ctx, "loadUserTokenList", userId)
+	defer func() { end(err) }()
+	return b.next.loadUserTokenList(ctx, userId)
+}
+
+func (b *instrumentedBackend) loadUserTokensWithScope(ctx context.Context, userId string, scope string) (list []*bUserTokenInfo, err error) {
+	ctx, end := b.start(ctx, "loadUserTokensWithScope", userId)
+	defer func() { end(err) }()
+	return b.next.loadUserTokensWithScope(ctx, userId, scope)
+}
+
+func (b *instrumentedBackend) loadUserTokenListPaged(ctx context.Context, userId string, offset, limit int64) (list []*bUserTokenInfo, total int64, err error) {
+	ctx, end := b.start(ctx, "loadUserTokenListPaged", userId)
+	defer func() { end(err) }()
+	return b.next.loadUserTokenListPaged(ctx, userId, offset, limit)
+}
+
+func (b *instrumentedBackend) deleteUserToken(ctx context.Context, userId string, tokens ...string) (deleted int64, err error) {
+	ctx, end := b.start(ctx, "deleteUserToken", userId)
+	defer func() { end(err) }()
+	return b.next.deleteUserToken(ctx, userId, tokens...)
+}
+
+func (b *instrumentedBackend) moveUserTokens(ctx context.Context, fromUserId string, toUserId string) (err error) {
+	ctx, end := b.start(ctx, "moveUserTokens", fromUserId)
+	defer func() { end(err) }()
+	return b.next.moveUserTokens(ctx, fromUserId, toUserId)
+}
+
+func (b *instrumentedBackend) deleteAllUserTokens(ctx context.Context, userIds ...string) (err error) {
+	ctx, end := b.start(ctx, "deleteAllUserTokens")
+	defer func() { end(err) }()
+	return b.next.deleteAllUserTokens(ctx, userIds...)
+}
+
+func (b *instrumentedBackend) deleteUserTokensExcept(ctx context.Context, userId string, keepToken string) (err error) {
+	ctx, end := b.start(ctx, "deleteUserTokensExcept", userId)
+	defer func() { end(err) }()
+	return b.next.deleteUserTokensExcept(ctx, userId, keepToken)
+}
+
+func (b *instrumentedBackend) countUserTokens(ctx context.Context, userId string) (count int64, err error) {
+	ctx, end := b.start(ctx, "countUserTokens", userId)
+	defer func() { end(err) }()
+	return b.next.countUserTokens(ctx, userId)
+}
+
+func (b *instrumentedBackend) userTokenExists(ctx context.Context, userId string, tokenString string) (ok bool, err error) {
+	ctx, end := b.start(ctx, "userTokenExists", userId)
+	defer func() { end(err) }()
+	return b.next.userTokenExists(ctx, userId, tokenString)
+}
+
+func (b *instrumentedBackend) refreshUserToken(ctx context.Context, userId string, tokenString string, expiresIn time.Duration) (err error) {
+	ctx, end := b.start(ctx, "refreshUserToken", userId)
+	defer func() { end(err) }()
+	return b.next.refreshUserToken(ctx, userId, tokenString, expiresIn)
+}
+
+func (b *instrumentedBackend) rotateUserToken(ctx context.Context, userId string, oldToken string, genToken func() (string, error), value interface{}, expiresIn time.Duration) (token string, err error) {
+	ctx, end := b.start(ctx, "rotateUserToken", userId)
+	defer func() { end(err) }()
+	return b.next.rotateUserToken(ctx, userId, oldToken, genToken, value, expiresIn)
+}
+
+// scanUserIds walks the whole keyspace calling fn, which the WithDefaultTimeout
+// would cut short; the backend bounds each page instead, and the operations fn
+// runs are bounded on their own
+func (b *instrumentedBackend) scanUserIds(ctx context.Context, fn func(userId string) error) (err error) {
+	ctx, end := b.trace(ctx, "scanUserIds")
+	defer func() { end(err) }()
+	return b.next.scanUserIds(ctx, fn)
+}
+
+// iterateUserTokens isn't bounded by the WithDefaultTimeout either, it lasts as
+// long as fn takes over every token of the user
+func (b *instrumentedBackend) iterateUserTokens(ctx context.Context, userId string, fn func(*bUserTokenInfo) error) (err error) {
+	ctx, end := b.trace(ctx, "iterateUserTokens", userId)
+	defer func() { end(err) }()
+	return b.next.iterateUserTokens(ctx, userId, fn)
+}
+
+func (b *instrumentedBackend) extendAllUserTokens(ctx context.Context, userId string, expiresIn time.Duration) (err error) {
+	ctx, end := b.start(ctx, "extendAllUserTokens", userId)
+	defer func() { end(err) }()
+	return b.next.extendAllUserTokens(ctx, userId, expiresIn)
+}
+
+func (b *instrumentedBackend) reconcileUserToken(ctx context.Context, userId string, tokenString string) (err error) {
+	ctx, end := b.start(ctx, "reconcileUserToken", userId)
+	defer func() { end(err) }()
+	return b.next.reconcileUserToken(ctx, userId, tokenString)
+}
+
+func (b *instrumentedBackend) dumpUserTokens(ctx context.Context, userId string) (dump []UserTokenDebug, err error) {
+	ctx, end := b.start(ctx, "dumpUserTokens", userId)
+	defer func() { end(err) }()
+	return b.next.dumpUserTokens(ctx, userId)
+}
+
+func (b *instrumentedBackend) userIdForToken(ctx context.Context, tokenString string) (userId string, err error) {
+	ctx, end := b.start(ctx, "userIdForToken")
+	defer func() { end(err) }()
+	return b.next.userIdForToken(ctx, tokenString)
+}
+
+// watchRevocations isn't traced, a span would last as long as the subscription
+func (b *instrumentedBackend) watchRevocations(ctx context.Context, fn func(token string)) error {
+	return b.next.watchRevocations(ctx, fn)
+}
+
+func (b *instrumentedBackend) ping(ctx context.Context) (err error) {
+	ctx, end := b.start(ctx, "ping")
+	defer func() { end(err) }()
+	return b.next.ping(ctx)
+}
+
+func (b *instrumentedBackend) close() error {
+	return b.next.close()
+}
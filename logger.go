@@ -0,0 +1,19 @@
+package tokenmanager
+
+import (
+	"context"
+	"log/slog"
+)
+
+// warn logs err of a best effort step whose failure isn't returned, such as a
+// cleanup ahead of a save or the rollback of a failed one. Without a logger it does nothing.
+func (o *options) warn(ctx context.Context, op string, userId string, err error) {
+	if o.logger == nil || err == nil {
+		return
+	}
+	o.logger.WarnContext(ctx, "tokenmanager: "+op+" failed",
+		slog.String("operation", op),
+		slog.String("user_id", userId),
+		slog.Any("error", err),
+	)
+}
@@ -2,8 +2,10 @@ package tokenmanager
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+	"sync"
 	"time"
 )
 
@@ -12,6 +14,11 @@ func newTokenID() string { return uuid.New().String() }
 type UserTokenInfoM[T any] struct {
 	TokenData   *TokenData[T]
 	TokenString string
+	ExpiresAt   time.Time // set when loaded from the backend
+	Metadata    map[string]string
+	Fingerprint string    // Fingerprint of TokenString, safe to log
+	Revoked     bool      // ended by SoftRevokeToken, only loaded during its grace period
+	CreatedAt   time.Time // when the backend saved the token, set when loaded; zero for the hashed layout and older tokens
 }
 
 type UserTokenInfoPairM[T any] struct {
@@ -27,12 +34,12 @@ func (u *user[T]) NewTokenID() string {
 	return newTokenID()
 }
 
-func (u *user[T]) createToken(ctx context.Context, userID string, tokenData *TokenData[T], expiresIn time.Duration) (*UserTokenInfoM[T], error) {
-	saveValue, err := json.Marshal(tokenData)
+func (u *user[T]) createToken(ctx context.Context, userID string, tokenData *TokenData[T], expiresIn time.Duration, metadata map[string]string) (*UserTokenInfoM[T], error) {
+	saveValue, err := u.opts.encodePayload(tokenData)
 	if err != nil {
 		return nil, errorWrap(err)
 	}
-	tokenString, err := u.opts.backend.saveUserToken(ctx, userID, u.opts.tokenCreator.GenerateToken, string(saveValue), expiresIn)
+	tokenString, err := u.opts.backend.saveUserToken(ctx, userID, u.opts.tokenCreator.GenerateToken, string(saveValue), expiresIn, metadata)
 	if err != nil {
 		return nil, errorWrap(err)
 	}
@@ -40,16 +47,47 @@ func (u *user[T]) createToken(ctx context.Context, userID string, tokenData *Tok
 	return &UserTokenInfoM[T]{
 		TokenData:   tokenData,
 		TokenString: tokenString,
+		Fingerprint: Fingerprint(tokenString),
+		Metadata:    metadata,
 	}, nil
 }
 
+// accessExpire is the expiry of an access token issued with expiresIn: expiresIn
+// when given, otherwise the WithDefaultExpiry duration, falling back to the access
+// token expiry
+func (u *user[T]) accessExpire(expiresIn ...time.Duration) time.Duration {
+	if len(expiresIn) != 0 {
+		return expiresIn[0]
+	}
+	if u.opts.defaultExpire > 0 {
+		return u.opts.defaultExpire
+	}
+	return u.opts.accessTokenExpire
+}
+
+// newTokenData is the TokenData of a new token of userID, created now
+func (u *user[T]) newTokenData(userID string, tokenType Type, payload *T, expiresIn time.Duration) *TokenData[T] {
+	return &TokenData[T]{
+		ID:        newTokenID(),
+		UserID:    userID,
+		Type:      tokenType,
+		Payload:   *payload,
+		CreatedAt: u.opts.now().Unix(),
+		ExpiresIn: expiresIn,
+	}
+}
+
 func (u *user[T]) CreateAccessToken(ctx context.Context, userID string, payload *T, tokenID ...string) (*UserTokenInfoM[T], error) {
+	return u.createAccessToken(ctx, userID, payload, nil, tokenID...)
+}
+
+func (u *user[T]) createAccessToken(ctx context.Context, userID string, payload *T, metadata map[string]string, tokenID ...string) (*UserTokenInfoM[T], error) {
 	tokenUUID := uuid.New()
 	_tokenId := tokenUUID.String()
 	if len(tokenID) != 0 {
 		_tokenId = tokenID[0]
 	}
-	createdAt, _ := tokenUUID.Time().UnixTime()
+	createdAt := u.opts.now().Unix()
 	r, e := u.createToken(ctx, userID, &TokenData[T]{
 		ID:        _tokenId,
 		UserID:    userID,
@@ -57,17 +95,21 @@ func (u *user[T]) CreateAccessToken(ctx context.Context, userID string, payload
 		Payload:   *payload,
 		CreatedAt: createdAt,
 		ExpiresIn: u.opts.accessTokenExpire,
-	}, u.opts.accessTokenExpire)
+	}, u.opts.accessTokenExpire, metadata)
 	return r, errorWrap(e)
 }
 
 func (u *user[T]) CreateRefreshToken(ctx context.Context, userID string, payload *T, tokenID ...string) (*UserTokenInfoM[T], error) {
+	return u.createRefreshToken(ctx, userID, payload, nil, tokenID...)
+}
+
+func (u *user[T]) createRefreshToken(ctx context.Context, userID string, payload *T, metadata map[string]string, tokenID ...string) (*UserTokenInfoM[T], error) {
 	tokenUUID := uuid.New()
 	_tokenId := tokenUUID.String()
 	if len(tokenID) != 0 {
 		_tokenId = tokenID[0]
 	}
-	createdAt, _ := tokenUUID.Time().UnixTime()
+	createdAt := u.opts.now().Unix()
 
 	r, e := u.createToken(ctx, userID, &TokenData[T]{
 		ID:        _tokenId,
@@ -76,65 +118,329 @@ func (u *user[T]) CreateRefreshToken(ctx context.Context, userID string, payload
 		Payload:   *payload,
 		CreatedAt: createdAt,
 		ExpiresIn: u.opts.refreshTokenExpire,
-	}, u.opts.refreshTokenExpire)
+	}, u.opts.refreshTokenExpire, metadata)
 
 	return r, errorWrap(e)
 }
 
-func (u *user[T]) CreateTokenPair(ctx context.Context, userID string, payload *T) (*UserTokenInfoPairM[T], error) {
-	tid := u.NewTokenID()
+// CreateTokenPipe queues creating a token of userID on the caller's pipe, e.g. to
+// issue it in the transaction creating the user. The token is stored once pipe is
+// executed, the returned func reports whether it was. Redis backends only.
+func (u *user[T]) CreateTokenPipe(ctx context.Context, pipe redis.Pipeliner, userID string, payload *T, expiresIn ...time.Duration) (*UserTokenInfoM[T], func() error, error) {
+	expire := u.accessExpire(expiresIn...)
+	tokenData := u.newTokenData(userID, TypeAccess, payload, expire)
+	saveValue, err := u.opts.encodePayload(tokenData)
+	if err != nil {
+		return nil, nil, errorWrap(err)
+	}
+	tokenString, result, err := u.opts.backend.saveUserTokenPipe(ctx, pipe, userID, u.opts.tokenCreator.GenerateToken, string(saveValue), expire)
+	if err != nil {
+		return nil, nil, errorWrap(err)
+	}
+	return &UserTokenInfoM[T]{
+		TokenData:   tokenData,
+		TokenString: tokenString,
+		Fingerprint: Fingerprint(tokenString),
+	}, func() error { return errorWrap(result()) }, nil
+}
+
+// DeleteTokenPipe queues DeleteToken on the caller's pipe, the returned func
+// reports the outcome once pipe is executed
+func (u *user[T]) DeleteTokenPipe(ctx context.Context, pipe redis.Pipeliner, userID string, tokenString ...string) func() error {
+	result := u.opts.backend.deleteUserTokenPipe(ctx, pipe, userID, tokenString...)
+	return func() error { return errorWrap(result()) }
+}
+
+// ImportTokens stores tokens of userID issued elsewhere, e.g. when migrating sessions.
+// String values are stored as is, others encoded with the codec. Entries already
+// expired or colliding with a stored token are skipped.
+func (u *user[T]) ImportTokens(ctx context.Context, userID string, entries []TokenEntry) error {
+	return errorWrap(u.opts.backend.saveUserTokens(ctx, userID, entries))
+}
 
-	access, err := u.CreateAccessToken(ctx, userID, payload, tid)
+// ExportTokens snapshots the active tokens of userID as JSON, each with its value,
+// metadata and remaining TTL, for RestoreTokens
+func (u *user[T]) ExportTokens(ctx context.Context, userID string) ([]byte, error) {
+	data, err := exportUserTokens(ctx, u.opts.backend, u.opts.now(), userID)
+	return data, errorWrap(err)
+}
+
+// RestoreTokens recreates the tokens of an ExportTokens snapshot for userID, each
+// expiring its remaining TTL from now. Tokens whose TTL ran out are dropped.
+func (u *user[T]) RestoreTokens(ctx context.Context, userID string, data []byte) error {
+	return errorWrap(importUserTokens(ctx, u.opts.backend, u.opts.now(), userID, data))
+}
+
+// RotateRefreshToken replaces oldToken with a new refresh token atomically, so there's
+// never a moment both or neither are valid. A gone oldToken is ErrInvalidToken.
+func (u *user[T]) RotateRefreshToken(ctx context.Context, userID string, oldToken string, payload *T) (*UserTokenInfoM[T], error) {
+	tokenUUID := uuid.New()
+	createdAt := u.opts.now().Unix()
+	tokenData := &TokenData[T]{
+		ID:        tokenUUID.String(),
+		UserID:    userID,
+		Type:      TypeRefresh,
+		Payload:   *payload,
+		CreatedAt: createdAt,
+		ExpiresIn: u.opts.refreshTokenExpire,
+	}
+	saveValue, err := u.opts.encodePayload(tokenData)
 	if err != nil {
 		return nil, errorWrap(err)
 	}
+	tokenString, err := u.opts.backend.rotateUserToken(ctx, userID, oldToken, u.opts.tokenCreator.GenerateToken, string(saveValue), u.opts.refreshTokenExpire)
+	if err != nil {
+		return nil, errorWrap(err)
+	}
+	return &UserTokenInfoM[T]{
+		TokenData:   tokenData,
+		TokenString: tokenString,
+		Fingerprint: Fingerprint(tokenString),
+	}, nil
+}
+
+// CreateToken issues an access type token expiring after expiresIn when given,
+// otherwise after the WithDefaultExpiry duration, falling back to the access token expiry.
+func (u *user[T]) CreateToken(ctx context.Context, userID string, payload *T, expiresIn ...time.Duration) (*UserTokenInfoM[T], error) {
+	expire := u.accessExpire(expiresIn...)
+	r, e := u.createToken(ctx, userID, u.newTokenData(userID, TypeAccess, payload, expire), expire, nil)
+	return r, errorWrap(e)
+}
 
-	refresh, err := u.CreateRefreshToken(ctx, userID, payload, tid)
+// CreateUnconfirmedToken issues an access type token that fails with ErrTokenUnconfirmed
+// until ConfirmToken, e.g. for email confirmation links. Not supported by the hashed layout.
+func (u *user[T]) CreateUnconfirmedToken(ctx context.Context, userID string, payload *T, expiresIn ...time.Duration) (*UserTokenInfoM[T], error) {
+	expire := u.accessExpire(expiresIn...)
+	tokenData := u.newTokenData(userID, TypeAccess, payload, expire)
+	saveValue, err := u.opts.encodePayload(tokenData)
 	if err != nil {
 		return nil, errorWrap(err)
 	}
-	g := &UserTokenInfoPairM[T]{
-		AccessToken:  access,
-		RefreshToken: refresh,
+	tokenString, err := u.opts.backend.saveUnconfirmedUserToken(ctx, userID, u.opts.tokenCreator.GenerateToken, string(saveValue), expire)
+	if err != nil {
+		return nil, errorWrap(err)
 	}
+	return &UserTokenInfoM[T]{
+		TokenData:   tokenData,
+		TokenString: tokenString,
+		Fingerprint: Fingerprint(tokenString),
+	}, nil
+}
 
-	return g, nil
+// ConfirmToken makes a token made by CreateUnconfirmedToken usable, in place
+func (u *user[T]) ConfirmToken(ctx context.Context, userID string, tokenString string) error {
+	return errorWrap(u.opts.backend.confirmUserToken(ctx, userID, tokenString))
 }
 
-func (u *user[T]) LoadToken(ctx context.Context, userID string, tokenString string) (*UserTokenInfoM[T], error) {
-	userToken, err := u.opts.backend.loadUserToken(ctx, userID, tokenString)
+// GetOrCreateToken returns the furthest expiring token of userID, or issues an access
+// type token when userID has none, so concurrent logins share one session.
+// It reports whether the token was created.
+func (u *user[T]) GetOrCreateToken(ctx context.Context, userID string, payload *T, expiresIn ...time.Duration) (*UserTokenInfoM[T], bool, error) {
+	expire := u.accessExpire(expiresIn...)
+	tokenData := u.newTokenData(userID, TypeAccess, payload, expire)
+	saveValue, err := u.opts.encodePayload(tokenData)
+	if err != nil {
+		return nil, false, errorWrap(err)
+	}
+	tokenString, created, err := u.opts.backend.getOrCreateUserToken(ctx, userID, u.opts.tokenCreator.GenerateToken, string(saveValue), expire)
+	if err != nil {
+		return nil, false, errorWrap(err)
+	}
+	if !created {
+		userTokenInfo, err := u.LoadToken(ctx, userID, tokenString)
+		return userTokenInfo, false, errorWrap(err)
+	}
+	return &UserTokenInfoM[T]{
+		TokenData:   tokenData,
+		TokenString: tokenString,
+		Fingerprint: Fingerprint(tokenString),
+	}, true, nil
+}
+
+// CreateTokenWithString issues an access type token under tokenString, e.g. one
+// derived from a request's idempotency key. If tokenString is already stored it
+// reports false and returns the stored token, so a retried call never issues twice.
+// A tokenString another user holds fails with ErrTokenTaken.
+func (u *user[T]) CreateTokenWithString(ctx context.Context, userID string, tokenString string, payload *T, expiresIn ...time.Duration) (*UserTokenInfoM[T], bool, error) {
+	expire := u.accessExpire(expiresIn...)
+	tokenData := u.newTokenData(userID, TypeAccess, payload, expire)
+	saveValue, err := u.opts.encodePayload(tokenData)
+	if err != nil {
+		return nil, false, errorWrap(err)
+	}
+	created, err := u.opts.backend.saveUserTokenWithId(ctx, userID, tokenString, string(saveValue), expire)
+	if err != nil {
+		return nil, false, errorWrap(err)
+	}
+	if !created {
+		userTokenInfo, err := u.LoadToken(ctx, userID, tokenString)
+		if err != nil {
+			return nil, false, errorWrap(err)
+		}
+		if userTokenInfo.TokenData.UserID != userID {
+			return nil, false, errorWrap(ErrTokenTaken)
+		}
+		return userTokenInfo, false, nil
+	}
+	return &UserTokenInfoM[T]{
+		TokenData:   tokenData,
+		TokenString: tokenString,
+		Fingerprint: Fingerprint(tokenString),
+	}, true, nil
+}
+
+func (u *user[T]) CreateTokenPair(ctx context.Context, userID string, payload *T) (*UserTokenInfoPairM[T], error) {
+	return u.CreateTokenPairWithMetadata(ctx, userID, payload, nil)
+}
+
+// CreateTokenPairWithMetadata stores metadata such as device or ip next to both tokens.
+// The tokens are linked, revoking either one revokes the other.
+func (u *user[T]) CreateTokenPairWithMetadata(ctx context.Context, userID string, payload *T, metadata map[string]string) (*UserTokenInfoPairM[T], error) {
+	tid := u.NewTokenID()
+	createdAt := u.opts.now().Unix()
+	accessData := &TokenData[T]{
+		ID:        tid,
+		UserID:    userID,
+		Type:      TypeAccess,
+		Payload:   *payload,
+		CreatedAt: createdAt,
+		ExpiresIn: u.opts.accessTokenExpire,
+	}
+	refreshData := &TokenData[T]{
+		ID:        tid,
+		UserID:    userID,
+		Type:      TypeRefresh,
+		Payload:   *payload,
+		CreatedAt: createdAt,
+		ExpiresIn: u.opts.refreshTokenExpire,
+	}
+	accessValue, err := u.opts.encodePayload(accessData)
 	if err != nil {
 		return nil, errorWrap(err)
 	}
-	tokenData := &TokenData[T]{}
-	err = json.Unmarshal([]byte(userToken.TokenData), tokenData)
+	refreshValue, err := u.opts.encodePayload(refreshData)
+	if err != nil {
+		return nil, errorWrap(err)
+	}
+
+	access, refresh, err := u.opts.backend.saveTokenPair(ctx, userID, u.opts.tokenCreator.GenerateToken, u.opts.tokenCreator.GenerateToken,
+		string(accessValue), string(refreshValue), u.opts.accessTokenExpire, u.opts.refreshTokenExpire, metadata)
 	if err != nil {
 		return nil, errorWrap(err)
 	}
+	return &UserTokenInfoPairM[T]{
+		AccessToken: &UserTokenInfoM[T]{
+			TokenData:   accessData,
+			TokenString: access,
+			Fingerprint: Fingerprint(access),
+			Metadata:    metadata,
+		},
+		RefreshToken: &UserTokenInfoM[T]{
+			TokenData:   refreshData,
+			TokenString: refresh,
+			Fingerprint: Fingerprint(refresh),
+			Metadata:    metadata,
+		},
+	}, nil
+}
+
+func decodeTokenData[T any](o *options, data string) (*TokenData[T], error) {
+	tokenData := &TokenData[T]{}
+	err := o.decodePayload([]byte(data), tokenData)
+	if err != nil {
+		return nil, err
+	}
+	return tokenData, nil
+}
+
+func decodeUserToken[T any](o *options, userToken *bUserTokenInfo) (*UserTokenInfoM[T], error) {
+	tokenData, err := decodeTokenData[T](o, userToken.TokenData)
+	if err != nil {
+		return nil, err
+	}
 	return &UserTokenInfoM[T]{
 		TokenData:   tokenData,
 		TokenString: userToken.TokenString,
+		ExpiresAt:   userToken.ExpiresAt,
+		Metadata:    userToken.Metadata,
+		Fingerprint: userToken.Fingerprint,
+		Revoked:     userToken.Revoked,
+		CreatedAt:   userToken.CreatedAt,
 	}, nil
 }
 
+func (u *user[T]) LoadToken(ctx context.Context, userID string, tokenString string) (*UserTokenInfoM[T], error) {
+	userToken, err := u.opts.backend.loadUserToken(ctx, userID, tokenString)
+	if err != nil {
+		return nil, errorWrap(err)
+	}
+	userTokenInfo, err := decodeUserToken[T](&u.opts, userToken)
+	return userTokenInfo, errorWrap(err)
+}
+
+// LoadRawToken returns the stored value of a user token as is, without decoding it
+func (u *user[T]) LoadRawToken(ctx context.Context, userID string, tokenString string) (string, error) {
+	userToken, err := u.opts.backend.loadUserToken(ctx, userID, tokenString)
+	if err != nil {
+		return "", errorWrap(err)
+	}
+	return userToken.TokenData, nil
+}
+
+// LoadTokenList returns the tokens of userID, skipping tokens that can't be decoded
 func (u *user[T]) LoadTokenList(ctx context.Context, userID string) ([]*UserTokenInfoM[T], error) {
+	userTokenList, _, err := u.LoadTokenListWithErrors(ctx, userID)
+	return userTokenList, err
+}
+
+// LoadTokenListWithErrors is LoadTokenList reporting the tokens it skipped, keyed
+// by token string with the cause. A failing storage read fails the whole call.
+func (u *user[T]) LoadTokenListWithErrors(ctx context.Context, userID string) ([]*UserTokenInfoM[T], map[string]error, error) {
 	tokenList, err := u.opts.backend.loadUserTokenList(ctx, userID)
 	if err != nil {
-		return nil, errorWrap(err)
+		return nil, nil, errorWrap(err)
 	}
 	userTokenList := make([]*UserTokenInfoM[T], 0)
+	failed := make(map[string]error)
 	for _, token := range tokenList {
-		v := &TokenData[T]{}
-		err := json.Unmarshal([]byte(token.TokenData), v)
+		userTokenInfo, err := decodeUserToken[T](&u.opts, token)
 		if err != nil {
+			failed[token.TokenString] = err
 			continue
 		}
-		userTokenList = append(userTokenList, &UserTokenInfoM[T]{
-			TokenData:   v,
-			TokenString: token.TokenString,
-		})
+		userTokenList = append(userTokenList, userTokenInfo)
 	}
-	return userTokenList, nil
+	return userTokenList, failed, nil
+}
+
+// LoadTokenListPaged returns limit tokens of userID from offset in the WithListOrder
+// order, along with the number of tokens in total. A negative limit means all.
+func (u *user[T]) LoadTokenListPaged(ctx context.Context, userID string, offset, limit int64) ([]*UserTokenInfoM[T], int64, error) {
+	tokenList, total, err := u.opts.backend.loadUserTokenListPaged(ctx, userID, offset, limit)
+	if err != nil {
+		return nil, 0, errorWrap(err)
+	}
+	userTokenList := make([]*UserTokenInfoM[T], 0, len(tokenList))
+	for _, token := range tokenList {
+		userTokenInfo, err := decodeUserToken[T](&u.opts, token)
+		if err != nil {
+			continue
+		}
+		userTokenList = append(userTokenList, userTokenInfo)
+	}
+	return userTokenList, total, nil
+}
+
+// IterateTokens calls fn for every token of userID without loading them all at once.
+// Order is unspecified and iteration stops at the first error returned by fn.
+func (u *user[T]) IterateTokens(ctx context.Context, userID string, fn func(*UserTokenInfoM[T]) error) error {
+	return errorWrap(u.opts.backend.iterateUserTokens(ctx, userID, func(token *bUserTokenInfo) error {
+		userTokenInfo, err := decodeUserToken[T](&u.opts, token)
+		if err != nil {
+			return nil
+		}
+		return fn(userTokenInfo)
+	}))
 }
 
 func (u *user[T]) AbortToken(ctx context.Context, userID string, tokenID string) error {
@@ -150,12 +456,174 @@ func (u *user[T]) AbortToken(ctx context.Context, userID string, tokenID string)
 		}
 	}
 
-	return errorWrap(u.opts.backend.deleteToken(ctx, tokenForDelete...))
+	_, err = u.opts.backend.deleteUserToken(ctx, userID, tokenForDelete...)
+	return errorWrap(err)
+}
+
+// LoadTokensByType returns the tokens of userID of the given type, e.g. only the refresh tokens
+func (u *user[T]) LoadTokensByType(ctx context.Context, userID string, tokenType Type) ([]*UserTokenInfoM[T], error) {
+	userTokenInfos, err := u.LoadTokenList(ctx, userID)
+	if err != nil {
+		return nil, errorWrap(err)
+	}
+
+	userTokenList := make([]*UserTokenInfoM[T], 0, len(userTokenInfos))
+	for _, tokenInfo := range userTokenInfos {
+		if tokenInfo.TokenData.Type == tokenType {
+			userTokenList = append(userTokenList, tokenInfo)
+		}
+	}
+	return userTokenList, nil
+}
+
+// UpdateTokenPayloadIfActive replaces the payload of a token of userID keeping its
+// expiry, e.g. to continue a session, failing with ErrTokenRevoked if the token was
+// revoked in the meantime and ErrTokenNotFound once it is gone
+func (u *user[T]) UpdateTokenPayloadIfActive(ctx context.Context, userID string, tokenString string, payload *T) error {
+	userTokenInfo, err := u.LoadToken(ctx, userID, tokenString)
+	if err != nil {
+		return err
+	}
+	if userTokenInfo.Revoked {
+		return errorWrap(ErrTokenRevoked)
+	}
+	tokenData := userTokenInfo.TokenData
+	tokenData.Payload = *payload
+	saveValue, err := u.opts.encodePayload(tokenData)
+	if err != nil {
+		return errorWrap(err)
+	}
+	return errorWrap(u.opts.backend.updateTokenValueIfActive(ctx, userID, tokenString, string(saveValue)))
+}
+
+// LoadTokensWithScope returns the tokens of userID granting scope, listed in their
+// ScopeMetadataKey metadata. The redis backend looks them up in a scope index
+// instead of loading every token.
+func (u *user[T]) LoadTokensWithScope(ctx context.Context, userID string, scope string) ([]*UserTokenInfoM[T], error) {
+	tokenList, err := u.opts.backend.loadUserTokensWithScope(ctx, userID, scope)
+	if err != nil {
+		return nil, errorWrap(err)
+	}
+	userTokenList := make([]*UserTokenInfoM[T], 0, len(tokenList))
+	for _, token := range tokenList {
+		userTokenInfo, err := decodeUserToken[T](&u.opts, token)
+		if err != nil {
+			continue
+		}
+		userTokenList = append(userTokenList, userTokenInfo)
+	}
+	return userTokenList, nil
+}
+
+// DeleteTokensByType deletes the tokens of userID of the given type
+func (u *user[T]) DeleteTokensByType(ctx context.Context, userID string, tokenType Type) error {
+	userTokenInfos, err := u.LoadTokensByType(ctx, userID, tokenType)
+	if err != nil {
+		return errorWrap(err)
+	}
+
+	tokenForDelete := make([]string, 0, len(userTokenInfos))
+	for _, tokenInfo := range userTokenInfos {
+		tokenForDelete = append(tokenForDelete, tokenInfo.TokenString)
+	}
+	_, err = u.opts.backend.deleteUserToken(ctx, userID, tokenForDelete...)
+	return errorWrap(err)
+}
+
+// SoftRevokeToken revokes a token of userID at once, while LoadToken still returns
+// it flagged Revoked for grace, e.g. to tell the user their session was ended.
+// The token is deleted when grace is over.
+func (u *user[T]) SoftRevokeToken(ctx context.Context, userID string, tokenString string, grace time.Duration) error {
+	return errorWrap(u.opts.backend.softRevokeUserToken(ctx, userID, tokenString, grace))
+}
+
+// DeleteToken revokes tokens of userID, removing their values and user token entries together
+func (u *user[T]) DeleteToken(ctx context.Context, userID string, tokenString ...string) error {
+	_, err := u.DeleteTokens(ctx, userID, tokenString...)
+	return err
+}
+
+// DeleteTokens is DeleteToken returning how many of the tokens were there to delete,
+// so a caller can tell a no-op, e.g. to answer 404 rather than 200
+func (u *user[T]) DeleteTokens(ctx context.Context, userID string, tokenString ...string) (int64, error) {
+	deleted, err := u.opts.backend.deleteUserToken(ctx, userID, tokenString...)
+	return deleted, errorWrap(err)
+}
+
+// MoveTokens reassigns every token of fromUserID to toUserID, e.g. when merging
+// accounts. A token both users hold keeps the later expiry.
+func (u *user[T]) MoveTokens(ctx context.Context, fromUserID string, toUserID string) error {
+	return errorWrap(u.opts.backend.moveUserTokens(ctx, fromUserID, toUserID))
+}
+
+// DeleteAllTokens logs the users out everywhere. Users that failed are listed in a *PartialFailureError
+func (u *user[T]) DeleteAllTokens(ctx context.Context, userIDs ...string) error {
+	return errorWrap(u.opts.backend.deleteAllUserTokens(ctx, userIDs...))
+}
+
+// DeleteAllTokensExcept logs userID out of every other device, keeping keepToken.
+// It fails with ErrInvalidToken, deleting nothing, when keepToken isn't a token of userID.
+func (u *user[T]) DeleteAllTokensExcept(ctx context.Context, userID string, keepToken string) error {
+	return errorWrap(u.opts.backend.deleteUserTokensExcept(ctx, userID, keepToken))
+}
+
+// Cleanup removes expired and dangling tokens of userID
+func (u *user[T]) Cleanup(ctx context.Context, userID string) error {
+	_, err := u.opts.backend.cleanupUserToken(ctx, userID)
+	return errorWrap(err)
+}
+
+// CleanupDryRun returns the tokens Cleanup would remove from userID, expired or
+// dangling, without removing anything, e.g. to audit a cleanup before running it
+func (u *user[T]) CleanupDryRun(ctx context.Context, userID string) ([]string, error) {
+	preview, err := u.opts.backend.previewCleanupUserToken(ctx, userID)
+	return preview, errorWrap(err)
+}
+
+// CountTokens returns the number of active tokens of userID
+func (u *user[T]) CountTokens(ctx context.Context, userID string) (int64, error) {
+	count, err := u.opts.backend.countUserTokens(ctx, userID)
+	return count, errorWrap(err)
+}
+
+// TokenExists checks a token of userID is still valid without loading it
+func (u *user[T]) TokenExists(ctx context.Context, userID string, tokenString string) (bool, error) {
+	ok, err := u.opts.backend.userTokenExists(ctx, userID, tokenString)
+	return ok, errorWrap(err)
+}
+
+// ExtendToken pushes the expiry of an active token to expiresIn from now, failing
+// with ErrTokenRevoked for a revoked one
+func (u *user[T]) ExtendToken(ctx context.Context, userID string, tokenString string, expiresIn time.Duration) error {
+	return errorWrap(u.opts.backend.refreshUserToken(ctx, userID, tokenString, expiresIn))
+}
+
+// ExtendAllTokens pushes the expiry of every active token of userID to expiresIn from
+// now, revoked ones keep theirs
+func (u *user[T]) ExtendAllTokens(ctx context.Context, userID string, expiresIn time.Duration) error {
+	return errorWrap(u.opts.backend.extendAllUserTokens(ctx, userID, expiresIn))
+}
+
+// ReconcileToken resyncs the user token expiry with the expiry of its stored value,
+// e.g. after the keys were edited by hand
+func (u *user[T]) ReconcileToken(ctx context.Context, userID string, tokenString string) error {
+	return errorWrap(u.opts.backend.reconcileUserToken(ctx, userID, tokenString))
+}
+
+// DumpTokens returns the raw entries of userID, including the dangling and expired
+// ones LoadTokenList skips, for debugging
+func (u *user[T]) DumpTokens(ctx context.Context, userID string) ([]UserTokenDebug, error) {
+	dump, err := u.opts.backend.dumpUserTokens(ctx, userID)
+	return dump, errorWrap(err)
 }
 
 type Manager[T any] struct {
 	opts options
 	User *user[T]
+
+	mu       sync.Mutex
+	janitors []context.CancelFunc
+	wg       sync.WaitGroup
 }
 
 func CreateManager[Payload any](opts []Option) *Manager[Payload] {
@@ -170,13 +638,14 @@ func CreateManager[Payload any](opts []Option) *Manager[Payload] {
 	return m
 }
 
+// New creates a Manager backed by the redis client
+func New[Payload any](client *redis.Client, opts ...Option) *Manager[Payload] {
+	return CreateManager[Payload](append([]Option{WithRedisBackend(client)}, opts...))
+}
+
 func (m *Manager[T]) unmarshalTokenData(unmarshalTokenData string) (*TokenData[T], error) {
-	td := &TokenData[T]{}
-	err := json.Unmarshal([]byte(unmarshalTokenData), td)
-	if err != nil {
-		return nil, errorWrap(err)
-	}
-	return td, nil
+	td, err := decodeTokenData[T](&m.opts, unmarshalTokenData)
+	return td, errorWrap(err)
 }
 
 func (m *Manager[T]) NewTokenID() string {
@@ -201,10 +670,211 @@ func (m *Manager[T]) GetTokenData(ctx context.Context, tokenString string) (*Tok
 	return tokenData, nil
 }
 
+// GetTokenDataWithTTL is GetTokenData also returning how long the token has left,
+// e.g. to cache it no longer than that. A token without expiry has 0 left.
+func (m *Manager[T]) GetTokenDataWithTTL(ctx context.Context, tokenString string) (*TokenData[T], time.Duration, error) {
+	tokenUnmarshalData, ttl, err := m.opts.backend.loadTokenWithTTL(ctx, tokenString)
+	if err != nil {
+		return nil, 0, errorWrap(err)
+	}
+	tokenData, err := m.unmarshalTokenData(tokenUnmarshalData)
+	if err != nil {
+		return nil, 0, errorWrap(err)
+	}
+	return tokenData, ttl, nil
+}
+
+// LoadTokenInto decodes the stored value of the token into dest with the configured codec
+func (m *Manager[T]) LoadTokenInto(ctx context.Context, tokenString string, dest any) error {
+	value, err := m.opts.backend.loadToken(ctx, tokenString)
+	if err != nil {
+		return errorWrap(err)
+	}
+	return errorWrap(m.opts.decodePayload([]byte(value), dest))
+}
+
+// UpdateTokenPayload replaces the payload of the token in place, e.g. after the roles
+// of its user changed, keeping its expiry. A concurrent update may be overwritten.
+func (m *Manager[T]) UpdateTokenPayload(ctx context.Context, tokenString string, payload *T) error {
+	tokenData, err := m.GetTokenData(ctx, tokenString)
+	if err != nil {
+		return err
+	}
+	tokenData.Payload = *payload
+	saveValue, err := m.opts.encodePayload(tokenData)
+	if err != nil {
+		return errorWrap(err)
+	}
+	return errorWrap(m.opts.backend.updateTokenValue(ctx, tokenString, string(saveValue)))
+}
+
 func (m *Manager[T]) AbortToken(ctx context.Context, tokenString ...string) error {
 	return errorWrap(m.opts.backend.deleteToken(ctx, tokenString...))
 }
 
+// markerValue is stored under marker keys, which only exist to be checked
+const markerValue = "1"
+
+// SaveMarker stores a value-less marker under tokenString for expire, e.g. the jti
+// of a JWT whose claims travel in the token itself. It reports false if tokenString
+// is already stored. RevokeToken and AbortToken invalidate the marker.
+func (m *Manager[T]) SaveMarker(ctx context.Context, tokenString string, expire time.Duration) (bool, error) {
+	ok, err := m.opts.backend.saveToken(ctx, tokenString, markerValue, expire)
+	return ok, errorWrap(err)
+}
+
+// IsMarkerValid reports whether the marker of tokenString is stored and not revoked
+func (m *Manager[T]) IsMarkerValid(ctx context.Context, tokenString string) (bool, error) {
+	_, err := m.opts.backend.loadToken(ctx, tokenString)
+	switch {
+	case err == nil:
+		return true, nil
+	case errors.Is(err, ErrTokenNotFound), errors.Is(err, ErrTokenRevoked):
+		return false, nil
+	default:
+		return false, errorWrap(err)
+	}
+}
+
+// AbortTokenIfValue deletes the token only if its stored value is still expected,
+// e.g. the value read before deciding to delete, and reports whether it did.
+func (m *Manager[T]) AbortTokenIfValue(ctx context.Context, tokenString string, expected string) (bool, error) {
+	deleted, err := m.opts.backend.deleteTokenIfValue(ctx, tokenString, expected)
+	return deleted, errorWrap(err)
+}
+
+// RevokeToken invalidates tokens before they expire, loading them returns ErrTokenRevoked
+func (m *Manager[T]) RevokeToken(ctx context.Context, tokenString string) error {
+	return errorWrap(m.opts.backend.revokeToken(ctx, tokenString))
+}
+
+// WatchRevocations calls fn with every token revoked by any instance sharing the
+// WithRevocationChannel channel, until ctx is done. Tokens come hashed under
+// WithTokenHashing. It fails with ErrNotSupported without the channel.
+func (m *Manager[T]) WatchRevocations(ctx context.Context, fn func(token string)) error {
+	return errorWrap(m.opts.backend.watchRevocations(ctx, fn))
+}
+
+// UserIDForToken returns the user the token belongs to. The redis backends need
+// WithTokenOwnerIndex, otherwise it fails with ErrNotSupported.
+func (m *Manager[T]) UserIDForToken(ctx context.Context, tokenString string) (string, error) {
+	userId, err := m.opts.backend.userIdForToken(ctx, tokenString)
+	return userId, errorWrap(err)
+}
+
+const healthCheckTimeout = time.Second * 2
+
+// HealthCheck reports whether the backend is reachable, giving up after a short timeout
+func (m *Manager[T]) HealthCheck(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+	return errorWrap(m.opts.backend.ping(ctx))
+}
+
+// defaultJanitorInterval is the StartJanitor interval used for one that isn't positive
+const defaultJanitorInterval = time.Minute
+
+// StartJanitor cleans up the tokens of every user each interval until ctx is done
+// or the manager is closed. It returns immediately, the sweep runs in its own goroutine.
+// An interval that isn't positive falls back to a minute.
+func (m *Manager[T]) StartJanitor(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		interval = defaultJanitorInterval
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	m.mu.Lock()
+	m.janitors = append(m.janitors, cancel)
+	m.mu.Unlock()
+
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				err := m.opts.backend.scanUserIds(ctx, func(userId string) error {
+					_, err := m.opts.backend.cleanupUserToken(ctx, userId)
+					m.opts.warn(ctx, "cleanupUserToken", userId, err)
+					return ctx.Err()
+				})
+				if ctx.Err() == nil {
+					m.opts.warn(ctx, "scanUserIds", "", err)
+				}
+			}
+		}
+	}()
+}
+
+// VacuumStats reports what a Vacuum pass did.
+type VacuumStats struct {
+	// Users is the number of user token keys scanned
+	Users int64
+	// Removed is the number of expired and dangling members removed
+	Removed int64
+}
+
+// Vacuum cleans up the tokens of every user once, walking the keyspace with SCAN.
+// It stops at the first failing cleanup and returns the stats gathered so far.
+func (m *Manager[T]) Vacuum(ctx context.Context) (VacuumStats, error) {
+	var stats VacuumStats
+	err := m.opts.backend.scanUserIds(ctx, func(userId string) error {
+		removed, err := m.opts.backend.cleanupUserToken(ctx, userId)
+		if err != nil {
+			return err
+		}
+		stats.Users++
+		stats.Removed += removed
+		return nil
+	})
+	return stats, errorWrap(err)
+}
+
+// ListActiveUserIDs returns the ids of the users holding tokens, walking the
+// keyspace with SCAN. Users may gain or lose tokens during the walk, so it is a
+// best effort snapshot meant for admin tooling, not for request paths.
+func (m *Manager[T]) ListActiveUserIDs(ctx context.Context) ([]string, error) {
+	userIds, err := listActiveUserIds(ctx, m.opts.backend)
+	return userIds, errorWrap(err)
+}
+
+// IterateActiveUserIDs calls fn with the id of every user holding tokens, one SCAN
+// page of WithScanCount keys at a time, so users are never all held in memory.
+// An error from fn stops the walk and is returned as is. A user may be seen twice,
+// as with SCAN itself.
+func (m *Manager[T]) IterateActiveUserIDs(ctx context.Context, fn func(userID string) error) error {
+	var fnErr error
+	err := m.opts.backend.scanUserIds(ctx, func(userId string) error {
+		fnErr = fn(userId)
+		return fnErr
+	})
+	if fnErr != nil {
+		return fnErr
+	}
+	return errorWrap(err)
+}
+
+// Stats returns the counts of the backend operations of the manager so far
+func (m *Manager[T]) Stats() Stats {
+	return m.opts.stats.snapshot()
+}
+
+// Close stops the janitors and releases the backend, closing its redis client.
+// The manager must not be used afterwards.
+func (m *Manager[T]) Close() error {
+	m.mu.Lock()
+	for _, cancel := range m.janitors {
+		cancel()
+	}
+	m.janitors = nil
+	m.mu.Unlock()
+	m.wg.Wait()
+	return m.opts.backend.close()
+}
+
 type RefreshTokenOption struct {
 	Duration time.Duration
 }
@@ -231,8 +901,8 @@ func (m *Manager[T]) RefreshToken(ctx context.Context, tokenString string, optio
 	}
 
 	var refreshTokenInfo *UserTokenInfoM[T]
-	if time.Now().UTC().Sub(time.Unix(refreshTokenData.CreatedAt, 0)) <= option.Duration {
-		refreshTokenInfo, err = m.User.CreateRefreshToken(ctx, userId, payload)
+	if m.opts.now().Sub(time.Unix(refreshTokenData.CreatedAt, 0)) <= option.Duration {
+		refreshTokenInfo, err = m.User.createRefreshToken(ctx, userId, payload, userRefreshTokenInfo.Metadata)
 		if err != nil {
 			return nil, errorWrap(err)
 		}
@@ -240,7 +910,7 @@ func (m *Manager[T]) RefreshToken(ctx context.Context, tokenString string, optio
 		refreshTokenInfo = userRefreshTokenInfo
 	}
 
-	accessTokenInfo, err := m.User.CreateAccessToken(ctx, userId, payload, refreshTokenInfo.TokenData.ID)
+	accessTokenInfo, err := m.User.createAccessToken(ctx, userId, payload, userRefreshTokenInfo.Metadata, refreshTokenInfo.TokenData.ID)
 	if err != nil {
 		return nil, errorWrap(err)
 	}
@@ -0,0 +1,21 @@
+package tokenmanager
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestStartJanitorWithoutInterval(t *testing.T) {
+	server := miniredis.RunT(t)
+	m := New[struct{}](redis.NewClient(&redis.Options{Addr: server.Addr()}))
+	for _, interval := range []time.Duration{0, -time.Second} {
+		m.StartJanitor(context.Background(), interval)
+	}
+	if err := m.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+}
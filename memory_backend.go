@@ -0,0 +1,1059 @@
+package tokenmanager
+
+import (
+	"context"
+	"errors"
+	"github.com/redis/go-redis/v9"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+type memoryToken struct {
+	value       string
+	expireAt    time.Time // zero value means the token never expires
+	metadata    map[string]string
+	userId      string // owner of a user token
+	unconfirmed bool   // fails to load until confirmUserToken
+	softRevoked bool   // revoked by softRevokeUserToken
+	partner     string // other token of the pair saved by saveTokenPair
+	createdAt   time.Time
+}
+
+func (t *memoryToken) expired(now time.Time) bool {
+	return !t.expireAt.IsZero() && !now.Before(t.expireAt)
+}
+
+// memoryBackend keeps tokens in process memory. It mirrors the redis layout:
+// tokens holds the TOKENS:<token> values and userTokens holds the
+// USER_TOKENS:<userId> sorted sets as token -> expire unix score.
+type memoryBackend struct {
+	opts       *options
+	mu         sync.RWMutex
+	tokens     map[string]*memoryToken
+	userTokens map[string]map[string]int64
+	revoked    map[string]time.Time // token -> expireAt, zero for never
+	issued     map[string]*memoryIssueWindow
+}
+
+// memoryIssueWindow counts the tokens a user issued until resetAt
+type memoryIssueWindow struct {
+	count   int
+	resetAt time.Time
+}
+
+func NewMemoryBackend() Backend {
+	return newMemoryBackend()
+}
+
+func newMemoryBackend() *memoryBackend {
+	return &memoryBackend{
+		opts:       defaultOptions,
+		tokens:     make(map[string]*memoryToken),
+		userTokens: make(map[string]map[string]int64),
+		revoked:    make(map[string]time.Time),
+		issued:     make(map[string]*memoryIssueWindow),
+	}
+}
+
+func (m *memoryBackend) bind(opts *options) {
+	m.opts = opts
+}
+
+func copyMetadata(metadata map[string]string) map[string]string {
+	if len(metadata) == 0 {
+		return nil
+	}
+	c := make(map[string]string, len(metadata))
+	for k, v := range metadata {
+		c[k] = v
+	}
+	return c
+}
+
+// getToken returns a live token, evicting it when expired. m.mu must be held for writing.
+func (m *memoryBackend) getToken(token string, now time.Time) (*memoryToken, bool) {
+	t, ok := m.tokens[token]
+	if !ok {
+		return nil, false
+	}
+	if t.expired(now) {
+		delete(m.tokens, token)
+		return nil, false
+	}
+	return t, true
+}
+
+// peekToken is the read locked counterpart of getToken. The second result
+// reports whether an expired token was found and needs eviction.
+func (m *memoryBackend) peekToken(token string, now time.Time) (*memoryToken, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	t, ok := m.tokens[token]
+	if !ok {
+		return nil, false
+	}
+	if t.expired(now) {
+		return nil, true
+	}
+	return t, false
+}
+
+// isRevoked reports whether token is revoked. m.mu must be held.
+func (m *memoryBackend) isRevoked(token string, now time.Time) bool {
+	expireAt, ok := m.revoked[token]
+	return ok && (expireAt.IsZero() || now.Before(expireAt))
+}
+
+func (m *memoryBackend) evictToken(token string, now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.getToken(token, now)
+}
+
+func (m *memoryBackend) saveToken(ctx context.Context, token string, value interface{}, expire time.Duration) (bool, error) {
+	if expire < 0 {
+		return false, ErrInvalidExpiry
+	}
+	v, err := m.opts.encodeValue(value)
+	if err != nil {
+		return false, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.saveTokenLocked(token, v, expire, m.opts.now()), nil
+}
+
+func (m *memoryBackend) saveTokenLocked(token string, value string, expire time.Duration, now time.Time) bool {
+	if _, ok := m.getToken(token, now); ok {
+		return false
+	}
+	t := &memoryToken{value: value, createdAt: now.UTC()}
+	if expire > 0 {
+		t.expireAt = now.Add(expire)
+	}
+	m.tokens[token] = t
+	return true
+}
+
+func (m *memoryBackend) loadToken(ctx context.Context, token string) (string, error) {
+	value, _, err := m.loadTokenWithTTL(ctx, token)
+	return value, err
+}
+
+func (m *memoryBackend) loadTokenWithTTL(ctx context.Context, token string) (string, time.Duration, error) {
+	now := m.opts.now()
+	m.mu.RLock()
+	revoked := m.isRevoked(token, now)
+	m.mu.RUnlock()
+	if revoked {
+		return "", 0, ErrTokenRevoked
+	}
+
+	t, stale := m.peekToken(token, now)
+	if stale {
+		m.evictToken(token, now)
+	}
+	if t == nil {
+		return "", 0, ErrTokenNotFound
+	}
+	if t.unconfirmed {
+		return "", 0, ErrTokenUnconfirmed
+	}
+	var ttl time.Duration
+	if !t.expireAt.IsZero() {
+		ttl = t.expireAt.Sub(now)
+	}
+	return t.value, ttl, nil
+}
+
+func (m *memoryBackend) deleteToken(ctx context.Context, tokens ...string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, token := range tokens {
+		delete(m.tokens, token)
+	}
+	return nil
+}
+
+func (m *memoryBackend) deleteTokenIfValue(ctx context.Context, token string, expected string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t, ok := m.getToken(token, m.opts.now())
+	if !ok || t.value != expected {
+		return false, nil
+	}
+	delete(m.tokens, token)
+	return true, nil
+}
+
+func (m *memoryBackend) updateTokenValue(ctx context.Context, token string, value interface{}) error {
+	v, err := m.opts.encodeValue(value)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.getToken(token, m.opts.now())
+	if !ok {
+		return ErrTokenNotFound
+	}
+	t.value = v
+	return nil
+}
+
+func (m *memoryBackend) updateTokenValueIfActive(ctx context.Context, userId string, token string, value interface{}) error {
+	v, err := m.opts.encodeValue(value)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.opts.now()
+	score, ok := m.userTokens[userId][token]
+	if !ok || score <= now.Unix() {
+		return ErrTokenNotFound
+	}
+	t, ok := m.getToken(token, now)
+	if !ok {
+		return ErrTokenNotFound
+	}
+	if m.isRevoked(token, now) {
+		return ErrTokenRevoked
+	}
+	t.value = v
+	return nil
+}
+
+func (m *memoryBackend) isTokenExist(ctx context.Context, token string) (bool, error) {
+	now := m.opts.now()
+	t, stale := m.peekToken(token, now)
+	if stale {
+		m.evictToken(token, now)
+	}
+	return t != nil, nil
+}
+
+func (m *memoryBackend) areTokensExist(ctx context.Context, tokens ...string) (map[string]bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	now := m.opts.now()
+	exists := make(map[string]bool, len(tokens))
+	for _, token := range tokens {
+		t, ok := m.tokens[token]
+		exists[token] = ok && !t.expired(now)
+	}
+	return exists, nil
+}
+
+func (m *memoryBackend) revokeToken(ctx context.Context, token string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.opts.now()
+	for t, expireAt := range m.revoked {
+		if !expireAt.IsZero() && !now.Before(expireAt) {
+			delete(m.revoked, t)
+		}
+	}
+	t, ok := m.getToken(token, now)
+	if !ok {
+		return ErrTokenNotFound
+	}
+	m.revokeLocked(token, t)
+	if p, ok := m.getToken(t.partner, now); ok {
+		m.revokeLocked(t.partner, p)
+	}
+	return nil
+}
+
+func (m *memoryBackend) revokeLocked(token string, t *memoryToken) {
+	t.softRevoked = false
+	m.revoked[token] = t.expireAt
+}
+
+func (m *memoryBackend) softRevokeUserToken(ctx context.Context, userId string, token string, grace time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.opts.now()
+	var partner string
+	if t, ok := m.tokens[token]; ok {
+		partner = t.partner
+	}
+	if err := m.softRevokeLocked(userId, token, grace, now); err != nil {
+		return err
+	}
+	if partner == "" {
+		return nil
+	}
+	if err := m.softRevokeLocked(userId, partner, grace, now); !errors.Is(err, ErrTokenNotFound) {
+		return err
+	}
+	return nil
+}
+
+func (m *memoryBackend) softRevokeLocked(userId string, token string, grace time.Duration, now time.Time) error {
+	score, ok := m.userTokens[userId][token]
+	if !ok || score <= now.Unix() {
+		return ErrTokenNotFound
+	}
+	t, ok := m.getToken(token, now)
+	if !ok {
+		return ErrTokenNotFound
+	}
+	expire := now.Add(grace).UTC()
+	if !t.expireAt.IsZero() && t.expireAt.Before(expire) {
+		expire = t.expireAt
+	}
+	t.expireAt = expire
+	t.softRevoked = true
+	m.revoked[token] = expire
+	m.userTokens[userId][token] = expireScore(expire)
+	return nil
+}
+
+func (m *memoryBackend) cleanupUserToken(ctx context.Context, userId string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.cleanupUserTokenLocked(userId, m.opts.now()), nil
+}
+
+// cleanupUserTokenLocked removes the expired and dangling members of userId and
+// returns how many it removed.
+func (m *memoryBackend) cleanupUserTokenLocked(userId string, now time.Time) int64 {
+	members, ok := m.userTokens[userId]
+	if !ok {
+		return 0
+	}
+	var removed int64
+	for token, score := range members {
+		if score <= now.Unix() {
+			delete(members, token)
+			removed++
+			continue
+		}
+		if _, ok := m.getToken(token, now); !ok {
+			delete(members, token)
+			removed++
+		}
+	}
+	if len(members) == 0 {
+		delete(m.userTokens, userId)
+	}
+	return removed
+}
+
+func (m *memoryBackend) previewCleanupUserToken(ctx context.Context, userId string) ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	now := m.opts.now()
+	preview := make([]string, 0)
+	for _, token := range m.sortedUserTokens(userId) {
+		if m.userTokens[userId][token] <= now.Unix() {
+			preview = append(preview, token)
+			continue
+		}
+		if t, ok := m.tokens[token]; !ok || t.expired(now) {
+			preview = append(preview, token)
+		}
+	}
+	return preview, nil
+}
+
+// sortedUserTokens returns members ordered like ZRANGE: by score, then by member.
+func (m *memoryBackend) sortedUserTokens(userId string) []string {
+	members := m.userTokens[userId]
+	tokens := make([]string, 0, len(members))
+	for token := range members {
+		tokens = append(tokens, token)
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		si, sj := members[tokens[i]], members[tokens[j]]
+		if si != sj {
+			return si < sj
+		}
+		return tokens[i] < tokens[j]
+	})
+	return tokens
+}
+
+// listedUserTokens returns members in the WithListOrder order
+func (m *memoryBackend) listedUserTokens(userId string) []string {
+	tokens := m.sortedUserTokens(userId)
+	if m.opts.listOrder == Descending {
+		slices.Reverse(tokens)
+	}
+	return tokens
+}
+
+func (m *memoryBackend) checkIssueRateLocked(userId string, now time.Time) error {
+	if m.opts.issueRateMax <= 0 {
+		return nil
+	}
+	w, ok := m.issued[userId]
+	if !ok || !now.Before(w.resetAt) {
+		w = &memoryIssueWindow{resetAt: now.Add(m.opts.issueRateWindow)}
+		m.issued[userId] = w
+	}
+	w.count++
+	if w.count > m.opts.issueRateMax {
+		return ErrRateLimited
+	}
+	return nil
+}
+
+func (m *memoryBackend) saveUserToken(ctx context.Context, userId string, genToken func() (string, error), value interface{}, expiresIn time.Duration, metadata map[string]string) (string, error) {
+	if err := checkExpiry(expiresIn); err != nil {
+		return "", err
+	}
+	v, err := m.opts.encodeValue(value)
+	if err != nil {
+		return "", err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.checkIssueRateLocked(userId, m.opts.now()); err != nil {
+		return "", err
+	}
+	m.cleanupUserTokenLocked(userId, m.opts.now())
+	var expire time.Time
+	token, err := m.opts.generateToken(ctx, genToken, func(token string) (bool, error) {
+		now := m.opts.now()
+		expire = now.Add(expiresIn).UTC()
+		return m.saveTokenLocked(token, v, expire.Sub(now), now), nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	m.tokens[token].userId = userId
+	if len(metadata) != 0 {
+		m.tokens[token].metadata = copyMetadata(metadata)
+	}
+	members, ok := m.userTokens[userId]
+	if !ok {
+		members = make(map[string]int64)
+		m.userTokens[userId] = members
+	}
+	members[token] = expireScore(expire)
+	if max := m.opts.maxUserTokens; max > 0 && len(members) > max {
+		for _, evicted := range m.sortedUserTokens(userId)[:len(members)-max] {
+			delete(members, evicted)
+			delete(m.tokens, evicted)
+		}
+	}
+	return token, nil
+}
+
+func (m *memoryBackend) saveTokenPair(ctx context.Context, userId string, genAccess, genRefresh func() (string, error), accessValue, refreshValue interface{}, accessTTL, refreshTTL time.Duration, metadata map[string]string) (string, string, error) {
+	if err := checkExpiry(accessTTL); err != nil {
+		return "", "", err
+	}
+	if err := checkExpiry(refreshTTL); err != nil {
+		return "", "", err
+	}
+	access, err := m.saveUserToken(ctx, userId, genAccess, accessValue, accessTTL, metadata)
+	if err != nil {
+		return "", "", err
+	}
+	refresh, err := m.saveUserToken(ctx, userId, genRefresh, refreshValue, refreshTTL, metadata)
+	if err != nil {
+		_, _ = m.deleteUserToken(ctx, userId, access)
+		return "", "", err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if t, ok := m.tokens[access]; ok {
+		t.partner = refresh
+	}
+	if t, ok := m.tokens[refresh]; ok {
+		t.partner = access
+	}
+	return access, refresh, nil
+}
+
+func (m *memoryBackend) saveUnconfirmedUserToken(ctx context.Context, userId string, genToken func() (string, error), value interface{}, expiresIn time.Duration) (string, error) {
+	token, err := m.saveUserToken(ctx, userId, genToken, value, expiresIn, nil)
+	if err != nil {
+		return "", err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if t, ok := m.tokens[token]; ok {
+		t.unconfirmed = true
+	}
+	return token, nil
+}
+
+func (m *memoryBackend) confirmUserToken(ctx context.Context, userId string, tokenString string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.opts.now()
+	score, ok := m.userTokens[userId][tokenString]
+	if !ok || score <= now.Unix() {
+		return ErrTokenNotFound
+	}
+	t, ok := m.getToken(tokenString, now)
+	if !ok {
+		return ErrTokenNotFound
+	}
+	t.unconfirmed = false
+	return nil
+}
+
+func (m *memoryBackend) getOrCreateUserToken(ctx context.Context, userId string, genToken func() (string, error), value interface{}, expiresIn time.Duration) (string, bool, error) {
+	if err := checkExpiry(expiresIn); err != nil {
+		return "", false, err
+	}
+	v, err := m.opts.encodeValue(value)
+	if err != nil {
+		return "", false, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.opts.now()
+	m.cleanupUserTokenLocked(userId, now)
+	if tokens := m.sortedUserTokens(userId); len(tokens) != 0 {
+		return tokens[len(tokens)-1], false, nil
+	}
+	if err := m.checkIssueRateLocked(userId, now); err != nil {
+		return "", false, err
+	}
+	var expire time.Time
+	token, err := m.opts.generateToken(ctx, genToken, func(token string) (bool, error) {
+		expire = now.Add(expiresIn).UTC()
+		return m.saveTokenLocked(token, v, expire.Sub(now), now), nil
+	})
+	if err != nil {
+		return "", false, err
+	}
+	m.tokens[token].userId = userId
+	m.userTokens[userId] = map[string]int64{token: expireScore(expire)}
+	return token, true, nil
+}
+
+func (m *memoryBackend) saveUserTokenWithId(ctx context.Context, userId string, token string, value interface{}, expiresIn time.Duration) (bool, error) {
+	if err := checkExpiry(expiresIn); err != nil {
+		return false, err
+	}
+	v, err := m.opts.encodeValue(value)
+	if err != nil {
+		return false, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.opts.now()
+	if err := m.checkIssueRateLocked(userId, now); err != nil {
+		return false, err
+	}
+	m.cleanupUserTokenLocked(userId, now)
+	expire := now.Add(expiresIn).UTC()
+	created := m.saveTokenLocked(token, v, expire.Sub(now), now)
+
+	if !created && m.tokens[token].userId != userId {
+		return false, ErrTokenTaken
+	}
+	members, ok := m.userTokens[userId]
+	if !ok {
+		members = make(map[string]int64)
+		m.userTokens[userId] = members
+	}
+	if !created {
+		if _, ok := members[token]; !ok {
+			if t := m.tokens[token]; !t.expireAt.IsZero() {
+				expire = t.expireAt
+			}
+			members[token] = expireScore(expire)
+		}
+		return false, nil
+	}
+
+	m.tokens[token].userId = userId
+	members[token] = expireScore(expire)
+	if max := m.opts.maxUserTokens; max > 0 && len(members) > max {
+		for _, evicted := range m.sortedUserTokens(userId)[:len(members)-max] {
+			delete(members, evicted)
+			delete(m.tokens, evicted)
+		}
+	}
+	return true, nil
+}
+
+func (m *memoryBackend) saveUserTokens(ctx context.Context, userId string, entries []TokenEntry) error {
+	values := make([]string, len(entries))
+	for i, entry := range entries {
+		v, err := m.opts.encodeValue(entry.Value)
+		if err != nil {
+			return err
+		}
+		values[i] = v
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.opts.now()
+	for i, entry := range entries {
+		if !entry.ExpiresAt.After(now) || !m.saveTokenLocked(entry.Token, values[i], entry.ExpiresAt.Sub(now), now) {
+			continue
+		}
+		t := m.tokens[entry.Token]
+		t.userId = userId
+		t.metadata = copyMetadata(entry.Metadata)
+		members, ok := m.userTokens[userId]
+		if !ok {
+			members = make(map[string]int64)
+			m.userTokens[userId] = members
+		}
+		members[entry.Token] = expireScore(entry.ExpiresAt)
+	}
+	if max := m.opts.maxUserTokens; max > 0 && len(m.userTokens[userId]) > max {
+		members := m.userTokens[userId]
+		for _, evicted := range m.sortedUserTokens(userId)[:len(members)-max] {
+			delete(members, evicted)
+			delete(m.tokens, evicted)
+		}
+	}
+	return nil
+}
+
+// saveUserTokenPipe and deleteUserTokenPipe need a redis pipeline
+func (m *memoryBackend) saveUserTokenPipe(ctx context.Context, pipe redis.Pipeliner, userId string, genToken func() (string, error), value interface{}, expiresIn time.Duration) (string, func() error, error) {
+	return "", nil, ErrNotSupported
+}
+
+func (m *memoryBackend) deleteUserTokenPipe(ctx context.Context, pipe redis.Pipeliner, userId string, tokens ...string) func() error {
+	return func() error { return ErrNotSupported }
+}
+
+func (m *memoryBackend) loadUserToken(ctx context.Context, userId string, tokenString string) (*bUserTokenInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.opts.now()
+	if m.opts.cleanupOnLoad() {
+		m.cleanupUserTokenLocked(userId, now)
+	}
+	if d := m.opts.slidingExpiration; d > 0 && !m.isRevoked(tokenString, now) {
+		err := m.refreshUserTokenLocked(userId, tokenString, d, now)
+		if err != nil {
+			delete(m.tokens, tokenString)
+			return nil, err
+		}
+	}
+	userToken, err := m.loadUserTokenLocked(userId, tokenString, now)
+	if errors.Is(err, ErrTokenRevoked) {
+		return m.loadSoftRevokedUserTokenLocked(userId, tokenString, now)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if m.tokens[tokenString].unconfirmed {
+		return nil, ErrTokenUnconfirmed
+	}
+	return userToken, nil
+}
+
+// loadSoftRevokedUserTokenLocked loads a revoked token of the user in its grace
+// period. m.mu must be held.
+func (m *memoryBackend) loadSoftRevokedUserTokenLocked(userId string, tokenString string, now time.Time) (*bUserTokenInfo, error) {
+	t, ok := m.getToken(tokenString, now)
+	if !ok {
+		return nil, ErrTokenNotFound
+	}
+	if !t.softRevoked {
+		return nil, ErrTokenRevoked
+	}
+	return &bUserTokenInfo{
+		TokenString: tokenString,
+		Fingerprint: Fingerprint(tokenString),
+		TokenData:   t.value,
+		ExpiresAt:   time.Unix(m.userTokens[userId][tokenString], 0).UTC(),
+		Metadata:    copyMetadata(t.metadata),
+		Revoked:     true,
+		CreatedAt:   t.createdAt,
+		opts:        m.opts,
+	}, nil
+}
+
+func (m *memoryBackend) loadUserTokenLocked(userId string, tokenString string, now time.Time) (*bUserTokenInfo, error) {
+	score, ok := m.userTokens[userId][tokenString]
+	if !ok {
+		delete(m.tokens, tokenString)
+		return nil, ErrTokenNotFound
+	}
+	if score <= now.Unix() {
+		return nil, ErrTokenNotFound
+	}
+
+	if m.isRevoked(tokenString, now) {
+		return nil, ErrTokenRevoked
+	}
+	t, ok := m.getToken(tokenString, now)
+	if !ok {
+		return nil, ErrTokenNotFound
+	}
+	return &bUserTokenInfo{
+		TokenString: tokenString,
+		Fingerprint: Fingerprint(tokenString),
+		TokenData:   t.value,
+		ExpiresAt:   time.Unix(score, 0).UTC(),
+		Metadata:    copyMetadata(t.metadata),
+		CreatedAt:   t.createdAt,
+		opts:        m.opts,
+	}, nil
+}
+
+func (m *memoryBackend) loadUserTokensWithScope(ctx context.Context, userId string, scope string) ([]*bUserTokenInfo, error) {
+	list, err := m.loadUserTokenList(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+	return withScope(list, scope), nil
+}
+
+func (m *memoryBackend) loadUserTokenList(ctx context.Context, userId string) ([]*bUserTokenInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.opts.now()
+	m.cleanupUserTokenLocked(userId, now)
+
+	userTokenList := make([]*bUserTokenInfo, 0)
+	for _, tokenString := range m.listedUserTokens(userId) {
+		userToken, err := m.loadUserTokenLocked(userId, tokenString, now)
+		if err != nil {
+			continue
+		}
+		userTokenList = append(userTokenList, userToken)
+	}
+	return userTokenList, nil
+}
+
+func (m *memoryBackend) loadUserTokenListPaged(ctx context.Context, userId string, offset, limit int64) ([]*bUserTokenInfo, int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.opts.now()
+	m.cleanupUserTokenLocked(userId, now)
+
+	tokens := m.listedUserTokens(userId)
+	total := int64(len(tokens))
+	start := min(max(offset, 0), total)
+	end := total
+	if limit >= 0 {
+		end = min(start+limit, total)
+	}
+
+	userTokenList := make([]*bUserTokenInfo, 0, end-start)
+	for _, tokenString := range tokens[start:end] {
+		userToken, err := m.loadUserTokenLocked(userId, tokenString, now)
+		if err != nil {
+			continue
+		}
+		userTokenList = append(userTokenList, userToken)
+	}
+	return userTokenList, total, nil
+}
+
+func (m *memoryBackend) deleteUserToken(ctx context.Context, userId string, tokens ...string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var deleted int64
+	members := m.userTokens[userId]
+	for _, token := range tokens {
+		_, value := m.tokens[token]
+		_, member := members[token]
+		if value || member {
+			deleted++
+		}
+		delete(m.tokens, token)
+		delete(members, token)
+	}
+	if members != nil && len(members) == 0 {
+		delete(m.userTokens, userId)
+	}
+	return deleted, nil
+}
+
+func (m *memoryBackend) deleteUserTokensExcept(ctx context.Context, userId string, keepToken string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	members := m.userTokens[userId]
+	if _, ok := members[keepToken]; !ok {
+		return ErrTokenNotFound
+	}
+	for token := range members {
+		if token != keepToken {
+			delete(m.tokens, token)
+			delete(members, token)
+		}
+	}
+	return nil
+}
+
+func (m *memoryBackend) countUserTokens(ctx context.Context, userId string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.cleanupUserTokenLocked(userId, m.opts.now())
+	return int64(len(m.userTokens[userId])), nil
+}
+
+func (m *memoryBackend) refreshUserToken(ctx context.Context, userId string, tokenString string, expiresIn time.Duration) error {
+	if err := checkExpiry(expiresIn); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.refreshUserTokenLocked(userId, tokenString, expiresIn, m.opts.now())
+}
+
+func (m *memoryBackend) refreshUserTokenLocked(userId string, tokenString string, expiresIn time.Duration, now time.Time) error {
+	members := m.userTokens[userId]
+	if _, ok := members[tokenString]; !ok {
+		return ErrTokenNotFound
+	}
+	t, ok := m.getToken(tokenString, now)
+	if !ok {
+		delete(members, tokenString)
+		return ErrTokenNotFound
+	}
+	if m.isRevoked(tokenString, now) {
+		// the revocation expires with the expiry the token had
+		return ErrTokenRevoked
+	}
+
+	expire := now.Add(expiresIn).UTC()
+	t.expireAt = expire
+	members[tokenString] = expireScore(expire)
+	return nil
+}
+
+func (m *memoryBackend) extendAllUserTokens(ctx context.Context, userId string, expiresIn time.Duration) error {
+	if err := checkExpiry(expiresIn); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.opts.now()
+	m.cleanupUserTokenLocked(userId, now)
+	for tokenString := range m.userTokens[userId] {
+		err := m.refreshUserTokenLocked(userId, tokenString, expiresIn, now)
+		if err != nil && !errors.Is(err, ErrTokenRevoked) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *memoryBackend) reconcileUserToken(ctx context.Context, userId string, tokenString string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	members := m.userTokens[userId]
+	score, ok := members[tokenString]
+	if !ok {
+		return ErrTokenNotFound
+	}
+	t, ok := m.getToken(tokenString, m.opts.now())
+	if !ok {
+		delete(members, tokenString)
+		return ErrTokenNotFound
+	}
+	if t.expireAt.IsZero() {
+		t.expireAt = time.Unix(score, 0).UTC()
+		return nil
+	}
+	members[tokenString] = expireScore(t.expireAt)
+	return nil
+}
+
+func (m *memoryBackend) dumpUserTokens(ctx context.Context, userId string) ([]UserTokenDebug, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	now := m.opts.now()
+	members := m.userTokens[userId]
+	dump := make([]UserTokenDebug, 0, len(members))
+	for _, token := range m.sortedUserTokens(userId) {
+		entry := UserTokenDebug{
+			TokenString: token,
+			Score:       members[token],
+			TTL:         -2,
+		}
+		if t, ok := m.tokens[token]; ok && !t.expired(now) {
+			entry.Exists = true
+			entry.TTL = -1
+			if !t.expireAt.IsZero() {
+				entry.TTL = t.expireAt.Sub(now)
+			}
+		}
+		dump = append(dump, entry)
+	}
+	return dump, nil
+}
+
+func (m *memoryBackend) rotateUserToken(ctx context.Context, userId string, oldToken string, genToken func() (string, error), value interface{}, expiresIn time.Duration) (string, error) {
+	if err := checkExpiry(expiresIn); err != nil {
+		return "", err
+	}
+	v, err := m.opts.encodeValue(value)
+	if err != nil {
+		return "", err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, err = m.loadUserTokenLocked(userId, oldToken, m.opts.now())
+	if err != nil {
+		return "", err
+	}
+	var expire time.Time
+	token, err := m.opts.generateToken(ctx, genToken, func(token string) (bool, error) {
+		now := m.opts.now()
+		expire = now.Add(expiresIn).UTC()
+		return m.saveTokenLocked(token, v, expire.Sub(now), now), nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	m.tokens[token].userId = userId
+	members := m.userTokens[userId]
+	delete(members, oldToken)
+	delete(m.tokens, oldToken)
+	members[token] = expireScore(expire)
+	return token, nil
+}
+
+func (m *memoryBackend) deleteAllUserTokens(ctx context.Context, userIds ...string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, userId := range userIds {
+		for token := range m.userTokens[userId] {
+			delete(m.tokens, token)
+		}
+		delete(m.userTokens, userId)
+	}
+	return nil
+}
+
+func (m *memoryBackend) moveUserTokens(ctx context.Context, fromUserId string, toUserId string) error {
+	if fromUserId == toUserId {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for token, score := range m.userTokens[fromUserId] {
+		to := m.userTokens[toUserId]
+		if to == nil {
+			to = make(map[string]int64)
+			m.userTokens[toUserId] = to
+		}
+		if current, ok := to[token]; !ok || current < score {
+			to[token] = score
+		}
+		if t, ok := m.tokens[token]; ok && t.userId == fromUserId {
+			t.userId = toUserId
+		}
+	}
+	delete(m.userTokens, fromUserId)
+	return nil
+}
+
+func (m *memoryBackend) userTokenExists(ctx context.Context, userId string, tokenString string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.opts.now()
+	m.cleanupUserTokenLocked(userId, now)
+	if _, ok := m.userTokens[userId][tokenString]; !ok {
+		return false, nil
+	}
+	_, ok := m.getToken(tokenString, now)
+	return ok && !m.isRevoked(tokenString, now), nil
+}
+
+func (m *memoryBackend) scanUserIds(ctx context.Context, fn func(userId string) error) error {
+	m.mu.RLock()
+	userIds := make([]string, 0, len(m.userTokens))
+	for userId := range m.userTokens {
+		userIds = append(userIds, userId)
+	}
+	m.mu.RUnlock()
+
+	for _, userId := range userIds {
+		err := fn(userId)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *memoryBackend) iterateUserTokens(ctx context.Context, userId string, fn func(*bUserTokenInfo) error) error {
+	userTokenList, err := m.loadUserTokenList(ctx, userId)
+	if err != nil {
+		return err
+	}
+	for _, userToken := range userTokenList {
+		err = fn(userToken)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *memoryBackend) userIdForToken(ctx context.Context, tokenString string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t, ok := m.getToken(tokenString, m.opts.now())
+	if !ok || t.userId == "" {
+		return "", ErrTokenNotFound
+	}
+	if _, ok := m.userTokens[t.userId][tokenString]; !ok {
+		return "", ErrTokenNotFound
+	}
+	return t.userId, nil
+}
+
+func (m *memoryBackend) watchRevocations(ctx context.Context, fn func(token string)) error {
+	return ErrNotSupported
+}
+
+func (m *memoryBackend) ping(ctx context.Context) error {
+	return nil
+}
+
+func (m *memoryBackend) close() error {
+	return nil
+}
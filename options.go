@@ -1,7 +1,11 @@
 package tokenmanager
 
 import (
+	"context"
 	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel/trace"
+	"log/slog"
+	"math/rand/v2"
 	"time"
 )
 
@@ -10,6 +14,45 @@ type options struct {
 	refreshTokenExpire time.Duration
 	backend            backend
 	tokenCreator       tokenCreator
+	tokenPrefix        string
+	userTokenPrefix    string
+	maxUserTokens      int
+	slidingExpiration  time.Duration
+	tokenHash          func(string) string
+	maxTokenAttempts   int
+	codec              codec
+	tracer             trace.Tracer
+	traceUserIDHash    bool
+	observer           Observer
+	defaultExpire      time.Duration
+	lazyCleanup        bool
+	cleanupSampling    float64
+	scanCount          int64
+	storageLayout      StorageLayout
+	clock              Clock
+	ownerIndex         bool
+	retryAttempts      int
+	retryBackoff       time.Duration
+	collisionPolicy    CollisionPolicy
+	namespace          string
+	listOrder          ListOrder
+	maxValueSize       int
+	issueRateMax       int
+	issueRateWindow    time.Duration
+	logger             *slog.Logger
+	readClient         *redis.Client
+	keyTagging         bool
+	defaultTimeout     time.Duration
+	payloadVersion     int
+	pipelineBatchSize  int
+	transactionMode    TransactionMode
+	loadValidator      func(ctx context.Context, token string, value string) error
+	stats              *stats
+	clientFactory      func() (*redis.Client, error)
+	strictConsistency  bool
+	revocationChannel  string
+	localCacheSize     int
+	localCacheTTL      time.Duration
 }
 
 var (
@@ -17,11 +60,51 @@ var (
 		accessTokenExpire:  time.Hour * 6,
 		refreshTokenExpire: time.Hour * 24 * 15,
 		tokenCreator:       &opaqueTokenCreator{},
+		tokenPrefix:        "TOKENS",
+		userTokenPrefix:    "USER_TOKENS",
+		maxTokenAttempts:   10,
+		codec:              jsonCodec,
+		observer:           nopObserver{},
+		scanCount:          100,
+		pipelineBatchSize:  500,
+		cleanupSampling:    1,
+		clock:              realClock{},
 	}
 )
 
 type Option func(*options)
 
+// ListOrder is the order of user token listings
+type ListOrder int
+
+const (
+	Ascending ListOrder = iota // soonest expiring first
+	Descending
+)
+
+// TransactionMode is how the redis backend saves a token and its user token entry together
+type TransactionMode int
+
+const (
+	TransactionLua        TransactionMode = iota // one script
+	TransactionOptimistic                        // WATCH and MULTI, for servers disallowing scripts
+	TransactionNone                              // separate commands, the token is removed again on failure
+)
+
+// zRangeArgs ranges the user token key by score in the listing order, limited to
+// count members from offset unless both are 0.
+func (o *options) zRangeArgs(key string, offset, count int64) redis.ZRangeArgs {
+	return redis.ZRangeArgs{
+		Key:     key,
+		Start:   "-inf",
+		Stop:    "+inf",
+		ByScore: true,
+		Rev:     o.listOrder == Descending, // go-redis swaps Start and Stop for REV
+		Offset:  offset,
+		Count:   count,
+	}
+}
+
 func WithAccessTokenExpire(expire time.Duration) Option {
 	return func(o *options) {
 		o.accessTokenExpire = expire
@@ -34,6 +117,13 @@ func WithRefreshTokenExpire(expire time.Duration) Option {
 	}
 }
 
+// WithDefaultExpiry sets the expiry of tokens created without one
+func WithDefaultExpiry(expire time.Duration) Option {
+	return func(o *options) {
+		o.defaultExpire = expire
+	}
+}
+
 func WithOpaqueToken() Option {
 	return func(o *options) {
 		o.tokenCreator = &opaqueTokenCreator{}
@@ -41,6 +131,15 @@ func WithOpaqueToken() Option {
 	}
 }
 
+// WithDefaultTokenGenerator generates opaque tokens of length random bytes from
+// crypto/rand, base64url encoded. Backends use it whenever no generator is passed.
+// Lengths under 16 bytes are raised to 16, 48 is the default.
+func WithDefaultTokenGenerator(length int) Option {
+	return func(o *options) {
+		o.tokenCreator = &opaqueTokenCreator{length: max(length, minTokenBytes)}
+	}
+}
+
 func WithJWTToken() Option {
 	return func(o *options) {
 		o.tokenCreator = &jwtTokenCreator{}
@@ -51,16 +150,374 @@ func WithJWTToken() Option {
 func WithRedisBackend(client *redis.Client) Option {
 	return func(o *options) {
 		o.backend = &redisBackend{
+			opts:   defaultOptions,
 			client: client,
 		}
 	}
 }
 
+// WithTokenPrefix sets the key prefix of token values, "TOKENS" by default
+func WithTokenPrefix(prefix string) Option {
+	return func(o *options) {
+		o.tokenPrefix = prefix
+	}
+}
+
+// WithNamespace puts ns in front of every key, e.g. "tenantA:TOKENS:...", to keep
+// tenants sharing a redis apart. The empty namespace leaves keys as they are.
+func WithNamespace(ns string) Option {
+	return func(o *options) {
+		o.namespace = ns
+	}
+}
+
+// WithUserTokenPrefix sets the key prefix of user token sets, "USER_TOKENS" by default
+func WithUserTokenPrefix(prefix string) Option {
+	return func(o *options) {
+		o.userTokenPrefix = prefix
+	}
+}
+
+// WithMaxUserTokens limits the active tokens of a user to max, evicting the
+// oldest ones on save. Zero means no limit.
+func WithMaxUserTokens(max int) Option {
+	return func(o *options) {
+		o.maxUserTokens = max
+	}
+}
+
+// WithIssueRateLimit caps the tokens a user can create to max per window,
+// failing further creations with ErrRateLimited until the window is over.
+func WithIssueRateLimit(max int, window time.Duration) Option {
+	return func(o *options) {
+		o.issueRateMax = max
+		o.issueRateWindow = window
+	}
+}
+
+// WithSlidingExpiration extends a user token by expire every time it is loaded
+func WithSlidingExpiration(expire time.Duration) Option {
+	return func(o *options) {
+		o.slidingExpiration = expire
+	}
+}
+
+// WithTokenHashing stores tokens under hashFn(token) instead of the token itself,
+// so the keyspace doesn't reveal live tokens. A nil hashFn uses SHA-256.
+func WithTokenHashing(hashFn func(string) string) Option {
+	return func(o *options) {
+		if hashFn == nil {
+			hashFn = sha256Hex
+		}
+		o.tokenHash = hashFn
+	}
+}
+
+// WithMaxTokenAttempts bounds how many colliding tokens are generated on save
+// before giving up with ErrTokenGenerationExhausted, 10 by default.
+func WithMaxTokenAttempts(attempts int) Option {
+	return func(o *options) {
+		o.maxTokenAttempts = attempts
+	}
+}
+
+// WithCollisionPolicy sets what happens when a generated token collides with a
+// stored one, by default another token is generated
+func WithCollisionPolicy(policy CollisionPolicy) Option {
+	return func(o *options) {
+		o.collisionPolicy = policy
+	}
+}
+
+// WithMaxValueSize rejects token values longer than n bytes once encoded with
+// ErrValueTooLarge, before anything is written. Zero means no limit.
+func WithMaxValueSize(n int) Option {
+	return func(o *options) {
+		o.maxValueSize = n
+	}
+}
+
+// WithCodec sets how token values are serialized, JSON by default
+func WithCodec(encode func(any) ([]byte, error), decode func([]byte, any) error) Option {
+	return func(o *options) {
+		o.codec = codec{
+			encode: encode,
+			decode: decode,
+		}
+	}
+}
+
+// WithPayloadVersion prefixes the token payloads written from now on with schema
+// version v, from 1 to 255. Payloads of other versions are read through their
+// RegisterPayloadVersion decoder, those written before versioning as they are.
+func WithPayloadVersion(v int) Option {
+	return func(o *options) {
+		o.payloadVersion = v
+	}
+}
+
+// WithTracer records a span around every backend operation
+func WithTracer(tracer trace.Tracer) Option {
+	return func(o *options) {
+		o.tracer = tracer
+	}
+}
+
+// WithTraceUserIDHashing records user ids hashed with SHA-256 in spans
+func WithTraceUserIDHashing() Option {
+	return func(o *options) {
+		o.traceUserIDHash = true
+	}
+}
+
+// WithLogger logs the errors of best effort steps, like cleanups and rollbacks,
+// at warn level. They are ignored without a logger.
+func WithLogger(logger *slog.Logger) Option {
+	return func(o *options) {
+		o.logger = logger
+	}
+}
+
+// WithObserver reports the name, latency and error of every backend operation to observer
+func WithObserver(observer Observer) Option {
+	return func(o *options) {
+		if observer == nil {
+			observer = nopObserver{}
+		}
+		o.observer = observer
+	}
+}
+
+// WithLazyCleanup skips the user token sweep when loading a single user token.
+// Membership and the token value are still checked, expired entries are left
+// for Cleanup or the next save.
+func WithLazyCleanup() Option {
+	return func(o *options) {
+		o.lazyCleanup = true
+	}
+}
+
+// WithStrictConsistency makes the redis backend fail loading a user token whose
+// value is gone before its expiry with ErrOrphanedToken, instead of skipping and
+// removing it, to debug data integrity issues. The sweeps ahead of loads and saves,
+// which remove such tokens too, are skipped; Cleanup still runs them.
+func WithStrictConsistency(strict bool) Option {
+	return func(o *options) {
+		o.strictConsistency = strict
+	}
+}
+
+// WithCleanupSampling runs the user token sweep on the given fraction of single
+// user token loads, the rest rely on the expiry checks of the load. 1, the
+// default, sweeps on every load, 0 never does, like WithLazyCleanup.
+func WithCleanupSampling(rate float64) Option {
+	return func(o *options) {
+		o.cleanupSampling = rate
+	}
+}
+
+// withDefaultTimeout bounds ctx by the WithDefaultTimeout when it has no deadline
+func (o *options) withDefaultTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok || o.defaultTimeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, o.defaultTimeout)
+}
+
+// cleanupOnLoad reports whether this single user token load sweeps the user tokens
+func (o *options) cleanupOnLoad() bool {
+	if o.lazyCleanup || o.cleanupSampling <= 0 {
+		return false
+	}
+	return o.cleanupSampling >= 1 || rand.Float64() < o.cleanupSampling
+}
+
+// WithScanCount sets the COUNT hint of SCAN and ZSCAN pages, 100 by default
+func WithScanCount(count int64) Option {
+	return func(o *options) {
+		o.scanCount = count
+	}
+}
+
+// WithStorageLayout selects how the redis backends store tokens, Separate by default.
+// Hashed needs far fewer keys, but tokens can only be reached through their user:
+// Validate, GetTokenData, RevokeToken and other lookups by token alone return
+// ErrNotSupported. The keys of a user must share a slot, so it doesn't suit NewClusterBackend.
+func WithStorageLayout(layout StorageLayout) Option {
+	return func(o *options) {
+		o.storageLayout = layout
+	}
+}
+
+// WithClock sets the source of the current time, the system clock by default.
+// Expiry enforced by redis itself still follows the redis clock.
+func WithClock(clock Clock) Option {
+	return func(o *options) {
+		if clock == nil {
+			clock = realClock{}
+		}
+		o.clock = clock
+	}
+}
+
+// WithTokenOwnerIndex keeps a TOKEN_OWNERS key per user token, so the owner of a
+// token can be found from the token alone with UserIDForToken.
+func WithTokenOwnerIndex() Option {
+	return func(o *options) {
+		o.ownerIndex = true
+	}
+}
+
+// WithPipelineBatchSize caps the pipelines and multi key deletes of bulk and
+// maintenance operations at n commands or keys, sending them in batches. It is
+// 500 by default, 0 sends everything at once.
+func WithPipelineBatchSize(n int) Option {
+	return func(o *options) {
+		o.pipelineBatchSize = n
+	}
+}
+
+// WithDefaultTimeout bounds each backend operation to d when the caller's context
+// has no deadline, so a stalled store can't hang it. A deadline is never shortened.
+// Walks calling back for every user or token, like Vacuum, aren't bounded as a
+// whole; each page of user ids and each operation fn runs is.
+func WithDefaultTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.defaultTimeout = d
+	}
+}
+
+// WithKeyTagging puts every key of a user token behind the {userId} hash tag, so a
+// Redis Cluster keeps them in one slot and the atomic cleanup and rotation scripts
+// can run. It turns WithTokenOwnerIndex on, which operations given the token alone
+// look the user up in first. Tokens saved under another layout aren't found, and
+// tokens can't move to another user, whose keys live in another slot.
+func WithKeyTagging() Option {
+	return func(o *options) {
+		o.keyTagging = true
+		o.ownerIndex = true
+	}
+}
+
+// WithRetry tries read operations up to attempts times on connection failures,
+// waiting backoff before the first retry and doubling it after each.
+// Misses, error replies and a done context are never retried.
+func WithRetry(attempts int, backoff time.Duration) Option {
+	return func(o *options) {
+		o.retryAttempts = attempts
+		o.retryBackoff = backoff
+	}
+}
+
+// WithListOrder sets the order user tokens are listed in, by expiry. Tokens sharing
+// a lifetime expire in the order they were created, so Descending lists the newest first.
+func WithListOrder(order ListOrder) Option {
+	return func(o *options) {
+		o.listOrder = order
+	}
+}
+
+// WithTransactionMode sets how the redis backend saves user tokens, TransactionLua
+// by default. Under TransactionOptimistic a transaction losing a race counts as a
+// collision and retries with another token, within WithMaxTokenAttempts.
+// Other operations keep their scripts.
+func WithTransactionMode(mode TransactionMode) Option {
+	return func(o *options) {
+		o.transactionMode = mode
+	}
+}
+
+// WithReadClient sends the read only commands of the redis backend, loading tokens
+// and listing user tokens, to client, e.g. a replica, instead of the primary.
+// Cleanups and every other write still go to the primary. A replica lags behind,
+// so a token may not load right after it was created.
+func WithReadClient(client *redis.Client) Option {
+	return func(o *options) {
+		o.readClient = client
+	}
+}
+
+// WithRevocationChannel publishes every token revoked through the redis backend on
+// the pub/sub channel, so the other instances learn of it with WatchRevocations,
+// e.g. to drop the token from a local cache. Publishing is best effort.
+func WithRevocationChannel(channel string) Option {
+	return func(o *options) {
+		o.revocationChannel = channel
+	}
+}
+
+// WithLocalCache keeps up to size loaded tokens in process memory for ttl, so
+// LoadToken doesn't reach the backend on every request. An entry never outlives
+// its token, and is dropped when this instance revokes or deletes the token.
+// Revocations by other instances, and of the partner of a revoked token pair, only
+// reach the cache with WithRevocationChannel, until then such a token may load for
+// up to ttl.
+func WithLocalCache(size int, ttl time.Duration) Option {
+	return func(o *options) {
+		o.localCacheSize = size
+		o.localCacheTTL = ttl
+	}
+}
+
+// WithLoadValidator runs fn on every token loaded, by token or as a user token,
+// with its stored value. A token fn returns an error for fails to load with it,
+// e.g. one missing from an external allowlist, and so does a list holding it.
+func WithLoadValidator(fn func(ctx context.Context, token string, value string) error) Option {
+	return func(o *options) {
+		o.loadValidator = fn
+	}
+}
+
+// WithClientFactory runs the redis backend on clients from factory, the first
+// created on first use. A client that is closed or can't connect is replaced with
+// a new one, and the call retried once if it can be repeated safely; saving user
+// tokens and walks with a callback fail instead. Following WithRedisBackend, its
+// client is used until replaced. Closing the manager closes the current client.
+func WithClientFactory(factory func() (*redis.Client, error)) Option {
+	return func(o *options) {
+		o.clientFactory = factory
+		if _, ok := o.backend.(*redisBackend); !ok {
+			o.backend = &redisBackend{opts: defaultOptions}
+		}
+	}
+}
+
+func WithMemoryBackend() Option {
+	return func(o *options) {
+		o.backend = newMemoryBackend()
+	}
+}
+
+func WithBackend(b Backend) Option {
+	return func(o *options) {
+		o.backend = b
+	}
+}
+
 func apply(opts []Option) *options {
 	optCopy := &options{}
 	*optCopy = *defaultOptions
 	for _, o := range opts {
 		o(optCopy)
 	}
+	if optCopy.backend != nil {
+		if rb, ok := optCopy.backend.(*redisBackend); ok && optCopy.clientFactory != nil {
+			optCopy.backend = &reconnectBackend{template: rb, hashed: optCopy.storageLayout == Hashed}
+		} else if ok && optCopy.storageLayout == Hashed {
+			optCopy.backend = &hashedRedisBackend{r: rb}
+		}
+		if optCopy.retryAttempts > 1 {
+			optCopy.backend = &retryBackend{backend: optCopy.backend}
+		}
+		if optCopy.localCacheSize > 0 && optCopy.localCacheTTL > 0 {
+			optCopy.backend = &cachedBackend{backend: optCopy.backend}
+		}
+		if optCopy.loadValidator != nil {
+			optCopy.backend = &validatedBackend{backend: optCopy.backend}
+		}
+		optCopy.stats = &stats{}
+		optCopy.backend = &instrumentedBackend{next: optCopy.backend}
+		optCopy.backend.bind(optCopy)
+	}
 	return optCopy
 }
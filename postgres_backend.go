@@ -0,0 +1,993 @@
+package tokenmanager
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"github.com/redis/go-redis/v9"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PostgresSchema creates the tables of NewPostgresBackend, to be run by the
+// migrations of the service. A row with a NULL user_id is a token saved on its own.
+const PostgresSchema = `
+CREATE TABLE IF NOT EXISTS tokens (
+	token        TEXT PRIMARY KEY,
+	user_id      TEXT,
+	value        TEXT NOT NULL,
+	expires_at   TIMESTAMPTZ,
+	metadata     TEXT,
+	revoked      BOOLEAN NOT NULL DEFAULT FALSE,
+	soft_revoked BOOLEAN NOT NULL DEFAULT FALSE,
+	unconfirmed  BOOLEAN NOT NULL DEFAULT FALSE,
+	partner      TEXT,
+	created_at   TIMESTAMPTZ
+);
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ;
+CREATE INDEX IF NOT EXISTS tokens_user_id_expires_at ON tokens (user_id, expires_at);
+CREATE TABLE IF NOT EXISTS token_issue_rates (
+	user_id  TEXT PRIMARY KEY,
+	count    INTEGER NOT NULL,
+	reset_at TIMESTAMPTZ NOT NULL
+);
+`
+
+// postgresBackend keeps every token as a row of the tokens table, the user index
+// being the user_id column, so a user token can't dangle like a redis member.
+// Times come from the configured clock rather than now() of the server.
+type postgresBackend struct {
+	opts *options
+	db   *sql.DB
+}
+
+// NewPostgresBackend returns a backend storing tokens in the tables of
+// PostgresSchema, for tokens that must survive a redis flush. db is opened with
+// any postgres driver. Closing the manager closes db.
+func NewPostgresBackend(db *sql.DB) Backend {
+	return &postgresBackend{
+		opts: defaultOptions,
+		db:   db,
+	}
+}
+
+// pgQuerier is what both *sql.DB and *sql.Tx run statements with
+type pgQuerier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+const (
+	pgInsertLive = `INSERT INTO tokens (token, user_id, value, expires_at, metadata, unconfirmed, created_at)
+VALUES ($1, $2, $3, $4, $5, $6, $7)
+ON CONFLICT (token) DO UPDATE SET
+	user_id = EXCLUDED.user_id, value = EXCLUDED.value, expires_at = EXCLUDED.expires_at,
+	metadata = EXCLUDED.metadata, unconfirmed = EXCLUDED.unconfirmed, revoked = FALSE, soft_revoked = FALSE,
+	created_at = EXCLUDED.created_at
+WHERE tokens.expires_at IS NOT NULL AND tokens.expires_at <= $7
+RETURNING token`
+	pgSelectUserToken = `SELECT token, value, expires_at, metadata, revoked, soft_revoked, unconfirmed, created_at FROM tokens`
+)
+
+// pgRow is a row of the tokens table
+type pgRow struct {
+	token       string
+	value       string
+	expiresAt   sql.NullTime
+	metadata    sql.NullString
+	revoked     bool
+	softRevoked bool
+	unconfirmed bool
+	createdAt   sql.NullTime
+}
+
+func (row *pgRow) userToken(opts *options) (*bUserTokenInfo, error) {
+	userToken := &bUserTokenInfo{
+		TokenString: row.token,
+		Fingerprint: Fingerprint(row.token),
+		TokenData:   row.value,
+		ExpiresAt:   time.Unix(expireScore(row.expiresAt.Time), 0).UTC(),
+		opts:        opts,
+	}
+	if row.createdAt.Valid {
+		userToken.CreatedAt = row.createdAt.Time.UTC()
+	}
+	if row.metadata.Valid {
+		if err := json.Unmarshal([]byte(row.metadata.String), &userToken.Metadata); err != nil {
+			return nil, err
+		}
+	}
+	return userToken, nil
+}
+
+func (p *postgresBackend) bind(opts *options) {
+	p.opts = opts
+}
+
+// tx runs fn in a transaction, committed when fn succeeds
+func (p *postgresBackend) tx(ctx context.Context, userId string, fn func(tx *sql.Tx) error) error {
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		if rbErr := tx.Rollback(); !errors.Is(rbErr, sql.ErrTxDone) {
+			p.opts.warn(ctx, "rollback", userId, rbErr)
+		}
+		return err
+	}
+	return tx.Commit()
+}
+
+func pgMetadata(metadata map[string]string) (sql.NullString, error) {
+	if len(metadata) == 0 {
+		return sql.NullString{}, nil
+	}
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		return sql.NullString{}, err
+	}
+	return sql.NullString{String: string(data), Valid: true}, nil
+}
+
+func pgExpiresAt(expireAt time.Time) sql.NullTime {
+	return sql.NullTime{Time: expireAt, Valid: !expireAt.IsZero()}
+}
+
+func pgUserId(userId string) sql.NullString {
+	return sql.NullString{String: userId, Valid: userId != ""}
+}
+
+// insertToken stores the token unless a live one exists, like SET NX. An expired
+// row is still there until cleaned up, so it is overwritten instead of conflicting.
+func (p *postgresBackend) insertToken(ctx context.Context, q pgQuerier, token string, userId string, value string, expireAt time.Time, metadata map[string]string, unconfirmed bool, now time.Time) (bool, error) {
+	meta, err := pgMetadata(metadata)
+	if err != nil {
+		return false, err
+	}
+	var inserted string
+	err = q.QueryRowContext(ctx, pgInsertLive, token, pgUserId(userId), value, pgExpiresAt(expireAt), meta, unconfirmed, now).Scan(&inserted)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (p *postgresBackend) checkIssueRate(ctx context.Context, q pgQuerier, userId string, now time.Time) error {
+	if p.opts.issueRateMax <= 0 {
+		return nil
+	}
+	var count int
+	err := q.QueryRowContext(ctx, `INSERT INTO token_issue_rates (user_id, count, reset_at) VALUES ($1, 1, $3)
+ON CONFLICT (user_id) DO UPDATE SET
+	count = CASE WHEN token_issue_rates.reset_at <= $2 THEN 1 ELSE token_issue_rates.count + 1 END,
+	reset_at = CASE WHEN token_issue_rates.reset_at <= $2 THEN $3 ELSE token_issue_rates.reset_at END
+RETURNING count`, userId, now, now.Add(p.opts.issueRateWindow)).Scan(&count)
+	if err != nil {
+		return err
+	}
+	if count > p.opts.issueRateMax {
+		return ErrRateLimited
+	}
+	return nil
+}
+
+func (p *postgresBackend) cleanup(ctx context.Context, q pgQuerier, userId string, now time.Time) (int64, error) {
+	res, err := q.ExecContext(ctx, `DELETE FROM tokens WHERE user_id = $1 AND expires_at <= $2`, userId, now)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// trim keeps the newest WithMaxUserTokens tokens of the user
+func (p *postgresBackend) trim(ctx context.Context, q pgQuerier, userId string) error {
+	if p.opts.maxUserTokens <= 0 {
+		return nil
+	}
+	_, err := q.ExecContext(ctx, `DELETE FROM tokens WHERE user_id = $1 AND token IN (
+	SELECT token FROM tokens WHERE user_id = $1 ORDER BY expires_at DESC, token DESC OFFSET $2
+)`, userId, p.opts.maxUserTokens)
+	return err
+}
+
+// saveUserTokenTx generates and stores a token of the user
+func (p *postgresBackend) saveUserTokenTx(ctx context.Context, tx *sql.Tx, userId string, genToken func() (string, error), value string, expiresIn time.Duration, metadata map[string]string, unconfirmed bool, now time.Time) (string, error) {
+	expire := now.Add(expiresIn).UTC()
+	token, err := p.opts.generateToken(ctx, genToken, func(token string) (bool, error) {
+		return p.insertToken(ctx, tx, token, userId, value, expire, metadata, unconfirmed, now)
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, p.trim(ctx, tx, userId)
+}
+
+func (p *postgresBackend) selectUserTokens(ctx context.Context, q pgQuerier, query string, args ...any) ([]*pgRow, error) {
+	rows, err := q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := make([]*pgRow, 0)
+	for rows.Next() {
+		row := &pgRow{}
+		if err := rows.Scan(&row.token, &row.value, &row.expiresAt, &row.metadata, &row.revoked, &row.softRevoked, &row.unconfirmed, &row.createdAt); err != nil {
+			return nil, err
+		}
+		list = append(list, row)
+	}
+	return list, rows.Err()
+}
+
+// selectUserToken returns the live row of a token of the user
+func (p *postgresBackend) selectUserToken(ctx context.Context, q pgQuerier, userId string, tokenString string, now time.Time) (*pgRow, error) {
+	rows, err := p.selectUserTokens(ctx, q, pgSelectUserToken+` WHERE user_id = $1 AND token = $2 AND `+pgLiveAt(3), userId, tokenString, now)
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, ErrTokenNotFound
+	}
+	return rows[0], nil
+}
+
+// pgLiveAt is the condition of a row not expired at the time bound to $arg
+func pgLiveAt(arg int) string {
+	return `(expires_at IS NULL OR expires_at > $` + strconv.Itoa(arg) + `)`
+}
+
+// pgPlaceholders lists n placeholders from $from on, for an IN clause
+func pgPlaceholders(from, n int) string {
+	placeholders := make([]string, n)
+	for i := range placeholders {
+		placeholders[i] = "$" + strconv.Itoa(from+i)
+	}
+	return strings.Join(placeholders, ", ")
+}
+
+func (p *postgresBackend) listOrder() string {
+	if p.opts.listOrder == Descending {
+		return ` ORDER BY expires_at DESC, token DESC`
+	}
+	return ` ORDER BY expires_at, token`
+}
+
+// userTokens returns the user tokens of rows, skipping revoked ones
+func userTokens(opts *options, rows []*pgRow) ([]*bUserTokenInfo, error) {
+	userTokenList := make([]*bUserTokenInfo, 0, len(rows))
+	for _, row := range rows {
+		if row.revoked {
+			continue
+		}
+		userToken, err := row.userToken(opts)
+		if err != nil {
+			return nil, err
+		}
+		userTokenList = append(userTokenList, userToken)
+	}
+	return userTokenList, nil
+}
+
+func (p *postgresBackend) saveToken(ctx context.Context, token string, value interface{}, expire time.Duration) (bool, error) {
+	if expire < 0 {
+		return false, ErrInvalidExpiry
+	}
+	v, err := p.opts.encodeValue(value)
+	if err != nil {
+		return false, err
+	}
+	now := p.opts.now()
+	var expireAt time.Time
+	if expire > 0 {
+		expireAt = now.Add(expire).UTC()
+	}
+	return p.insertToken(ctx, p.db, token, "", v, expireAt, nil, false, now)
+}
+
+func (p *postgresBackend) loadToken(ctx context.Context, token string) (string, error) {
+	value, _, err := p.loadTokenWithTTL(ctx, token)
+	return value, err
+}
+
+func (p *postgresBackend) loadTokenWithTTL(ctx context.Context, token string) (string, time.Duration, error) {
+	now := p.opts.now()
+	rows, err := p.selectUserTokens(ctx, p.db, pgSelectUserToken+` WHERE token = $1 AND `+pgLiveAt(2), token, now)
+	if err != nil {
+		return "", 0, err
+	}
+	if len(rows) == 0 {
+		return "", 0, ErrTokenNotFound
+	}
+	row := rows[0]
+	switch {
+	case row.revoked:
+		return "", 0, ErrTokenRevoked
+	case row.unconfirmed:
+		return "", 0, ErrTokenUnconfirmed
+	}
+	var ttl time.Duration
+	if row.expiresAt.Valid {
+		ttl = row.expiresAt.Time.Sub(now)
+	}
+	return row.value, ttl, nil
+}
+
+func (p *postgresBackend) deleteToken(ctx context.Context, tokens ...string) error {
+	return p.tx(ctx, "", func(tx *sql.Tx) error {
+		for _, token := range tokens {
+			if _, err := tx.ExecContext(ctx, `DELETE FROM tokens WHERE token = $1`, token); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (p *postgresBackend) deleteTokenIfValue(ctx context.Context, token string, expected string) (bool, error) {
+	res, err := p.db.ExecContext(ctx, `DELETE FROM tokens WHERE token = $1 AND value = $2 AND `+pgLiveAt(3), token, expected, p.opts.now())
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n != 0, err
+}
+
+func (p *postgresBackend) updateTokenValue(ctx context.Context, token string, value interface{}) error {
+	v, err := p.opts.encodeValue(value)
+	if err != nil {
+		return err
+	}
+	res, err := p.db.ExecContext(ctx, `UPDATE tokens SET value = $1 WHERE token = $2 AND `+pgLiveAt(3), v, token, p.opts.now())
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err == nil && n == 0 {
+		return ErrTokenNotFound
+	}
+	return err
+}
+
+func (p *postgresBackend) updateTokenValueIfActive(ctx context.Context, userId string, token string, value interface{}) error {
+	v, err := p.opts.encodeValue(value)
+	if err != nil {
+		return err
+	}
+	now := p.opts.now()
+	res, err := p.db.ExecContext(ctx, `UPDATE tokens SET value = $1 WHERE user_id = $2 AND token = $3 AND NOT revoked AND NOT soft_revoked AND `+pgLiveAt(4), v, userId, token, now)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil || n != 0 {
+		return err
+	}
+	// nothing updated, tell a revoked token from a missing one
+	row, err := p.selectUserToken(ctx, p.db, userId, token, now)
+	if err != nil {
+		return err
+	}
+	if row.revoked || row.softRevoked {
+		return ErrTokenRevoked
+	}
+	return ErrTokenNotFound
+}
+
+func (p *postgresBackend) isTokenExist(ctx context.Context, token string) (bool, error) {
+	var ok bool
+	err := p.db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM tokens WHERE token = $1 AND `+pgLiveAt(2)+`)`, token, p.opts.now()).Scan(&ok)
+	return ok, err
+}
+
+func (p *postgresBackend) areTokensExist(ctx context.Context, tokens ...string) (map[string]bool, error) {
+	exists := make(map[string]bool, len(tokens))
+	if len(tokens) == 0 {
+		return exists, nil
+	}
+	args := []interface{}{p.opts.now()}
+	for _, token := range tokens {
+		exists[token] = false
+		args = append(args, token)
+	}
+	rows, err := p.db.QueryContext(ctx, `SELECT token FROM tokens WHERE token IN (`+pgPlaceholders(2, len(tokens))+`) AND `+pgLiveAt(1), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var token string
+		if err := rows.Scan(&token); err != nil {
+			return nil, err
+		}
+		exists[token] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return exists, nil
+}
+
+func (p *postgresBackend) revokeToken(ctx context.Context, token string) error {
+	res, err := p.db.ExecContext(ctx, `UPDATE tokens SET revoked = TRUE, soft_revoked = FALSE
+WHERE (token = $1 OR token = (SELECT partner FROM tokens WHERE token = $1 AND `+pgLiveAt(2)+`)) AND `+pgLiveAt(2), token, p.opts.now())
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err == nil && n == 0 {
+		return ErrTokenNotFound
+	}
+	return err
+}
+
+// softRevokeUserToken leaves the rows of the token and its partner until grace
+// from now, when cleanups delete them
+func (p *postgresBackend) softRevokeUserToken(ctx context.Context, userId string, token string, grace time.Duration) error {
+	now := p.opts.now()
+	res, err := p.db.ExecContext(ctx, `UPDATE tokens SET revoked = TRUE, soft_revoked = TRUE, expires_at = LEAST(expires_at, $3)
+WHERE user_id = $1 AND (token = $2 OR token = (SELECT partner FROM tokens WHERE user_id = $1 AND token = $2 AND `+pgLiveAt(4)+`)) AND `+pgLiveAt(4),
+		userId, token, now.Add(grace).UTC(), now)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err == nil && n == 0 {
+		return ErrTokenNotFound
+	}
+	return err
+}
+
+func (p *postgresBackend) cleanupUserToken(ctx context.Context, userId string) (int64, error) {
+	return p.cleanup(ctx, p.db, userId, p.opts.now())
+}
+
+// previewCleanupUserToken returns the expired tokens, a row can't dangle
+func (p *postgresBackend) previewCleanupUserToken(ctx context.Context, userId string) ([]string, error) {
+	rows, err := p.db.QueryContext(ctx, `SELECT token FROM tokens WHERE user_id = $1 AND expires_at <= $2 ORDER BY expires_at, token`, userId, p.opts.now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	preview := make([]string, 0)
+	for rows.Next() {
+		var token string
+		if err := rows.Scan(&token); err != nil {
+			return nil, err
+		}
+		preview = append(preview, token)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return preview, nil
+}
+
+func (p *postgresBackend) saveUserToken(ctx context.Context, userId string, genToken func() (string, error), value interface{}, expiresIn time.Duration, metadata map[string]string) (string, error) {
+	return p.saveNewUserToken(ctx, userId, genToken, value, expiresIn, metadata, false)
+}
+
+// saveTokenPair saves both tokens in one transaction, each row naming the other as partner
+func (p *postgresBackend) saveTokenPair(ctx context.Context, userId string, genAccess, genRefresh func() (string, error), accessValue, refreshValue interface{}, accessTTL, refreshTTL time.Duration, metadata map[string]string) (string, string, error) {
+	if err := checkExpiry(accessTTL); err != nil {
+		return "", "", err
+	}
+	if err := checkExpiry(refreshTTL); err != nil {
+		return "", "", err
+	}
+	av, err := p.opts.encodeValue(accessValue)
+	if err != nil {
+		return "", "", err
+	}
+	rv, err := p.opts.encodeValue(refreshValue)
+	if err != nil {
+		return "", "", err
+	}
+
+	var access, refresh string
+	err = p.tx(ctx, userId, func(tx *sql.Tx) error {
+		now := p.opts.now()
+		if err := p.checkIssueRate(ctx, tx, userId, now); err != nil {
+			return err
+		}
+		if _, err := p.cleanup(ctx, tx, userId, now); err != nil {
+			return err
+		}
+		access, err = p.saveUserTokenTx(ctx, tx, userId, genAccess, av, accessTTL, metadata, false, now)
+		if err != nil {
+			return err
+		}
+		refresh, err = p.saveUserTokenTx(ctx, tx, userId, genRefresh, rv, refreshTTL, metadata, false, now)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `UPDATE tokens SET partner = CASE token WHEN $1 THEN $2 ELSE $1 END WHERE token IN ($1, $2)`, access, refresh)
+		return err
+	})
+	if err != nil {
+		return "", "", err
+	}
+	return access, refresh, nil
+}
+
+func (p *postgresBackend) saveUnconfirmedUserToken(ctx context.Context, userId string, genToken func() (string, error), value interface{}, expiresIn time.Duration) (string, error) {
+	return p.saveNewUserToken(ctx, userId, genToken, value, expiresIn, nil, true)
+}
+
+func (p *postgresBackend) saveNewUserToken(ctx context.Context, userId string, genToken func() (string, error), value interface{}, expiresIn time.Duration, metadata map[string]string, unconfirmed bool) (string, error) {
+	if err := checkExpiry(expiresIn); err != nil {
+		return "", err
+	}
+	v, err := p.opts.encodeValue(value)
+	if err != nil {
+		return "", err
+	}
+
+	var token string
+	err = p.tx(ctx, userId, func(tx *sql.Tx) error {
+		now := p.opts.now()
+		if err := p.checkIssueRate(ctx, tx, userId, now); err != nil {
+			return err
+		}
+		if _, err := p.cleanup(ctx, tx, userId, now); err != nil {
+			return err
+		}
+		token, err = p.saveUserTokenTx(ctx, tx, userId, genToken, v, expiresIn, metadata, unconfirmed, now)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+func (p *postgresBackend) confirmUserToken(ctx context.Context, userId string, tokenString string) error {
+	res, err := p.db.ExecContext(ctx, `UPDATE tokens SET unconfirmed = FALSE WHERE user_id = $1 AND token = $2 AND `+pgLiveAt(3), userId, tokenString, p.opts.now())
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err == nil && n == 0 {
+		return ErrTokenNotFound
+	}
+	return err
+}
+
+// getOrCreateUserToken serializes the callers of a user on a transaction scoped
+// advisory lock, so only one of them creates a token.
+func (p *postgresBackend) getOrCreateUserToken(ctx context.Context, userId string, genToken func() (string, error), value interface{}, expiresIn time.Duration) (string, bool, error) {
+	if err := checkExpiry(expiresIn); err != nil {
+		return "", false, err
+	}
+	v, err := p.opts.encodeValue(value)
+	if err != nil {
+		return "", false, err
+	}
+
+	var token string
+	var created bool
+	err = p.tx(ctx, userId, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtext($1))`, userId); err != nil {
+			return err
+		}
+		now := p.opts.now()
+		if _, err := p.cleanup(ctx, tx, userId, now); err != nil {
+			return err
+		}
+		err := tx.QueryRowContext(ctx, `SELECT token FROM tokens WHERE user_id = $1 AND `+pgLiveAt(2)+` ORDER BY expires_at DESC, token DESC LIMIT 1`, userId, now).Scan(&token)
+		if err == nil {
+			created = false
+			return nil
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		if err := p.checkIssueRate(ctx, tx, userId, now); err != nil {
+			return err
+		}
+		token, err = p.saveUserTokenTx(ctx, tx, userId, genToken, v, expiresIn, nil, false, now)
+		created = err == nil
+		return err
+	})
+	if err != nil {
+		return "", false, err
+	}
+	return token, created, nil
+}
+
+func (p *postgresBackend) saveUserTokenWithId(ctx context.Context, userId string, token string, value interface{}, expiresIn time.Duration) (bool, error) {
+	if err := checkExpiry(expiresIn); err != nil {
+		return false, err
+	}
+	v, err := p.opts.encodeValue(value)
+	if err != nil {
+		return false, err
+	}
+
+	var created bool
+	err = p.tx(ctx, userId, func(tx *sql.Tx) error {
+		now := p.opts.now()
+		if err := p.checkIssueRate(ctx, tx, userId, now); err != nil {
+			return err
+		}
+		if _, err := p.cleanup(ctx, tx, userId, now); err != nil {
+			return err
+		}
+		created, err = p.insertToken(ctx, tx, token, userId, v, now.Add(expiresIn).UTC(), nil, false, now)
+		if err != nil {
+			return err
+		}
+		if !created {
+			// a retry of a save that went through, unless another user or none holds it
+			var owned bool
+			err := tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM tokens WHERE token = $1 AND user_id = $2)`, token, userId).Scan(&owned)
+			if err == nil && !owned {
+				err = ErrTokenTaken
+			}
+			return err
+		}
+		return p.trim(ctx, tx, userId)
+	})
+	return created, err
+}
+
+// saveUserTokens skips entries already expired or whose token is already stored
+func (p *postgresBackend) saveUserTokens(ctx context.Context, userId string, entries []TokenEntry) error {
+	values := make([]string, len(entries))
+	for i, entry := range entries {
+		v, err := p.opts.encodeValue(entry.Value)
+		if err != nil {
+			return err
+		}
+		values[i] = v
+	}
+
+	return p.tx(ctx, userId, func(tx *sql.Tx) error {
+		now := p.opts.now()
+		for i, entry := range entries {
+			if !entry.ExpiresAt.After(now) {
+				continue
+			}
+			if _, err := p.insertToken(ctx, tx, entry.Token, userId, values[i], entry.ExpiresAt.UTC(), entry.Metadata, false, now); err != nil {
+				return err
+			}
+		}
+		return p.trim(ctx, tx, userId)
+	})
+}
+
+// saveUserTokenPipe and deleteUserTokenPipe need a redis pipeline
+func (p *postgresBackend) saveUserTokenPipe(ctx context.Context, pipe redis.Pipeliner, userId string, genToken func() (string, error), value interface{}, expiresIn time.Duration) (string, func() error, error) {
+	return "", nil, ErrNotSupported
+}
+
+func (p *postgresBackend) deleteUserTokenPipe(ctx context.Context, pipe redis.Pipeliner, userId string, tokens ...string) func() error {
+	return func() error { return ErrNotSupported }
+}
+
+func (p *postgresBackend) loadUserToken(ctx context.Context, userId string, tokenString string) (*bUserTokenInfo, error) {
+	now := p.opts.now()
+	if p.opts.cleanupOnLoad() {
+		if _, err := p.cleanup(ctx, p.db, userId, now); err != nil {
+			return nil, err
+		}
+	}
+	row, err := p.selectUserToken(ctx, p.db, userId, tokenString, now)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case row.softRevoked:
+		userToken, err := row.userToken(p.opts)
+		if err != nil {
+			return nil, err
+		}
+		userToken.Revoked = true
+		return userToken, nil
+	case row.revoked:
+		return nil, ErrTokenRevoked
+	case row.unconfirmed:
+		return nil, ErrTokenUnconfirmed
+	}
+	if d := p.opts.slidingExpiration; d > 0 {
+		if err := p.refreshUserToken(ctx, userId, tokenString, d); err != nil {
+			return nil, err
+		}
+		row.expiresAt = sql.NullTime{Time: now.Add(d).UTC(), Valid: true}
+	}
+	return row.userToken(p.opts)
+}
+
+func (p *postgresBackend) loadUserTokensWithScope(ctx context.Context, userId string, scope string) ([]*bUserTokenInfo, error) {
+	list, err := p.loadUserTokenList(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+	return withScope(list, scope), nil
+}
+
+func (p *postgresBackend) loadUserTokenList(ctx context.Context, userId string) ([]*bUserTokenInfo, error) {
+	now := p.opts.now()
+	if _, err := p.cleanup(ctx, p.db, userId, now); err != nil {
+		return nil, err
+	}
+	rows, err := p.selectUserTokens(ctx, p.db, pgSelectUserToken+` WHERE user_id = $1 AND `+pgLiveAt(2)+p.listOrder(), userId, now)
+	if err != nil {
+		return nil, err
+	}
+	return userTokens(p.opts, rows)
+}
+
+func (p *postgresBackend) loadUserTokenListPaged(ctx context.Context, userId string, offset, limit int64) ([]*bUserTokenInfo, int64, error) {
+	now := p.opts.now()
+	if _, err := p.cleanup(ctx, p.db, userId, now); err != nil {
+		return nil, 0, err
+	}
+	count := sql.NullInt64{Int64: limit, Valid: limit >= 0} // LIMIT NULL is no limit
+
+	var userTokenList []*bUserTokenInfo
+	var total int64
+	err := p.tx(ctx, userId, func(tx *sql.Tx) error {
+		if err := tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM tokens WHERE user_id = $1 AND `+pgLiveAt(2), userId, now).Scan(&total); err != nil {
+			return err
+		}
+		rows, err := p.selectUserTokens(ctx, tx, pgSelectUserToken+` WHERE user_id = $1 AND `+pgLiveAt(2)+p.listOrder()+` OFFSET $3 LIMIT $4`, userId, now, max(offset, 0), count)
+		if err != nil {
+			return err
+		}
+		userTokenList, err = userTokens(p.opts, rows)
+		return err
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return userTokenList, total, nil
+}
+
+func (p *postgresBackend) deleteUserToken(ctx context.Context, userId string, tokens ...string) (int64, error) {
+	var deleted int64
+	err := p.tx(ctx, userId, func(tx *sql.Tx) error {
+		deleted = 0
+		for _, token := range tokens {
+			res, err := tx.ExecContext(ctx, `DELETE FROM tokens WHERE user_id = $1 AND token = $2`, userId, token)
+			if err != nil {
+				return err
+			}
+			n, err := res.RowsAffected()
+			if err != nil {
+				return err
+			}
+			deleted += n
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return deleted, nil
+}
+
+func (p *postgresBackend) deleteAllUserTokens(ctx context.Context, userIds ...string) error {
+	failed := make(map[string]error)
+	for _, userId := range userIds {
+		if _, err := p.db.ExecContext(ctx, `DELETE FROM tokens WHERE user_id = $1`, userId); err != nil {
+			failed[userId] = err
+		}
+	}
+	if len(failed) != 0 {
+		return &PartialFailureError{Errors: failed}
+	}
+	return nil
+}
+
+// moveUserTokens reassigns the rows of fromUserId, a token being its own row
+// can't be held by both users
+func (p *postgresBackend) moveUserTokens(ctx context.Context, fromUserId string, toUserId string) error {
+	_, err := p.db.ExecContext(ctx, `UPDATE tokens SET user_id = $2 WHERE user_id = $1`, fromUserId, toUserId)
+	return err
+}
+
+func (p *postgresBackend) deleteUserTokensExcept(ctx context.Context, userId string, keepToken string) error {
+	return p.tx(ctx, userId, func(tx *sql.Tx) error {
+		if _, err := p.selectUserToken(ctx, tx, userId, keepToken, p.opts.now()); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, `DELETE FROM tokens WHERE user_id = $1 AND token <> $2`, userId, keepToken)
+		return err
+	})
+}
+
+func (p *postgresBackend) countUserTokens(ctx context.Context, userId string) (int64, error) {
+	now := p.opts.now()
+	if _, err := p.cleanup(ctx, p.db, userId, now); err != nil {
+		return 0, err
+	}
+	var count int64
+	err := p.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM tokens WHERE user_id = $1 AND `+pgLiveAt(2), userId, now).Scan(&count)
+	return count, err
+}
+
+// userTokenExists reports whether tokenString is an active, unrevoked token of the user
+func (p *postgresBackend) userTokenExists(ctx context.Context, userId string, tokenString string) (bool, error) {
+	var ok bool
+	err := p.db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM tokens WHERE user_id = $1 AND token = $2 AND NOT revoked AND `+pgLiveAt(3)+`)`, userId, tokenString, p.opts.now()).Scan(&ok)
+	return ok, err
+}
+
+func (p *postgresBackend) refreshUserToken(ctx context.Context, userId string, tokenString string, expiresIn time.Duration) error {
+	if err := checkExpiry(expiresIn); err != nil {
+		return err
+	}
+	now := p.opts.now()
+	res, err := p.db.ExecContext(ctx, `UPDATE tokens SET expires_at = $3 WHERE user_id = $1 AND token = $2 AND NOT revoked AND NOT soft_revoked AND `+pgLiveAt(4), userId, tokenString, now.Add(expiresIn).UTC(), now)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil || n != 0 {
+		return err
+	}
+	row, err := p.selectUserToken(ctx, p.db, userId, tokenString, now)
+	if err != nil {
+		return err
+	}
+	if row.revoked || row.softRevoked {
+		return ErrTokenRevoked
+	}
+	return ErrTokenNotFound
+}
+
+func (p *postgresBackend) extendAllUserTokens(ctx context.Context, userId string, expiresIn time.Duration) error {
+	if err := checkExpiry(expiresIn); err != nil {
+		return err
+	}
+	now := p.opts.now()
+	_, err := p.db.ExecContext(ctx, `UPDATE tokens SET expires_at = $2 WHERE user_id = $1 AND NOT revoked AND NOT soft_revoked AND `+pgLiveAt(3), userId, now.Add(expiresIn).UTC(), now)
+	return err
+}
+
+func (p *postgresBackend) rotateUserToken(ctx context.Context, userId string, oldToken string, genToken func() (string, error), value interface{}, expiresIn time.Duration) (string, error) {
+	if err := checkExpiry(expiresIn); err != nil {
+		return "", err
+	}
+	v, err := p.opts.encodeValue(value)
+	if err != nil {
+		return "", err
+	}
+
+	var token string
+	err = p.tx(ctx, userId, func(tx *sql.Tx) error {
+		now := p.opts.now()
+		row, err := p.selectUserToken(ctx, tx, userId, oldToken, now)
+		if err != nil {
+			return err
+		}
+		if row.revoked {
+			return ErrTokenRevoked
+		}
+		if _, err := tx.ExecContext(ctx, `DELETE FROM tokens WHERE token = $1`, oldToken); err != nil {
+			return err
+		}
+		token, err = p.saveUserTokenTx(ctx, tx, userId, genToken, v, expiresIn, nil, false, now)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+func (p *postgresBackend) userIdForToken(ctx context.Context, tokenString string) (string, error) {
+	var userId string
+	err := p.db.QueryRowContext(ctx, `SELECT user_id FROM tokens WHERE token = $1 AND user_id IS NOT NULL AND `+pgLiveAt(2), tokenString, p.opts.now()).Scan(&userId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrTokenNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	return userId, nil
+}
+
+// reconcileUserToken has nothing to repair, the expiry of a user token being a
+// single column
+func (p *postgresBackend) reconcileUserToken(ctx context.Context, userId string, tokenString string) error {
+	_, err := p.selectUserToken(ctx, p.db, userId, tokenString, p.opts.now())
+	return err
+}
+
+func (p *postgresBackend) dumpUserTokens(ctx context.Context, userId string) ([]UserTokenDebug, error) {
+	now := p.opts.now()
+	rows, err := p.selectUserTokens(ctx, p.db, pgSelectUserToken+` WHERE user_id = $1 ORDER BY expires_at, token`, userId)
+	if err != nil {
+		return nil, err
+	}
+	dump := make([]UserTokenDebug, 0, len(rows))
+	for _, row := range rows {
+		entry := UserTokenDebug{
+			TokenString: row.token,
+			Score:       expireScore(row.expiresAt.Time),
+			TTL:         -2,
+		}
+		switch {
+		case !row.expiresAt.Valid:
+			entry.Exists, entry.TTL = true, -1
+		case row.expiresAt.Time.After(now):
+			entry.Exists, entry.TTL = true, row.expiresAt.Time.Sub(now)
+		}
+		dump = append(dump, entry)
+	}
+	return dump, nil
+}
+
+// scanUserIds pages through the user ids WithScanCount at a time, so fn can use
+// the backend without a query left open. The WithDefaultTimeout bounds each page.
+func (p *postgresBackend) scanUserIds(ctx context.Context, fn func(userId string) error) error {
+	after := ""
+	for {
+		userIds, err := p.userIdsAfter(ctx, after)
+		if err != nil {
+			return err
+		}
+		for _, userId := range userIds {
+			if err := fn(userId); err != nil {
+				return err
+			}
+		}
+		if int64(len(userIds)) < p.opts.scanCount {
+			return nil
+		}
+		after = userIds[len(userIds)-1]
+	}
+}
+
+// userIdsAfter returns the next WithScanCount user ids after after
+func (p *postgresBackend) userIdsAfter(ctx context.Context, after string) ([]string, error) {
+	ctx, cancel := p.opts.withDefaultTimeout(ctx)
+	defer cancel()
+	rows, err := p.db.QueryContext(ctx, `SELECT DISTINCT user_id FROM tokens WHERE user_id > $1 ORDER BY user_id LIMIT $2`, after, p.opts.scanCount)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	userIds := make([]string, 0, p.opts.scanCount)
+	for rows.Next() {
+		var userId string
+		if err := rows.Scan(&userId); err != nil {
+			return nil, err
+		}
+		userIds = append(userIds, userId)
+	}
+	return userIds, rows.Err()
+}
+
+func (p *postgresBackend) iterateUserTokens(ctx context.Context, userId string, fn func(*bUserTokenInfo) error) error {
+	userTokenList, err := p.loadUserTokenList(ctx, userId)
+	if err != nil {
+		return err
+	}
+	for _, userToken := range userTokenList {
+		if err := fn(userToken); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *postgresBackend) watchRevocations(ctx context.Context, fn func(token string)) error {
+	return ErrNotSupported
+}
+
+func (p *postgresBackend) ping(ctx context.Context) error {
+	return p.db.PingContext(ctx)
+}
+
+func (p *postgresBackend) close() error {
+	return p.db.Close()
+}
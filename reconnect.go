@@ -0,0 +1,435 @@
+package tokenmanager
+
+import (
+	"context"
+	"errors"
+	"github.com/redis/go-redis/v9"
+	"net"
+	"sync"
+	"time"
+)
+
+// reconnectBackend runs the redis backend on a client of the WithClientFactory
+// factory, created on first use unless the backend came with one. When a call
+// fails because the client is closed or can't connect, the client is replaced
+// with a new one from the factory. The failed command never reached the server,
+// so reads and writes that are a single command or safe to repeat run once more.
+// The others, like saving a user token or walking every user with a callback, may
+// have gone halfway before failing; they return the error for the caller to decide.
+type reconnectBackend struct {
+	template *redisBackend // copied onto every new client
+	hashed   bool
+	opts     *options
+
+	mu   sync.RWMutex
+	next backend // nil until the first client is created
+}
+
+// isConnectionLost reports whether err means the client can't reach the server
+// at all, as opposed to a failing command or a miss like redis.Nil
+func isConnectionLost(err error) bool {
+	if errors.Is(err, redis.ErrClosed) {
+		return true
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+func (b *reconnectBackend) bind(opts *options) {
+	b.opts = opts
+	b.template.opts = opts
+	if b.template.client != nil {
+		b.next = b.wrap(b.template)
+	}
+}
+
+// wrap returns r in the configured storage layout, bound to the options
+func (b *reconnectBackend) wrap(r *redisBackend) backend {
+	var next backend = r
+	if b.hashed {
+		next = &hashedRedisBackend{r: r}
+	}
+	next.bind(b.opts)
+	return next
+}
+
+// current returns the backend on the current client, creating the first one
+func (b *reconnectBackend) current(ctx context.Context) (backend, error) {
+	b.mu.RLock()
+	next := b.next
+	b.mu.RUnlock()
+	if next != nil {
+		return next, nil
+	}
+	return b.recreate(ctx, nil)
+}
+
+// recreate replaces the client of failed with a new one from the factory and
+// closes it. A backend replaced in the meantime is returned as it is.
+func (b *reconnectBackend) recreate(ctx context.Context, failed backend) (backend, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.next != failed {
+		return b.next, nil
+	}
+	client, err := b.opts.clientFactory()
+	if err != nil {
+		return nil, err
+	}
+	r := *b.template
+	r.client = client
+	b.next = b.wrap(&r)
+	if failed != nil {
+		if err := failed.close(); !errors.Is(err, redis.ErrClosed) {
+			b.opts.warn(ctx, "close", "", err)
+		}
+	}
+	return b.next, nil
+}
+
+// do runs fn on the current backend, and once more on a new client when the
+// connection is lost. fn must be a single command or safe to repeat.
+func (b *reconnectBackend) do(ctx context.Context, fn func(next backend) error) error {
+	next, err := b.current(ctx)
+	if err != nil {
+		return err
+	}
+	err = fn(next)
+	if !isConnectionLost(err) {
+		return err
+	}
+	next, recreateErr := b.recreate(ctx, next)
+	if recreateErr != nil {
+		b.opts.warn(ctx, "clientFactory", "", recreateErr)
+		return err
+	}
+	return fn(next)
+}
+
+// once runs fn on the current backend, replacing the client when the connection
+// is lost without running fn again, as fn may have written before it failed
+func (b *reconnectBackend) once(ctx context.Context, fn func(next backend) error) error {
+	next, err := b.current(ctx)
+	if err != nil {
+		return err
+	}
+	err = fn(next)
+	if isConnectionLost(err) {
+		if _, recreateErr := b.recreate(ctx, next); recreateErr != nil {
+			b.opts.warn(ctx, "clientFactory", "", recreateErr)
+		}
+	}
+	return err
+}
+
+func (b *reconnectBackend) close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.next == nil {
+		return nil
+	}
+	return b.next.close()
+}
+
+func (b *reconnectBackend) saveToken(ctx context.Context, token string, value interface{}, expire time.Duration) (ok bool, err error) {
+	err = b.do(ctx, func(next backend) error {
+		ok, err = next.saveToken(ctx, token, value, expire)
+		return err
+	})
+	return ok, err
+}
+
+func (b *reconnectBackend) loadToken(ctx context.Context, token string) (value string, err error) {
+	err = b.do(ctx, func(next backend) error {
+		value, err = next.loadToken(ctx, token)
+		return err
+	})
+	return value, err
+}
+
+func (b *reconnectBackend) loadTokenWithTTL(ctx context.Context, token string) (value string, ttl time.Duration, err error) {
+	err = b.do(ctx, func(next backend) error {
+		value, ttl, err = next.loadTokenWithTTL(ctx, token)
+		return err
+	})
+	return value, ttl, err
+}
+
+func (b *reconnectBackend) deleteToken(ctx context.Context, tokens ...string) (err error) {
+	return b.do(ctx, func(next backend) error {
+		return next.deleteToken(ctx, tokens...)
+	})
+}
+
+func (b *reconnectBackend) deleteTokenIfValue(ctx context.Context, token string, expected string) (deleted bool, err error) {
+	err = b.once(ctx, func(next backend) error {
+		deleted, err = next.deleteTokenIfValue(ctx, token, expected)
+		return err
+	})
+	return deleted, err
+}
+
+func (b *reconnectBackend) updateTokenValue(ctx context.Context, token string, value interface{}) (err error) {
+	return b.do(ctx, func(next backend) error {
+		return next.updateTokenValue(ctx, token, value)
+	})
+}
+
+func (b *reconnectBackend) updateTokenValueIfActive(ctx context.Context, userId string, token string, value interface{}) (err error) {
+	return b.do(ctx, func(next backend) error {
+		return next.updateTokenValueIfActive(ctx, userId, token, value)
+	})
+}
+
+func (b *reconnectBackend) isTokenExist(ctx context.Context, token string) (ok bool, err error) {
+	err = b.do(ctx, func(next backend) error {
+		ok, err = next.isTokenExist(ctx, token)
+		return err
+	})
+	return ok, err
+}
+
+func (b *reconnectBackend) areTokensExist(ctx context.Context, tokens ...string) (exists map[string]bool, err error) {
+	err = b.do(ctx, func(next backend) error {
+		exists, err = next.areTokensExist(ctx, tokens...)
+		return err
+	})
+	return exists, err
+}
+
+func (b *reconnectBackend) revokeToken(ctx context.Context, token string) (err error) {
+	return b.do(ctx, func(next backend) error {
+		return next.revokeToken(ctx, token)
+	})
+}
+
+func (b *reconnectBackend) softRevokeUserToken(ctx context.Context, userId string, token string, grace time.Duration) (err error) {
+	return b.do(ctx, func(next backend) error {
+		return next.softRevokeUserToken(ctx, userId, token, grace)
+	})
+}
+
+func (b *reconnectBackend) cleanupUserToken(ctx context.Context, userId string) (removed int64, err error) {
+	err = b.do(ctx, func(next backend) error {
+		removed, err = next.cleanupUserToken(ctx, userId)
+		return err
+	})
+	return removed, err
+}
+
+func (b *reconnectBackend) previewCleanupUserToken(ctx context.Context, userId string) (preview []string, err error) {
+	err = b.do(ctx, func(next backend) error {
+		preview, err = next.previewCleanupUserToken(ctx, userId)
+		return err
+	})
+	return preview, err
+}
+
+func (b *reconnectBackend) saveUserToken(ctx context.Context, userId string, genToken func() (string, error), value interface{}, expiresIn time.Duration, metadata map[string]string) (token string, err error) {
+	err = b.once(ctx, func(next backend) error {
+		token, err = next.saveUserToken(ctx, userId, genToken, value, expiresIn, metadata)
+		return err
+	})
+	return token, err
+}
+
+func (b *reconnectBackend) saveTokenPair(ctx context.Context, userId string, genAccess, genRefresh func() (string, error), accessValue, refreshValue interface{}, accessTTL, refreshTTL time.Duration, metadata map[string]string) (access string, refresh string, err error) {
+	err = b.once(ctx, func(next backend) error {
+		access, refresh, err = next.saveTokenPair(ctx, userId, genAccess, genRefresh, accessValue, refreshValue, accessTTL, refreshTTL, metadata)
+		return err
+	})
+	return access, refresh, err
+}
+
+func (b *reconnectBackend) saveUnconfirmedUserToken(ctx context.Context, userId string, genToken func() (string, error), value interface{}, expiresIn time.Duration) (token string, err error) {
+	err = b.once(ctx, func(next backend) error {
+		token, err = next.saveUnconfirmedUserToken(ctx, userId, genToken, value, expiresIn)
+		return err
+	})
+	return token, err
+}
+
+func (b *reconnectBackend) confirmUserToken(ctx context.Context, userId string, tokenString string) (err error) {
+	return b.do(ctx, func(next backend) error {
+		return next.confirmUserToken(ctx, userId, tokenString)
+	})
+}
+
+func (b *reconnectBackend) getOrCreateUserToken(ctx context.Context, userId string, genToken func() (string, error), value interface{}, expiresIn time.Duration) (token string, created bool, err error) {
+	err = b.once(ctx, func(next backend) error {
+		token, created, err = next.getOrCreateUserToken(ctx, userId, genToken, value, expiresIn)
+		return err
+	})
+	return token, created, err
+}
+
+func (b *reconnectBackend) saveUserTokenWithId(ctx context.Context, userId string, token string, value interface{}, expiresIn time.Duration) (created bool, err error) {
+	err = b.once(ctx, func(next backend) error {
+		created, err = next.saveUserTokenWithId(ctx, userId, token, value, expiresIn)
+		return err
+	})
+	return created, err
+}
+
+func (b *reconnectBackend) saveUserTokens(ctx context.Context, userId string, entries []TokenEntry) (err error) {
+	return b.once(ctx, func(next backend) error {
+		return next.saveUserTokens(ctx, userId, entries)
+	})
+}
+
+func (b *reconnectBackend) saveUserTokenPipe(ctx context.Context, pipe redis.Pipeliner, userId string, genToken func() (string, error), value interface{}, expiresIn time.Duration) (token string, result func() error, err error) {
+	// the pipe belongs to the caller's client, nothing runs here to retry
+	next, err := b.current(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+	return next.saveUserTokenPipe(ctx, pipe, userId, genToken, value, expiresIn)
+}
+
+func (b *reconnectBackend) deleteUserTokenPipe(ctx context.Context, pipe redis.Pipeliner, userId string, tokens ...string) func() error {
+	next, err := b.current(ctx)
+	if err != nil {
+		return func() error { return err }
+	}
+	return next.deleteUserTokenPipe(ctx, pipe, userId, tokens...)
+}
+
+func (b *reconnectBackend) loadUserToken(ctx context.Context, userId string, tokenString string) (info *bUserTokenInfo, err error) {
+	err = b.do(ctx, func(next backend) error {
+		info, err = next.loadUserToken(ctx, userId, tokenString)
+		return err
+	})
+	return info, err
+}
+
+func (b *reconnectBackend) loadUserTokenList(ctx context.Context, userId string) (list []*bUserTokenInfo, err error) {
+	err = b.do(ctx, func(next backend) error {
+		list, err = next.loadUserTokenList(ctx, userId)
+		return err
+	})
+	return list, err
+}
+
+func (b *reconnectBackend) loadUserTokensWithScope(ctx context.Context, userId string, scope string) (list []*bUserTokenInfo, err error) {
+	err = b.do(ctx, func(next backend) error {
+		list, err = next.loadUserTokensWithScope(ctx, userId, scope)
+		return err
+	})
+	return list, err
+}
+
+func (b *reconnectBackend) loadUserTokenListPaged(ctx context.Context, userId string, offset, limit int64) (list []*bUserTokenInfo, total int64, err error) {
+	err = b.do(ctx, func(next backend) error {
+		list, total, err = next.loadUserTokenListPaged(ctx, userId, offset, limit)
+		return err
+	})
+	return list, total, err
+}
+
+func (b *reconnectBackend) deleteUserToken(ctx context.Context, userId string, tokens ...string) (deleted int64, err error) {
+	err = b.once(ctx, func(next backend) error {
+		deleted, err = next.deleteUserToken(ctx, userId, tokens...)
+		return err
+	})
+	return deleted, err
+}
+
+func (b *reconnectBackend) moveUserTokens(ctx context.Context, fromUserId string, toUserId string) (err error) {
+	return b.once(ctx, func(next backend) error {
+		return next.moveUserTokens(ctx, fromUserId, toUserId)
+	})
+}
+
+func (b *reconnectBackend) deleteAllUserTokens(ctx context.Context, userIds ...string) (err error) {
+	return b.do(ctx, func(next backend) error {
+		return next.deleteAllUserTokens(ctx, userIds...)
+	})
+}
+
+func (b *reconnectBackend) deleteUserTokensExcept(ctx context.Context, userId string, keepToken string) (err error) {
+	return b.do(ctx, func(next backend) error {
+		return next.deleteUserTokensExcept(ctx, userId, keepToken)
+	})
+}
+
+func (b *reconnectBackend) countUserTokens(ctx context.Context, userId string) (count int64, err error) {
+	err = b.do(ctx, func(next backend) error {
+		count, err = next.countUserTokens(ctx, userId)
+		return err
+	})
+	return count, err
+}
+
+func (b *reconnectBackend) userTokenExists(ctx context.Context, userId string, tokenString string) (ok bool, err error) {
+	err = b.do(ctx, func(next backend) error {
+		ok, err = next.userTokenExists(ctx, userId, tokenString)
+		return err
+	})
+	return ok, err
+}
+
+func (b *reconnectBackend) refreshUserToken(ctx context.Context, userId string, tokenString string, expiresIn time.Duration) (err error) {
+	return b.do(ctx, func(next backend) error {
+		return next.refreshUserToken(ctx, userId, tokenString, expiresIn)
+	})
+}
+
+func (b *reconnectBackend) rotateUserToken(ctx context.Context, userId string, oldToken string, genToken func() (string, error), value interface{}, expiresIn time.Duration) (token string, err error) {
+	err = b.once(ctx, func(next backend) error {
+		token, err = next.rotateUserToken(ctx, userId, oldToken, genToken, value, expiresIn)
+		return err
+	})
+	return token, err
+}
+
+func (b *reconnectBackend) scanUserIds(ctx context.Context, fn func(userId string) error) (err error) {
+	return b.once(ctx, func(next backend) error {
+		return next.scanUserIds(ctx, fn)
+	})
+}
+
+func (b *reconnectBackend) iterateUserTokens(ctx context.Context, userId string, fn func(*bUserTokenInfo) error) (err error) {
+	return b.once(ctx, func(next backend) error {
+		return next.iterateUserTokens(ctx, userId, fn)
+	})
+}
+
+func (b *reconnectBackend) extendAllUserTokens(ctx context.Context, userId string, expiresIn time.Duration) (err error) {
+	return b.do(ctx, func(next backend) error {
+		return next.extendAllUserTokens(ctx, userId, expiresIn)
+	})
+}
+
+func (b *reconnectBackend) reconcileUserToken(ctx context.Context, userId string, tokenString string) (err error) {
+	return b.do(ctx, func(next backend) error {
+		return next.reconcileUserToken(ctx, userId, tokenString)
+	})
+}
+
+func (b *reconnectBackend) dumpUserTokens(ctx context.Context, userId string) (dump []UserTokenDebug, err error) {
+	err = b.do(ctx, func(next backend) error {
+		dump, err = next.dumpUserTokens(ctx, userId)
+		return err
+	})
+	return dump, err
+}
+
+func (b *reconnectBackend) userIdForToken(ctx context.Context, tokenString string) (userId string, err error) {
+	err = b.do(ctx, func(next backend) error {
+		userId, err = next.userIdForToken(ctx, tokenString)
+		return err
+	})
+	return userId, err
+}
+
+func (b *reconnectBackend) watchRevocations(ctx context.Context, fn func(token string)) error {
+	return b.do(ctx, func(next backend) error {
+		return next.watchRevocations(ctx, fn)
+	})
+}
+
+func (b *reconnectBackend) ping(ctx context.Context) (err error) {
+	return b.do(ctx, func(next backend) error {
+		return next.ping(ctx)
+	})
+}
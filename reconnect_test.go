@@ -0,0 +1,61 @@
+package tokenmanager
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestReconnectRetriesOnlyRepeatableCalls(t *testing.T) {
+	ctx := context.Background()
+	server := miniredis.RunT(t)
+	clients := 0
+	opts := &options{}
+	*opts = *defaultOptions
+	opts.clientFactory = func() (*redis.Client, error) {
+		clients++
+		return redis.NewClient(&redis.Options{Addr: server.Addr()}), nil
+	}
+	b := &reconnectBackend{template: &redisBackend{}}
+	b.bind(opts)
+	t.Cleanup(func() {
+		_ = b.close()
+	})
+
+	token, err := b.saveUserToken(ctx, "user", nil, "value", time.Hour, nil)
+	if err != nil {
+		t.Fatalf("saveUserToken: %v", err)
+	}
+	closeCurrent := func() {
+		current, err := b.current(ctx)
+		if err != nil {
+			t.Fatalf("current: %v", err)
+		}
+		_ = current.close()
+	}
+
+	closeCurrent()
+	if _, err := b.loadUserToken(ctx, "user", token); err != nil {
+		t.Fatalf("loadUserToken on a closed client: %v, want it retried on a new one", err)
+	}
+	closeCurrent()
+	if _, err := b.saveUserToken(ctx, "user", nil, "value", time.Hour, nil); !isConnectionLost(err) {
+		t.Fatalf("saveUserToken on a closed client: got %v, want the connection error", err)
+	}
+	if _, err := b.saveUserToken(ctx, "user", nil, "value", time.Hour, nil); err != nil {
+		t.Fatalf("saveUserToken after the client was replaced: %v", err)
+	}
+	if clients != 3 {
+		t.Fatalf("got %d clients, want 3", clients)
+	}
+	count, err := b.countUserTokens(ctx, "user")
+	if err != nil {
+		t.Fatalf("countUserTokens: %v", err)
+	}
+	if count != 2 {
+		t.Fatalf("countUserTokens: got %d, want the two saves that succeeded", count)
+	}
+}
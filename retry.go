@@ -0,0 +1,154 @@
+package tokenmanager
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// retryBackend retries the read operations of the next backend on transient
+// errors. Writes aren't retried, as a write may have been applied before failing.
+type retryBackend struct {
+	backend
+	opts *options
+}
+
+func (b *retryBackend) bind(opts *options) {
+	b.opts = opts
+	b.backend.bind(opts)
+}
+
+// isTransientError reports whether err is a transport error worth retrying, as
+// opposed to a miss, an error reply or the caller giving up.
+func isTransientError(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	return isTransportError(err)
+}
+
+// retry runs fn until it succeeds, fails for good or runs out of attempts, doubling
+// the backoff each time. It gives up early rather than wait past the ctx deadline.
+func (b *retryBackend) retry(ctx context.Context, fn func() error) error {
+	err := fn()
+	wait := b.opts.retryBackoff
+	for attempt := 1; attempt < b.opts.retryAttempts && isTransientError(err); attempt++ {
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < wait {
+			return err
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+		wait *= 2
+		err = fn()
+	}
+	return err
+}
+
+func (b *retryBackend) loadToken(ctx context.Context, token string) (value string, err error) {
+	err = b.retry(ctx, func() error {
+		value, err = b.backend.loadToken(ctx, token)
+		return err
+	})
+	return value, err
+}
+
+func (b *retryBackend) loadTokenWithTTL(ctx context.Context, token string) (value string, ttl time.Duration, err error) {
+	err = b.retry(ctx, func() error {
+		value, ttl, err = b.backend.loadTokenWithTTL(ctx, token)
+		return err
+	})
+	return value, ttl, err
+}
+
+func (b *retryBackend) isTokenExist(ctx context.Context, token string) (ok bool, err error) {
+	err = b.retry(ctx, func() error {
+		ok, err = b.backend.isTokenExist(ctx, token)
+		return err
+	})
+	return ok, err
+}
+
+func (b *retryBackend) loadUserToken(ctx context.Context, userId string, tokenString string) (info *bUserTokenInfo, err error) {
+	err = b.retry(ctx, func() error {
+		info, err = b.backend.loadUserToken(ctx, userId, tokenString)
+		return err
+	})
+	return info, err
+}
+
+func (b *retryBackend) loadUserTokenList(ctx context.Context, userId string) (list []*bUserTokenInfo, err error) {
+	err = b.retry(ctx, func() error {
+		list, err = b.backend.loadUserTokenList(ctx, userId)
+		return err
+	})
+	return list, err
+}
+
+func (b *retryBackend) loadUserTokensWithScope(ctx context.Context, userId string, scope string) (list []*bUserTokenInfo, err error) {
+	err = b.retry(ctx, func() error {
+		list, err = b.backend.loadUserTokensWithScope(ctx, userId, scope)
+		return err
+	})
+	return list, err
+}
+
+func (b *retryBackend) loadUserTokenListPaged(ctx context.Context, userId string, offset, limit int64) (list []*bUserTokenInfo, total int64, err error) {
+	err = b.retry(ctx, func() error {
+		list, total, err = b.backend.loadUserTokenListPaged(ctx, userId, offset, limit)
+		return err
+	})
+	return list, total, err
+}
+
+func (b *retryBackend) countUserTokens(ctx context.Context, userId string) (count int64, err error) {
+	err = b.retry(ctx, func() error {
+		count, err = b.backend.countUserTokens(ctx, userId)
+		return err
+	})
+	return count, err
+}
+
+func (b *retryBackend) userTokenExists(ctx context.Context, userId string, tokenString string) (ok bool, err error) {
+	err = b.retry(ctx, func() error {
+		ok, err = b.backend.userTokenExists(ctx, userId, tokenString)
+		return err
+	})
+	return ok, err
+}
+
+func (b *retryBackend) userIdForToken(ctx context.Context, tokenString string) (userId string, err error) {
+	err = b.retry(ctx, func() error {
+		userId, err = b.backend.userIdForToken(ctx, tokenString)
+		return err
+	})
+	return userId, err
+}
+
+func (b *retryBackend) dumpUserTokens(ctx context.Context, userId string) (dump []UserTokenDebug, err error) {
+	err = b.retry(ctx, func() error {
+		dump, err = b.backend.dumpUserTokens(ctx, userId)
+		return err
+	})
+	return dump, err
+}
+
+func (b *retryBackend) previewCleanupUserToken(ctx context.Context, userId string) (preview []string, err error) {
+	err = b.retry(ctx, func() error {
+		preview, err = b.backend.previewCleanupUserToken(ctx, userId)
+		return err
+	})
+	return preview, err
+}
+
+func (b *retryBackend) areTokensExist(ctx context.Context, tokens ...string) (exists map[string]bool, err error) {
+	err = b.retry(ctx, func() error {
+		exists, err = b.backend.areTokensExist(ctx, tokens...)
+		return err
+	})
+	return exists, err
+}
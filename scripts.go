@@ -0,0 +1,323 @@
+package tokenmanager
+
+import "github.com/redis/go-redis/v9"
+
+// KEYS[1] user token key, KEYS[2..] token keys of hashed tokens
+// ARGV[1] expire score upper bound, ARGV[2] token key prefix the members are appended to,
+// empty when tokens are hashed, ARGV[3..] user token members matching KEYS[2..]
+// members are listed here so none saved meanwhile is mistaken for a dangling one;
+// a hashed member missing from KEYS was saved since and is kept
+var cleanupUserTokenScript = redis.NewScript(`
+local removed = redis.call('ZREMRANGEBYSCORE', KEYS[1], '0', ARGV[1])
+local keys = {}
+for i = 2, #KEYS do
+	keys[ARGV[i + 1]] = KEYS[i]
+end
+for _, member in ipairs(redis.call('ZRANGE', KEYS[1], 0, -1)) do
+	local key = keys[member]
+	if ARGV[2] ~= '' then
+		key = ARGV[2] .. member
+	end
+	if key and redis.call('EXISTS', key) == 0 then
+		removed = removed + redis.call('ZREM', KEYS[1], member)
+	end
+end
+return removed
+`)
+
+// KEYS[1] token key, KEYS[2] revoked token key
+// ARGV[1] ttl milliseconds
+// returns -1 when the token key is gone, -2 when the token is revoked, whose
+// revocation expires with the expiry it had
+var extendActiveTokenScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[2]) == 1 then
+	return -2
+end
+if redis.call('PEXPIRE', KEYS[1], ARGV[1]) == 0 then
+	return -1
+end
+return 1
+`)
+
+// KEYS[1] user token key
+// ARGV[1] number of members to keep
+// returns the removed members
+var trimUserTokenScript = redis.NewScript(`
+local stop = -1 - tonumber(ARGV[1])
+local evicted = redis.call('ZRANGE', KEYS[1], 0, stop)
+if #evicted > 0 then
+	redis.call('ZREMRANGEBYRANK', KEYS[1], 0, stop)
+end
+return evicted
+`)
+
+// KEYS[1] user token key
+// ARGV[1] score, ARGV[2] member, ARGV[3] 'XX' to only update an existing member, 'NX' to only add a new one
+// the key expires with its furthest member
+var addUserTokenScript = redis.NewScript(`
+if ARGV[3] == 'XX' or ARGV[3] == 'NX' then
+	redis.call('ZADD', KEYS[1], ARGV[3], ARGV[1], ARGV[2])
+else
+	redis.call('ZADD', KEYS[1], ARGV[1], ARGV[2])
+end
+local top = redis.call('ZRANGE', KEYS[1], -1, -1, 'WITHSCORES')
+if top[2] then
+	redis.call('EXPIREAT', KEYS[1], math.floor(tonumber(top[2])))
+end
+return 1
+`)
+
+// KEYS[1] user token key
+// the key expires with its furthest member
+var expireUserTokenKeyScript = redis.NewScript(`
+local top = redis.call('ZRANGE', KEYS[1], -1, -1, 'WITHSCORES')
+if top[2] then
+	redis.call('EXPIREAT', KEYS[1], math.floor(tonumber(top[2])))
+end
+return 1
+`)
+
+// KEYS[1] token key, KEYS[2] user token key
+// ARGV[1] value, ARGV[2] ttl milliseconds or 0 for none, ARGV[3] score, ARGV[4] member
+// returns 0 when the token key already exists
+var saveUserTokenScript = redis.NewScript(`
+local ok
+if tonumber(ARGV[2]) > 0 then
+	ok = redis.call('SET', KEYS[1], ARGV[1], 'NX', 'PX', ARGV[2])
+else
+	ok = redis.call('SET', KEYS[1], ARGV[1], 'NX')
+end
+if not ok then
+	return 0
+end
+redis.call('ZADD', KEYS[2], ARGV[3], ARGV[4])
+local top = redis.call('ZRANGE', KEYS[2], -1, -1, 'WITHSCORES')
+redis.call('EXPIREAT', KEYS[2], math.floor(tonumber(top[2])))
+return 1
+`)
+
+// KEYS[1] user token creation key
+// ARGV[1] creation unix seconds, ARGV[2] member, ARGV[3] expiry unix seconds, ARGV[4] now unix seconds
+// keeps the first creation of the member, the key lives as long as its furthest member
+var recordCreatedScript = redis.NewScript(`
+redis.call('ZADD', KEYS[1], 'NX', ARGV[1], ARGV[2])
+local ttl = redis.call('TTL', KEYS[1])
+if ttl < 0 or tonumber(ARGV[4]) + ttl < tonumber(ARGV[3]) then
+	redis.call('EXPIREAT', KEYS[1], ARGV[3])
+end
+return 1
+`)
+
+// KEYS[1] source user token key, KEYS[2] destination user token key, KEYS[3..] further
+// source and destination pairs, the scope keys
+// a member both hold keeps the higher score, a destination expires with its furthest member
+var moveUserTokensScript = redis.NewScript(`
+for i = 1, #KEYS, 2 do
+	redis.call('ZUNIONSTORE', KEYS[i + 1], 2, KEYS[i], KEYS[i + 1], 'AGGREGATE', 'MAX')
+	redis.call('DEL', KEYS[i])
+	local top = redis.call('ZRANGE', KEYS[i + 1], -1, -1, 'WITHSCORES')
+	if top[2] then
+		redis.call('EXPIREAT', KEYS[i + 1], math.floor(tonumber(top[2])))
+	end
+end
+return 1
+`)
+
+// KEYS[1] token key, KEYS[2..] other keys of the token
+// ARGV[1] expected value
+// returns 1 when the value matched and the keys were deleted
+var deleteTokenIfValueScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+redis.call('UNLINK', unpack(KEYS))
+return 1
+`)
+
+// KEYS[1] user token key, KEYS[2] token key, KEYS[3] revoked token key
+// ARGV[1] member, ARGV[2] value, ARGV[3] now
+// returns -1 when the token is gone, -2 when it is revoked, the TTL of the token key is kept
+var updateActiveUserTokenScript = redis.NewScript(`
+local score = redis.call('ZSCORE', KEYS[1], ARGV[1])
+if not score or tonumber(score) <= tonumber(ARGV[3]) or redis.call('EXISTS', KEYS[2]) == 0 then
+	return -1
+end
+if redis.call('EXISTS', KEYS[3]) == 1 then
+	return -2
+end
+redis.call('SET', KEYS[2], ARGV[2], 'XX', 'KEEPTTL')
+return 1
+`)
+
+// KEYS[1] issue counter key
+// ARGV[1] window milliseconds
+// returns the count including this issue, the window starts with the first one
+var issueRateScript = redis.NewScript(`
+local n = redis.call('INCR', KEYS[1])
+if n == 1 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[1])
+end
+return n
+`)
+
+// KEYS[1] user token hash, KEYS[2] user token expiry set, KEYS[3] user token metadata hash
+// ARGV[1] expire score upper bound
+var hashedCleanupUserTokenScript = redis.NewScript(`
+local expired = redis.call('ZRANGEBYSCORE', KEYS[2], '0', ARGV[1])
+for _, token in ipairs(expired) do
+	redis.call('HDEL', KEYS[1], token)
+	redis.call('HDEL', KEYS[3], token)
+end
+if #expired > 0 then
+	redis.call('ZREMRANGEBYSCORE', KEYS[2], '0', ARGV[1])
+end
+return #expired
+`)
+
+// KEYS[1] user token hash, KEYS[2] user token expiry set, KEYS[3] user token metadata hash
+// ARGV[1] token, ARGV[2] value, ARGV[3] score, ARGV[4] metadata json or empty, ARGV[5] max tokens or 0
+// returns 0 when the token already exists, the keys expire with the furthest token
+var hashedSaveUserTokenScript = redis.NewScript(`
+if redis.call('HSETNX', KEYS[1], ARGV[1], ARGV[2]) == 0 then
+	return 0
+end
+redis.call('ZADD', KEYS[2], ARGV[3], ARGV[1])
+if ARGV[4] ~= '' then
+	redis.call('HSET', KEYS[3], ARGV[1], ARGV[4])
+end
+local keep = tonumber(ARGV[5])
+if keep > 0 then
+	local stop = -1 - keep
+	local evicted = redis.call('ZRANGE', KEYS[2], 0, stop)
+	for _, token in ipairs(evicted) do
+		redis.call('HDEL', KEYS[1], token)
+		redis.call('HDEL', KEYS[3], token)
+	end
+	if #evicted > 0 then
+		redis.call('ZREMRANGEBYRANK', KEYS[2], 0, stop)
+	end
+end
+local top = redis.call('ZRANGE', KEYS[2], -1, -1, 'WITHSCORES')
+local at = math.floor(tonumber(top[2]))
+for i = 1, #KEYS do
+	redis.call('EXPIREAT', KEYS[i], at)
+end
+return 1
+`)
+
+// KEYS[1..3] source user token hash, expiry set and metadata hash, KEYS[4..6] the destination ones
+// a token both hold keeps the value and metadata of the later expiry
+var hashedMoveUserTokensScript = redis.NewScript(`
+local members = redis.call('ZRANGE', KEYS[2], 0, -1, 'WITHSCORES')
+for i = 1, #members, 2 do
+	local token, score = members[i], tonumber(members[i + 1])
+	local current = redis.call('ZSCORE', KEYS[5], token)
+	if not current or tonumber(current) < score then
+		redis.call('ZADD', KEYS[5], score, token)
+		local value = redis.call('HGET', KEYS[1], token)
+		if value then
+			redis.call('HSET', KEYS[4], token, value)
+		end
+		local meta = redis.call('HGET', KEYS[3], token)
+		if meta then
+			redis.call('HSET', KEYS[6], token, meta)
+		else
+			redis.call('HDEL', KEYS[6], token)
+		end
+	end
+end
+redis.call('DEL', KEYS[1], KEYS[2], KEYS[3])
+local top = redis.call('ZRANGE', KEYS[5], -1, -1, 'WITHSCORES')
+if top[2] then
+	local at = math.floor(tonumber(top[2]))
+	for i = 4, 6 do
+		redis.call('EXPIREAT', KEYS[i], at)
+	end
+end
+return #members / 2
+`)
+
+// KEYS[1] user token hash, KEYS[2] user token expiry set, KEYS[3] user token metadata hash
+// ARGV[1] score, ARGV[2] token
+// returns 0 when the token doesn't exist
+var hashedRefreshUserTokenScript = redis.NewScript(`
+if not redis.call('ZSCORE', KEYS[2], ARGV[2]) or redis.call('HEXISTS', KEYS[1], ARGV[2]) == 0 then
+	return 0
+end
+redis.call('ZADD', KEYS[2], ARGV[1], ARGV[2])
+local top = redis.call('ZRANGE', KEYS[2], -1, -1, 'WITHSCORES')
+local at = math.floor(tonumber(top[2]))
+for i = 1, #KEYS do
+	redis.call('EXPIREAT', KEYS[i], at)
+end
+return 1
+`)
+
+// KEYS[1] user token hash, KEYS[2] user token expiry set, KEYS[3] user token metadata hash
+// ARGV[1] score
+// returns the number of tokens extended
+var hashedExtendUserTokensScript = redis.NewScript(`
+local tokens = redis.call('ZRANGE', KEYS[2], 0, -1)
+for _, token in ipairs(tokens) do
+	redis.call('ZADD', KEYS[2], 'XX', ARGV[1], token)
+end
+if #tokens > 0 then
+	for i = 1, #KEYS do
+		redis.call('EXPIREAT', KEYS[i], ARGV[1])
+	end
+end
+return #tokens
+`)
+
+// KEYS[1] user token key, KEYS[2] old token key, KEYS[3] old token meta key,
+// KEYS[4] old revoked token key, KEYS[5] new token key
+// ARGV[1] old member, ARGV[2] new member, ARGV[3] value, ARGV[4] ttl milliseconds or 0 for none,
+// ARGV[5] score, ARGV[6] now
+// returns -1 when the old token is gone, -2 when it is revoked, 0 when the new token key exists
+var rotateUserTokenScript = redis.NewScript(`
+local score = redis.call('ZSCORE', KEYS[1], ARGV[1])
+if not score or tonumber(score) <= tonumber(ARGV[6]) or redis.call('EXISTS', KEYS[2]) == 0 then
+	return -1
+end
+if redis.call('EXISTS', KEYS[4]) == 1 then
+	return -2
+end
+local ok
+if tonumber(ARGV[4]) > 0 then
+	ok = redis.call('SET', KEYS[5], ARGV[3], 'NX', 'PX', ARGV[4])
+else
+	ok = redis.call('SET', KEYS[5], ARGV[3], 'NX')
+end
+if not ok then
+	return 0
+end
+redis.call('ZREM', KEYS[1], ARGV[1])
+redis.call('UNLINK', KEYS[2], KEYS[3])
+redis.call('ZADD', KEYS[1], ARGV[5], ARGV[2])
+local top = redis.call('ZRANGE', KEYS[1], -1, -1, 'WITHSCORES')
+redis.call('EXPIREAT', KEYS[1], math.floor(tonumber(top[2])))
+return 1
+`)
+
+// KEYS[1] user token hash, KEYS[2] user token expiry set, KEYS[3] user token metadata hash
+// ARGV[1] old token, ARGV[2] new token, ARGV[3] value, ARGV[4] score, ARGV[5] now
+// returns -1 when the old token is gone, 0 when the new token exists
+var hashedRotateUserTokenScript = redis.NewScript(`
+local score = redis.call('ZSCORE', KEYS[2], ARGV[1])
+if not score or tonumber(score) <= tonumber(ARGV[5]) or redis.call('HEXISTS', KEYS[1], ARGV[1]) == 0 then
+	return -1
+end
+if redis.call('HSETNX', KEYS[1], ARGV[2], ARGV[3]) == 0 then
+	return 0
+end
+redis.call('HDEL', KEYS[1], ARGV[1])
+redis.call('HDEL', KEYS[3], ARGV[1])
+redis.call('ZREM', KEYS[2], ARGV[1])
+redis.call('ZADD', KEYS[2], ARGV[4], ARGV[2])
+local top = redis.call('ZRANGE', KEYS[2], -1, -1, 'WITHSCORES')
+local at = math.floor(tonumber(top[2]))
+for i = 1, #KEYS do
+	redis.call('EXPIREAT', KEYS[i], at)
+end
+return 1
+`)
@@ -0,0 +1,63 @@
+package tokenmanager
+
+import (
+	"errors"
+	"strings"
+	"sync/atomic"
+)
+
+// Stats are the cumulative counts of a manager's backend operations since it was created
+type Stats struct {
+	Saves             int64 // token saves and rotations
+	Loads             int64 // single token loads, by token or as a user token
+	Hits              int64 // loads that found the token
+	Misses            int64 // loads failing with ErrTokenNotFound
+	Cleanups          int64 // user token sweeps run by Cleanup and the janitor
+	CollisionsRetried int64 // generated tokens that collided and were generated again
+}
+
+// stats counts the operations of a manager, shared by its copies of the options.
+// A nil stats counts nothing.
+type stats struct {
+	saves, loads, hits, misses, cleanups, collisions atomic.Int64
+}
+
+// record counts the backend operation op that ended with err
+func (s *stats) record(op string, err error) {
+	if s == nil {
+		return
+	}
+	switch {
+	case op == "loadToken" || op == "loadTokenWithTTL" || op == "loadUserToken":
+		s.loads.Add(1)
+		if err == nil {
+			s.hits.Add(1)
+		} else if errors.Is(err, ErrTokenNotFound) {
+			s.misses.Add(1)
+		}
+	case op == "cleanupUserToken":
+		s.cleanups.Add(1)
+	case err == nil && (strings.HasPrefix(op, "save") || op == "rotateUserToken"):
+		s.saves.Add(1)
+	}
+}
+
+func (s *stats) collision() {
+	if s != nil {
+		s.collisions.Add(1)
+	}
+}
+
+func (s *stats) snapshot() Stats {
+	if s == nil {
+		return Stats{}
+	}
+	return Stats{
+		Saves:             s.saves.Load(),
+		Loads:             s.loads.Load(),
+		Hits:              s.hits.Load(),
+		Misses:            s.misses.Load(),
+		Cleanups:          s.cleanups.Load(),
+		CollisionsRetried: s.collisions.Load(),
+	}
+}
@@ -1,13 +1,31 @@
 package tokenmanager
 
+import (
+	"context"
+	"strings"
+)
+
 type tokenCreator interface {
 	GenerateToken() (string, error)
 }
 
-type opaqueTokenCreator struct{}
+// defaultTokenBytes is the randomness of an opaque token, minTokenBytes the least
+// WithDefaultTokenGenerator accepts: 128 bits, beyond any chance of collision.
+const (
+	defaultTokenBytes = 48
+	minTokenBytes     = 16
+)
+
+type opaqueTokenCreator struct {
+	length int // random bytes, defaultTokenBytes when 0
+}
 
 func (o *opaqueTokenCreator) GenerateToken() (string, error) {
-	return generateURLSafeOpaqueToken(48), nil
+	length := o.length
+	if length == 0 {
+		length = defaultTokenBytes
+	}
+	return readURLSafeOpaqueToken(length)
 }
 
 type jwtTokenCreator struct{}
@@ -15,3 +33,66 @@ type jwtTokenCreator struct{}
 func (o *jwtTokenCreator) GenerateToken() (string, error) {
 	return generateURLSafeOpaqueToken(48), nil
 }
+
+// CollisionAction tells the token generation what to do after a generated token
+// collided with a stored one
+type CollisionAction int
+
+const (
+	// CollisionRetry generates another token
+	CollisionRetry CollisionAction = iota
+	// CollisionAbort gives up with ErrTokenGenerationExhausted
+	CollisionAbort
+	// CollisionWiden generates another token with extra random characters appended,
+	// which add up over the collisions that ask for it
+	CollisionWiden
+)
+
+// CollisionPolicy decides what to do after the attempt-th generated token collided,
+// counting from 1. WithMaxTokenAttempts still bounds the attempts.
+type CollisionPolicy func(attempt int) CollisionAction
+
+// widenBytes is the randomness CollisionWiden appends to a token
+const widenBytes = 6
+
+// generateToken saves tokens from genToken until save reports one didn't collide,
+// consulting the collision policy after each collision, until ctx is done.
+// A nil genToken uses the configured token generator.
+func (o *options) generateToken(ctx context.Context, genToken func() (string, error), save func(token string) (bool, error)) (string, error) {
+	if genToken == nil {
+		genToken = o.tokenCreator.GenerateToken
+	}
+	var suffix strings.Builder
+	for attempt := 1; attempt <= max(o.maxTokenAttempts, 1); attempt++ {
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+		if attempt > 1 {
+			o.stats.collision()
+		}
+		token, err := genToken()
+		if err != nil {
+			return "", err
+		}
+		token += suffix.String()
+
+		ok, err := save(token)
+		if err != nil {
+			return "", err
+		}
+		if ok {
+			return token, nil
+		}
+
+		if o.collisionPolicy == nil {
+			continue
+		}
+		switch o.collisionPolicy(attempt) {
+		case CollisionAbort:
+			return "", ErrTokenGenerationExhausted
+		case CollisionWiden:
+			suffix.WriteString(generateURLSafeOpaqueToken(widenBytes))
+		}
+	}
+	return "", ErrTokenGenerationExhausted
+}
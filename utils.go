@@ -2,8 +2,15 @@ package tokenmanager
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"errors"
+	"github.com/redis/go-redis/v9"
+	"io"
+	"net"
+	"syscall"
+	"time"
 )
 
 func generateURLSafeOpaqueToken(length int) string {
@@ -18,11 +25,87 @@ func generateURLSafeOpaqueToken(length int) string {
 	return token
 }
 
+// readURLSafeOpaqueToken is generateURLSafeOpaqueToken failing when crypto/rand does
+func readURLSafeOpaqueToken(length int) (string, error) {
+	bytes := make([]byte, length)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(bytes), nil
+}
+
+// checkExpiry rejects a non-positive expiresIn for a user token, whose value
+// would be gone at once, or never expire, next to a member left dangling.
+// A bare saveToken only rejects a negative one, 0 stores it without expiry.
+func checkExpiry(expiresIn time.Duration) error {
+	if expiresIn <= 0 {
+		return ErrInvalidExpiry
+	}
+	return nil
+}
+
+// expireScore is the user token score of a token expiring at expire: the expiry
+// rounded up to the second. A member is expired once its score is <= now, which a
+// rounded down score would reach up to a second before the token expires.
+// Scores are unix seconds, so they don't depend on the timezone of expire.
+func expireScore(expire time.Time) int64 {
+	score := expire.Unix()
+	if expire.Nanosecond() > 0 {
+		score++
+	}
+	return score
+}
+
+// ttlMillis is ttl as a PX argument, where 0 means no expiry, so a positive ttl
+// under a millisecond becomes 1.
+func ttlMillis(ttl time.Duration) int64 {
+	ms := ttl.Milliseconds()
+	if ttl > 0 && ms == 0 {
+		ms = 1
+	}
+	return ms
+}
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// Fingerprint identifies tokenString in logs without revealing it: the first
+// 8 hex digits of its SHA-256
+func Fingerprint(tokenString string) string {
+	return sha256Hex(tokenString)[:8]
+}
+
 func errorWrap(err error) error {
+	var backendErr *BackendError
 	switch {
+	case err == nil:
+		return nil
 	case errors.Is(err, ErrTokenNotFound):
 		return ErrInvalidToken
+	case errors.As(err, &backendErr):
+		return err
+	case isTransportError(err):
+		return &BackendError{Err: err}
 	default:
 		return err
 	}
 }
+
+// isTransportError reports whether err comes from reaching the storage rather
+// than from the token itself: connection failures, not the replies of a server
+// that was reached.
+func isTransportError(err error) bool {
+	if errors.Is(err, redis.Nil) {
+		return false
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) ||
+		errors.Is(err, redis.ErrClosed) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EPIPE)
+}
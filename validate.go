@@ -0,0 +1,104 @@
+package tokenmanager
+
+import (
+	"context"
+	"time"
+)
+
+// validatedBackend fails the token loads of the next backend that the
+// WithLoadValidator hook rejects
+type validatedBackend struct {
+	backend
+	opts *options
+}
+
+func (b *validatedBackend) bind(opts *options) {
+	b.opts = opts
+	b.backend.bind(opts)
+}
+
+func (b *validatedBackend) loadToken(ctx context.Context, token string) (string, error) {
+	value, err := b.backend.loadToken(ctx, token)
+	if err != nil {
+		return "", err
+	}
+	if err := b.opts.loadValidator(ctx, token, value); err != nil {
+		return "", err
+	}
+	return value, nil
+}
+
+func (b *validatedBackend) loadTokenWithTTL(ctx context.Context, token string) (string, time.Duration, error) {
+	value, ttl, err := b.backend.loadTokenWithTTL(ctx, token)
+	if err != nil {
+		return "", 0, err
+	}
+	if err := b.opts.loadValidator(ctx, token, value); err != nil {
+		return "", 0, err
+	}
+	return value, ttl, nil
+}
+
+func (b *validatedBackend) loadUserToken(ctx context.Context, userId string, tokenString string) (*bUserTokenInfo, error) {
+	userToken, err := b.backend.loadUserToken(ctx, userId, tokenString)
+	if err != nil {
+		return nil, err
+	}
+	if err := b.opts.loadValidator(ctx, tokenString, userToken.TokenData); err != nil {
+		return nil, err
+	}
+	return userToken, nil
+}
+
+// validate runs the hook on every token of list, failing the whole list with the
+// first error, as a load of that token alone would
+func (b *validatedBackend) validate(ctx context.Context, list []*bUserTokenInfo) error {
+	for _, userToken := range list {
+		if err := b.opts.loadValidator(ctx, userToken.TokenString, userToken.TokenData); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *validatedBackend) loadUserTokenList(ctx context.Context, userId string) ([]*bUserTokenInfo, error) {
+	list, err := b.backend.loadUserTokenList(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+	if err := b.validate(ctx, list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+func (b *validatedBackend) loadUserTokensWithScope(ctx context.Context, userId string, scope string) ([]*bUserTokenInfo, error) {
+	list, err := b.backend.loadUserTokensWithScope(ctx, userId, scope)
+	if err != nil {
+		return nil, err
+	}
+	if err := b.validate(ctx, list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+func (b *validatedBackend) loadUserTokenListPaged(ctx context.Context, userId string, offset, limit int64) ([]*bUserTokenInfo, int64, error) {
+	list, total, err := b.backend.loadUserTokenListPaged(ctx, userId, offset, limit)
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := b.validate(ctx, list); err != nil {
+		return nil, 0, err
+	}
+	return list, total, nil
+}
+
+func (b *validatedBackend) iterateUserTokens(ctx context.Context, userId string, fn func(*bUserTokenInfo) error) error {
+	return b.backend.iterateUserTokens(ctx, userId, func(userToken *bUserTokenInfo) error {
+		if err := b.opts.loadValidator(ctx, userToken.TokenString, userToken.TokenData); err != nil {
+			return err
+		}
+		return fn(userToken)
+	})
+}